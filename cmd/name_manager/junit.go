@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// junitTestSuites is the root of a JUnit XML report.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut *junitOutput  `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitOutput struct {
+	Text string `xml:",cdata"`
+}
+
+// writeJUnit writes a JUnit XML report for the tests run by "run", with
+// one test suite named after the family.  The failed tests are the tests
+// that failed or timed out, and the tests in error are the tests that
+// could not run to completion, e.g., because the name was lost.  The log
+// of a test is its system-out.
+func writeJUnit(path string, family string, tests []*runTest, start time.Time, duration time.Duration) error {
+	suite := junitTestSuite{
+		Name:      family,
+		Tests:     len(tests),
+		Time:      junitTime(duration),
+		Timestamp: start.Format("2006-01-02T15:04:05"),
+	}
+	for _, test := range tests {
+		testCase := junitTestCase{
+			Name:      test.command,
+			ClassName: family,
+			Time:      junitTime(test.duration),
+		}
+		message := &junitMessage{Message: test.message()}
+		switch test.status() {
+		case statusFail, statusTimeout:
+			testCase.Failure = message
+			suite.Failures++
+		case statusLost, statusInterrupted, statusError:
+			testCase.Error = message
+			suite.Errors++
+		case statusSkipped:
+			testCase.Skipped = message
+			suite.Skipped++
+		}
+		if test.result != nil {
+			log, err := ioutil.ReadFile(test.logPath)
+			if err != nil {
+				return err
+			}
+			testCase.SystemOut = &junitOutput{Text: string(log)}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(f)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// junitTime formats a duration in seconds, as expected in JUnit XML
+// reports.
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -4,13 +4,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/hchauvin/name_manager/pkg/server"
 	"github.com/urfave/cli/v2"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
 
 	"fmt"
 
@@ -32,24 +40,383 @@ func getNameManager(c *cli.Context) (name_manager.NameManager, error) {
 	return name_manager.CreateFromURL(c.String("backend"))
 }
 
-func printNames(names []name_manager.Name) {
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Name", "Family", "Created At", "Updated At", "Free"})
-	for _, name := range names {
-		updatedAtStr := ""
-		if !name.UpdatedAt.Equal(name.CreatedAt) {
-			updatedAtStr = humanize.Time(name.UpdatedAt)
+// acquireOptions gets the acquisition options from the command-line flags.
+func acquireOptions(c *cli.Context) ([]name_manager.AcquireOption, error) {
+	var opts []name_manager.AcquireOption
+	labels, err := name_manager.ParseKeyValues(c.StringSlice("label"))
+	if err != nil {
+		return nil, err
+	}
+	if labels != nil {
+		opts = append(opts, name_manager.WithLabels(labels))
+	}
+	attributes, err := name_manager.ParseKeyValues(c.StringSlice("require"))
+	if err != nil {
+		return nil, err
+	}
+	if attributes != nil {
+		opts = append(opts, name_manager.WithRequiredAttributes(attributes))
+	}
+	selector, err := name_manager.ParseSelector(c.String("selector"))
+	if err != nil {
+		return nil, err
+	}
+	if selector != nil {
+		opts = append(opts, name_manager.WithSelector(selector))
+	}
+	if ttl := c.Duration("ttl"); ttl > 0 {
+		opts = append(opts, name_manager.WithTTL(ttl))
+	}
+	return opts, nil
+}
+
+// labelFlag is the flag used to attach labels to acquired names.
+var labelFlag = &cli.StringSliceFlag{
+	Name:  "label",
+	Usage: "label to attach to the name, in the key=value format (can be repeated)",
+}
+
+// requireFlag is the flag used to only acquire the names with some
+// attributes.
+var requireFlag = &cli.StringSliceFlag{
+	Name:  "require",
+	Usage: "attribute the name must have, in the key=value format (can be repeated)",
+}
+
+// selectorFlag is the flag used to only acquire the names whose
+// attributes match a selector.
+var selectorFlag = &cli.StringFlag{
+	Name:  "selector",
+	Usage: "selector the attributes of the name must match (e.g., 'profile=large,region!=eu')",
+}
+
+// ttlFlag is the flag used to set the TTL of the leases.
+var ttlFlag = &cli.DurationFlag{
+	Name:  "ttl",
+	Usage: "time after which the name is released if it is not kept alive (0 for the default of the backend)",
+}
+
+// leaseFlags are the flags used to give the lease on a name to the
+// commands that act on held names.
+var leaseFlags = []cli.Flag{
+	&cli.Int64Flag{
+		Name:  "token",
+		Usage: "lease token given on acquisition (required unless --force is given)",
+	},
+	&cli.BoolFlag{
+		Name:  "force",
+		Usage: "skip the lease check, and act on the name whoever holds it",
+	},
+}
+
+// getLease gets the lease on a name from the <family> <name> arguments
+// and the lease flags.  With --force, the lease has no token, and matches
+// any lease on the name.
+func getLease(c *cli.Context) (name_manager.Lease, error) {
+	family := c.Args().Get(0)
+	name := c.Args().Get(1)
+	if family == "" || name == "" {
+		return name_manager.Lease{}, fmt.Errorf("expected arguments to be <family> <name>")
+	}
+	if c.Bool("force") {
+		if c.IsSet("token") {
+			return name_manager.Lease{}, fmt.Errorf("--token and --force are mutually exclusive")
 		}
-		freeStr := ""
-		if name.Free {
-			freeStr = "X"
+		return name_manager.Lease{Family: family, Name: name}, nil
+	}
+	if c.Int64("token") <= 0 {
+		return name_manager.Lease{}, fmt.Errorf("expected --token to be the lease token given on acquisition, or --force to skip the lease check")
+	}
+	return name_manager.Lease{Family: family, Name: name, Token: c.Int64("token")}, nil
+}
+
+// hookFlags are the flags used to set the lifecycle hooks of the names
+// that are held.
+var hookFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "on-create",
+		Usage: "shell command run before handing out a brand-new name",
+	},
+	&cli.StringFlag{
+		Name:  "on-acquire",
+		Usage: "shell command run before handing out a name that was used before",
+	},
+	&cli.StringFlag{
+		Name:  "on-release",
+		Usage: "shell command run before releasing the name",
+	},
+}
+
+// acquireHooks gets the lifecycle hooks of hold and run from the
+// command-line flags (see hookFlags), or nil if there are none.
+func acquireHooks(c *cli.Context) *name_manager.Hooks {
+	hooks := &name_manager.Hooks{
+		OnCreate:  hookFunc(c, "on-create"),
+		OnAcquire: hookFunc(c, "on-acquire"),
+		OnRelease: hookFunc(c, "on-release"),
+	}
+	if hooks.OnCreate == nil && hooks.OnAcquire == nil && hooks.OnRelease == nil {
+		return nil
+	}
+	return hooks
+}
+
+// destroyHook gets the onDestroy hook of gc from the command-line flags,
+// or nil if there is none.
+func destroyHook(c *cli.Context) name_manager.HookFunc {
+	return hookFunc(c, "on-destroy")
+}
+
+// hookFunc gets a hook from a command-line flag, or nil if the flag is
+// not set.  The hooks are shell commands (see name_manager.CommandHook).
+func hookFunc(c *cli.Context, flag string) name_manager.HookFunc {
+	if command := c.String(flag); command != "" {
+		return name_manager.CommandHook(command)
+	}
+	return nil
+}
+
+// destroy runs the onDestroy hook on the names that were released.  The
+// names are acquired while the hook runs, and the names that were
+// acquired by someone else in the meantime are skipped.
+func destroy(ctx context.Context, mng name_manager.NameManager, onDestroy name_manager.HookFunc, leases []name_manager.Lease) error {
+	failed := 0
+	for _, lease := range leases {
+		lease, err := mng.TryAcquireContext(ctx, lease.Family, lease.Name)
+		if err == name_manager.ErrInUse {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := name_manager.RunHook(ctx, mng, "onDestroy", onDestroy, lease); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+		}
+		if err := mng.ReleaseContext(ctx, lease); err != nil {
+			return err
 		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d onDestroy hooks failed", failed)
+	}
+	return nil
+}
+
+// heldNames are names held by "hold".
+type heldNames struct {
+	// cmd is the command to run, with the placeholders substituted.
+	cmd []string
+	// leases are the leases on the names.
+	leases []name_manager.Lease
+	// lines are printed when no command is given, and no output format.
+	lines []string
+	// env are the environment variables that export the names.
+	env []string
+	// ctx is done when the names are not held anymore.
+	ctx context.Context
+	// release releases the names.
+	release name_manager.ReleaseFunc
+}
+
+// runHolding runs a command while names are held by hold, with
+// additional environment variables, then releases the names.  If no
+// command is given, the leases are printed in the output format, or else
+// the lines, and the names are released on Ctl-C or SIGTERM.  The
+// command is supervised (see supervise), and is run again, up to retries
+// times, when it fails, and is not interrupted.  If retryNewName is
+// true, or if the names were lost, the names are released and held
+// again before the command is run again.
+// The names are released in all cases (see holdingExit).
+func runHolding(
+	hold func() (*heldNames, error),
+	out *output,
+	s supervision,
+	retries int,
+	retryNewName bool,
+) error {
+	held, err := hold()
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	if len(held.cmd) == 0 {
+		// No command given, release on Ctl-C
+		if out != nil {
+			if err := out.print(os.Stdout, held.leases, leaseColumns(held.leases)); err != nil {
+				if releaseErr := held.release(); releaseErr != nil {
+					fmt.Fprintln(os.Stderr, releaseErr)
+				}
+				return err
+			}
+		} else {
+			for _, line := range held.lines {
+				fmt.Println(line)
+			}
+		}
+		select {
+		case <-sig:
+			return held.release()
+		case <-held.ctx.Done():
+			return holdingExit(held.release(), &outcome{lost: name_manager.Cause(held.ctx)})
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		c := exec.Command(held.cmd[0], held.cmd[1:]...)
+		c.Env = append(os.Environ(), held.env...)
+		c.Stdin = os.Stdin
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		result, err := supervise(c, sig, held.ctx, s)
+		if err != nil {
+			if releaseErr := held.release(); releaseErr != nil {
+				fmt.Fprintln(os.Stderr, releaseErr)
+			}
+			return err
+		}
+		failed := result.exitCode != 0 || result.lost != nil
+		if !failed || result.interrupted || attempt > retries || (result.lost != nil && !retryNewName) {
+			return holdingExit(held.release(), result)
+		}
+
+		reason := fmt.Sprintf("exit code %d", result.exitCode)
+		if result.lost != nil {
+			reason = "name lost"
+		} else if result.timedOut {
+			reason = "timed out"
+		}
+		fmt.Fprintf(os.Stderr, "attempt %d of %d failed (%s): retrying\n", attempt, retries+1, reason)
+		if retryNewName {
+			if err := held.release(); err != nil && !errors.Is(err, name_manager.ErrLeaseLost) {
+				return err
+			}
+			if held, err = hold(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// holdingExit gives the error "hold" exits with, given the outcome of
+// the command and the error returned when the names were released:
+// exitCodeLeaseLost if the names were lost, exitCodeTimeout if the
+// command timed out, or else the exit code of the command.  The release
+// error is printed if the exit code is not zero.
+func holdingExit(releaseErr error, result *outcome) error {
+	if result.lost != nil {
+		// The names that were lost cannot be released.
+		if releaseErr != nil && !errors.Is(releaseErr, name_manager.ErrLeaseLost) {
+			fmt.Fprintln(os.Stderr, releaseErr)
+		}
+		return cli.Exit(fmt.Sprintf("the name is not held anymore: %v", result.lost), exitCodeLeaseLost)
+	}
+	exitCode := result.exitCode
+	if result.timedOut {
+		exitCode = exitCodeTimeout
+	}
+	if exitCode != 0 {
+		if releaseErr != nil {
+			fmt.Fprintln(os.Stderr, releaseErr)
+		}
+		return cli.Exit("", exitCode)
+	}
+	return releaseErr
+}
+
+// leaseEnv gives the environment variables that export the names held
+// for several families: NAME_MANAGER_<FAMILY> holds the comma-separated
+// names of a family, and NAME_MANAGER_<FAMILY>_<i> its i-th name.
+func leaseEnv(leases []name_manager.Lease) []string {
+	var env []string
+	names := make(map[string][]string)
+	var families []string
+	for _, lease := range leases {
+		if _, ok := names[lease.Family]; !ok {
+			families = append(families, lease.Family)
+		}
+		variable := "NAME_MANAGER_" + envName(lease.Family)
+		env = append(env, fmt.Sprintf("%s_%d=%s", variable, len(names[lease.Family]), lease.Name))
+		names[lease.Family] = append(names[lease.Family], lease.Name)
+	}
+	for _, family := range families {
+		env = append(env, "NAME_MANAGER_"+envName(family)+"="+strings.Join(names[family], ","))
+	}
+	return env
+}
+
+// leasePlaceholders gives the placeholders for the names held for
+// several families: "{<family>}" is replaced by the comma-separated
+// names of a family.
+func leasePlaceholders(leases []name_manager.Lease) map[string]string {
+	placeholders := make(map[string]string)
+	for _, lease := range leases {
+		placeholder := "{" + lease.Family + "}"
+		if names, ok := placeholders[placeholder]; ok {
+			placeholders[placeholder] = names + "," + lease.Name
+		} else {
+			placeholders[placeholder] = lease.Name
+		}
+	}
+	return placeholders
+}
+
+// substitutePlaceholders replaces the placeholders in the arguments of a
+// command.
+func substitutePlaceholders(args []string, placeholders map[string]string) []string {
+	oldnew := make([]string, 0, 2*len(placeholders))
+	for placeholder, value := range placeholders {
+		oldnew = append(oldnew, placeholder, value)
+	}
+	replacer := strings.NewReplacer(oldnew...)
+	substituted := make([]string, len(args))
+	for i, arg := range args {
+		substituted[i] = replacer.Replace(arg)
+	}
+	return substituted
+}
+
+// envName converts a family into a suffix for environment variables.
+func envName(family string) string {
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, family)
+}
+
+func printAttributes(attributes map[string]string) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Key", "Value"})
+	for _, attribute := range name_manager.FormatKeyValues(attributes) {
+		table.Append(strings.SplitN(attribute, "=", 2))
+	}
+	table.Render()
+}
+
+func printLeases(leases []name_manager.Lease) {
+	header, rows := leaseColumns(leases)(true)
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader(header)
+	table.AppendBulk(rows)
+	table.Render()
+}
+
+func printTickets(tickets []name_manager.Ticket) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Position", "Ticket", "Family", "Created At", "Updated At"})
+	for _, ticket := range tickets {
 		table.Append([]string{
-			name.Name,
-			name.Family,
-			humanize.Time(name.CreatedAt),
-			updatedAtStr,
-			freeStr,
+			strconv.Itoa(ticket.Position),
+			ticket.ID,
+			ticket.Family,
+			humanize.Time(ticket.CreatedAt),
+			humanize.Time(ticket.UpdatedAt),
 		})
 	}
 	table.Render()
@@ -70,82 +437,512 @@ func main() {
 
 	app.Commands = []*cli.Command{
 		{
-			Name:  "hold",
-			Usage: "holds a name for a given family, releasing it on Ctl-C",
+			Name:      "hold",
+			Usage:     "holds a name for a given family, releasing it on Ctl-C or when the command exits",
+			ArgsUsage: "<family> [command...]",
+			Description: "The name is exported to the command in the NAME_MANAGER_NAME (see --env), " +
+				"NAME_MANAGER_FAMILY and NAME_MANAGER_TOKEN environment variables, and the {name}, {family} " +
+				"and {token} placeholders in the arguments of the command are substituted.  With --family, " +
+				"the {<family>} placeholders are substituted with the comma-separated names of the families.  " +
+				"SIGINT and SIGTERM are forwarded to the process group of the command, and the names are " +
+				"released when the command exits, with the exit code of the command.  When a name is lost, " +
+				"e.g., because the keep-alive gave up, the command is terminated (see --grace-period) and " +
+				"hold exits with code 75.  With --retries, the command is run again when it fails, on the " +
+				"same name, or on a name held again with --retry-new-name.  Without a command, the names are " +
+				"printed, in the --output format if given.",
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "wait",
+					Usage: "wait for a name to be released when the family is at capacity",
+				},
+				&cli.StringSliceFlag{
+					Name: "family",
+					Usage: "atomically hold names for several families, in the family[:count] format " +
+						"(all the arguments are then the command, and the names are exported in the " +
+						"NAME_MANAGER_<FAMILY> and NAME_MANAGER_<FAMILY>_<i> environment variables)",
+				},
+				&cli.BoolFlag{
+					Name:  "reclaim",
+					Usage: "acquire the name again, if it is still free, when the keep-alive gives up",
+				},
+				&cli.StringFlag{
+					Name:  "env",
+					Value: "NAME_MANAGER_NAME",
+					Usage: "environment variable in which the name is exported to the command",
+				},
+				&cli.DurationFlag{
+					Name:  "grace-period",
+					Value: 10 * time.Second,
+					Usage: "time given to the command to exit after SIGTERM when a name is lost or on timeout, before it is killed",
+				},
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "time after which the command is terminated, with exit code 124 (0 for no timeout)",
+				},
+				&cli.IntFlag{
+					Name:  "retries",
+					Usage: "number of times the command is run again when it fails or times out",
+				},
+				&cli.BoolFlag{
+					Name:  "retry-new-name",
+					Usage: "release the name and hold a name again before the command is run again",
+				},
+				labelFlag,
+				requireFlag,
+				selectorFlag,
+				ttlFlag,
+				outputFlag,
+			}, hookFlags...),
 			Action: func(c *cli.Context) error {
 				nameManager, err := getNameManager(c)
 				if err != nil {
 					return err
 				}
-				family := c.Args().Get(0)
-				cmd := c.Args().Tail()
-				name, errc, release, err := nameManager.Hold(family)
+				opts, err := acquireOptions(c)
+				if err != nil {
+					return err
+				}
+				if hooks := acquireHooks(c); hooks != nil {
+					opts = append(opts, name_manager.WithHooks(*hooks))
+				}
+				if c.Bool("reclaim") {
+					opts = append(opts, name_manager.WithReclaim(func(reclaim name_manager.Reclaim) {
+						continuity := "preserved"
+						if !reclaim.Continuous {
+							continuity = "NOT preserved: the name was acquired by someone else in the meantime"
+						}
+						fmt.Fprintf(os.Stderr, "%s:%s reclaimed after '%v', continuity %s\n",
+							reclaim.Lease.Family, reclaim.Lease.Name, reclaim.Cause, continuity)
+					}))
+				}
+				out, err := getOutput(c)
 				if err != nil {
 					return err
 				}
-				if len(cmd) == 0 {
-					// No command given, release on Ctl-C
-					fmt.Println(name)
-					sig := make(chan os.Signal)
-					signal.Notify(sig, os.Interrupt)
-					select {
-					case <-sig:
-					case err := <-errc:
+				s := supervision{
+					timeout:     c.Duration("timeout"),
+					gracePeriod: c.Duration("grace-period"),
+				}
+				if families := c.StringSlice("family"); len(families) > 0 {
+					if c.Bool("wait") {
+						return fmt.Errorf("--wait cannot be used with --family")
+					}
+					if c.IsSet("env") {
+						return fmt.Errorf("--env cannot be used with --family")
+					}
+					counts, err := name_manager.ParseFamilyCounts(families)
+					if err != nil {
 						return err
 					}
-				} else {
-					c := exec.Command(cmd[0], cmd[1:]...)
-					c.Stdout = os.Stdout
-					c.Stderr = os.Stderr
-					if err := c.Run(); err != nil {
-						if exitErr, ok := err.(*exec.ExitError); ok {
-							os.Exit(exitErr.ExitCode())
+					return runHolding(func() (*heldNames, error) {
+						holdings, err := nameManager.HoldMany(context.Background(), counts, opts...)
+						if err != nil {
+							return nil, err
+						}
+						lines := make([]string, len(holdings.Leases))
+						for i, lease := range holdings.Leases {
+							lines[i] = lease.Family + " " + lease.Name
 						}
+						return &heldNames{
+							cmd:     substitutePlaceholders(c.Args().Slice(), leasePlaceholders(holdings.Leases)),
+							leases:  holdings.Leases,
+							lines:   lines,
+							env:     leaseEnv(holdings.Leases),
+							ctx:     holdings.Context,
+							release: holdings.Release,
+						}, nil
+					}, out, s, c.Int("retries"), c.Bool("retry-new-name"))
+				}
+				family := c.Args().Get(0)
+				// The command can be separated from the family by "--".
+				args := c.Args().Tail()
+				if len(args) > 0 && args[0] == "--" {
+					args = args[1:]
+				}
+				return runHolding(func() (*heldNames, error) {
+					var holding *name_manager.Holding
+					var err error
+					if c.Bool("wait") {
+						holding, err = nameManager.HoldWait(context.Background(), family, opts...)
+					} else {
+						holding, err = nameManager.HoldContext(context.Background(), family, opts...)
+					}
+					if err != nil {
+						return nil, err
+					}
+					token := strconv.FormatInt(holding.Token, 10)
+					return &heldNames{
+						cmd: substitutePlaceholders(args, map[string]string{
+							"{name}":   holding.Name,
+							"{family}": family,
+							"{token}":  token,
+						}),
+						leases: []name_manager.Lease{holding.Lease},
+						lines:  []string{holding.Name},
+						env: []string{
+							c.String("env") + "=" + holding.Name,
+							"NAME_MANAGER_FAMILY=" + family,
+							"NAME_MANAGER_TOKEN=" + token,
+						},
+						ctx:     holding.Context,
+						release: holding.Release,
+					}, nil
+				}, out, s, c.Int("retries"), c.Bool("retry-new-name"))
+			},
+		},
+		{
+			Name:      "run",
+			Usage:     "runs tests concurrently, each while a name is held for it",
+			ArgsUsage: "[test...]",
+			Description: "The tests are shell commands, given as arguments or in a file (see --file), and are " +
+				"taken from a queue by --concurrency workers.  The name is exported to the tests as with hold, " +
+				"and the output of each test goes to its log file.  A summary is printed at the end, and run " +
+				"fails if any test did not pass.",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:     "family",
+					Usage:    "family of the names held for the tests",
+					Required: true,
+				},
+				&cli.IntFlag{
+					Name:  "concurrency",
+					Value: 1,
+					Usage: "number of tests that run concurrently",
+				},
+				&cli.StringFlag{
+					Name:  "file",
+					Usage: "file with the tests, one per line, after the tests given as arguments",
+				},
+				&cli.StringFlag{
+					Name:  "shell",
+					Value: "sh",
+					Usage: "shell that runs the tests, with -c",
+				},
+				&cli.StringFlag{
+					Name:  "env",
+					Value: "NAME_MANAGER_NAME",
+					Usage: "environment variable in which the name is exported to the tests",
+				},
+				&cli.StringFlag{
+					Name:  "log-dir",
+					Usage: "directory for the logs of the tests (default: a temporary directory)",
+				},
+				&cli.StringFlag{
+					Name:  "junit",
+					Usage: "path to a JUnit XML report",
+				},
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "time after which a test is terminated (0 for no timeout)",
+				},
+				&cli.DurationFlag{
+					Name:  "grace-period",
+					Value: 10 * time.Second,
+					Usage: "time given to a test to exit after SIGTERM when a name is lost or on timeout, before it is killed",
+				},
+				labelFlag,
+				requireFlag,
+				selectorFlag,
+				ttlFlag,
+			}, hookFlags...),
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				opts, err := acquireOptions(c)
+				if err != nil {
+					return err
+				}
+				if hooks := acquireHooks(c); hooks != nil {
+					opts = append(opts, name_manager.WithHooks(*hooks))
+				}
+				if c.Int("concurrency") < 1 {
+					return fmt.Errorf("--concurrency must be at least 1")
+				}
+				commands := c.Args().Slice()
+				if path := c.String("file"); path != "" {
+					fileCommands, err := readTests(path)
+					if err != nil {
 						return err
 					}
+					commands = append(commands, fileCommands...)
+				}
+				if len(commands) == 0 {
+					return fmt.Errorf("no test to run")
+				}
+				logDir := c.String("log-dir")
+				if logDir == "" {
+					logDir, err = ioutil.TempDir("", "name_manager_run")
+				} else {
+					err = os.MkdirAll(logDir, 0755)
 				}
-				if err := release(); err != nil {
+				if err != nil {
 					return err
 				}
+
+				tests := make([]*runTest, len(commands))
+				for i, command := range commands {
+					tests[i] = &runTest{
+						index:   i + 1,
+						command: command,
+						logPath: logPath(logDir, i+1),
+					}
+				}
+				config := &runConfig{
+					family:      c.String("family"),
+					concurrency: c.Int("concurrency"),
+					shell:       c.String("shell"),
+					env:         c.String("env"),
+					supervision: supervision{
+						timeout:     c.Duration("timeout"),
+						gracePeriod: c.Duration("grace-period"),
+						detached:    true,
+					},
+					opts: opts,
+				}
+				start := time.Now()
+				runTests(nameManager, tests, config)
+				printTests(tests, config.family)
+				if path := c.String("junit"); path != "" {
+					if err := writeJUnit(path, config.family, tests, start, time.Since(start)); err != nil {
+						return err
+					}
+				}
+
+				failed := 0
+				for _, test := range tests {
+					if test.status() != statusPass {
+						failed++
+					}
+				}
+				if failed > 0 {
+					return cli.Exit(fmt.Sprintf("%d of %d tests did not pass", failed, len(tests)), 1)
+				}
 				return nil
 			},
 		},
 		{
 			Name:  "acquire",
 			Usage: "acquires a name for a given family",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "wait",
+					Usage: "wait for a name to be released when the family is at capacity",
+				},
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "maximum time to wait for a name (0 to wait indefinitely)",
+				},
+				&cli.BoolFlag{
+					Name:  "token",
+					Usage: "also print the lease token, after the name and a space",
+				},
+				labelFlag,
+				requireFlag,
+				selectorFlag,
+				ttlFlag,
+				outputFlag,
+			},
 			Action: func(c *cli.Context) error {
 				nameManager, err := getNameManager(c)
 				if err != nil {
 					return err
 				}
+				opts, err := acquireOptions(c)
+				if err != nil {
+					return err
+				}
+				out, err := getOutput(c)
+				if err != nil {
+					return err
+				}
 				family := c.Args().Get(0)
-				name, err := nameManager.Acquire(family)
+				ctx := context.Background()
+				if timeout := c.Duration("timeout"); timeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, timeout)
+					defer cancel()
+				}
+				var lease name_manager.Lease
+				if c.Bool("wait") {
+					lease, err = nameManager.AcquireWait(ctx, family, opts...)
+				} else {
+					lease, err = nameManager.AcquireContext(ctx, family, opts...)
+				}
 				if err != nil {
 					return err
 				}
-				fmt.Print(name)
+				if out != nil {
+					return out.print(os.Stdout, lease, leaseColumns([]name_manager.Lease{lease}))
+				}
+				if c.Bool("token") {
+					fmt.Printf("%s %d\n", lease.Name, lease.Token)
+				} else {
+					fmt.Println(lease.Name)
+				}
 				return nil
 			},
 		},
 		{
 			Name:  "keep_alive",
 			Usage: "keeps alive a name",
+			Flags: leaseFlags,
 			Action: func(c *cli.Context) error {
 				nameManager, err := getNameManager(c)
 				if err != nil {
 					return err
 				}
-				family := c.Args().Get(0)
-				name := c.Args().Get(1)
-				if family == "" || name == "" {
-					return fmt.Errorf("expected arguments to be <family> <name>")
+				lease, err := getLease(c)
+				if err != nil {
+					return err
 				}
-				return nameManager.KeepAlive(family, name)
+				return nameManager.KeepAliveContext(context.Background(), lease)
 			},
 		},
 		{
 			Name:  "release",
 			Usage: "releases a name",
+			Flags: leaseFlags,
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				lease, err := getLease(c)
+				if err != nil {
+					return err
+				}
+				return nameManager.ReleaseContext(context.Background(), lease)
+			},
+		},
+		{
+			Name:  "handoff",
+			Usage: "prepares the hand-off of a held name to another process, printing a one-time claim ticket",
+			Flags: leaseFlags,
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				lease, err := getLease(c)
+				if err != nil {
+					return err
+				}
+				ticket, err := nameManager.Transfer(context.Background(), lease)
+				if err != nil {
+					return err
+				}
+				fmt.Println(ticket.String())
+				return nil
+			},
+		},
+		{
+			Name:  "claim",
+			Usage: "claims a name handed off by another process, printing the name",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "token",
+					Usage: "also print the lease token, after the name and a space",
+				},
+				labelFlag,
+				ttlFlag,
+			},
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				if c.Args().Len() != 1 {
+					return fmt.Errorf("expected argument to be <ticket>")
+				}
+				ticket, err := name_manager.ParseClaimTicket(c.Args().Get(0))
+				if err != nil {
+					return err
+				}
+				opts, err := acquireOptions(c)
+				if err != nil {
+					return err
+				}
+				lease, err := nameManager.Claim(context.Background(), ticket, opts...)
+				if err != nil {
+					return err
+				}
+				if c.Bool("token") {
+					fmt.Printf("%s %d\n", lease.Name, lease.Token)
+				} else {
+					fmt.Println(lease.Name)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "attr",
+			Usage: "manages the durable attributes of the names",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "get",
+					Usage: "gets the attributes of a name",
+					Action: func(c *cli.Context) error {
+						nameManager, err := getNameManager(c)
+						if err != nil {
+							return err
+						}
+						family := c.Args().Get(0)
+						name := c.Args().Get(1)
+						if family == "" || name == "" {
+							return fmt.Errorf("expected arguments to be <family> <name>")
+						}
+						attributes, err := nameManager.GetAttributes(context.Background(), family, name)
+						if err != nil {
+							return err
+						}
+						printAttributes(attributes)
+						return nil
+					},
+				},
+				{
+					Name:  "set",
+					Usage: "sets attributes on a name (an empty value removes the attribute)",
+					Action: func(c *cli.Context) error {
+						nameManager, err := getNameManager(c)
+						if err != nil {
+							return err
+						}
+						family := c.Args().Get(0)
+						name := c.Args().Get(1)
+						if family == "" || name == "" || c.Args().Len() < 3 {
+							return fmt.Errorf("expected arguments to be <family> <name> <key=value>...")
+						}
+						attributes, err := name_manager.ParseKeyValues(c.Args().Slice()[2:])
+						if err != nil {
+							return err
+						}
+						return nameManager.SetAttributes(context.Background(), family, name, attributes)
+					},
+				},
+			},
+		},
+		{
+			Name:  "quarantine",
+			Usage: "takes a name out of rotation until it is unquarantined",
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				family := c.Args().Get(0)
+				name := c.Args().Get(1)
+				if family == "" || name == "" || c.Args().Len() < 3 {
+					return fmt.Errorf("expected arguments to be <family> <name> <reason>")
+				}
+				reason := strings.Join(c.Args().Slice()[2:], " ")
+				return nameManager.Quarantine(context.Background(), family, name, reason)
+			},
+		},
+		{
+			Name:  "unquarantine",
+			Usage: "puts a quarantined name back in rotation",
 			Action: func(c *cli.Context) error {
 				nameManager, err := getNameManager(c)
 				if err != nil {
@@ -156,25 +953,222 @@ func main() {
 				if family == "" || name == "" {
 					return fmt.Errorf("expected arguments to be <family> <name>")
 				}
-				return nameManager.Release(family, name)
+				return nameManager.Unquarantine(context.Background(), family, name)
+			},
+		},
+		{
+			Name:  "set_limit",
+			Usage: "sets the maximum number of names for a family (0 to remove the limit)",
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				family := c.Args().Get(0)
+				limitStr := c.Args().Get(1)
+				if family == "" || limitStr == "" {
+					return fmt.Errorf("expected arguments to be <family> <limit>")
+				}
+				limit, err := strconv.Atoi(limitStr)
+				if err != nil {
+					return fmt.Errorf("invalid limit: %v", err)
+				}
+				return nameManager.SetFamilyLimit(context.Background(), family, limit)
+			},
+		},
+		{
+			Name:        "set_generator",
+			Usage:       "sets the generator of the new names of a family (e.g., 'counter:ci-stack-%03d')",
+			Description: "generators: counter[:<template>], pool:<name>,<name>..., pronounceable[:<prefix>], uuid[:<prefix>]",
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				family := c.Args().Get(0)
+				spec := c.Args().Get(1)
+				if family == "" || spec == "" {
+					return fmt.Errorf("expected arguments to be <family> <generator>")
+				}
+				generator, err := name_manager.ParseNameGenerator(spec)
+				if err != nil {
+					return err
+				}
+				return nameManager.SetNameGenerator(context.Background(), family, generator)
+			},
+		},
+		{
+			Name:  "pool",
+			Usage: "manages the fixed pools of names",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "define",
+					Usage: "defines or extends the fixed pool of names of a family",
+					Action: func(c *cli.Context) error {
+						nameManager, err := getNameManager(c)
+						if err != nil {
+							return err
+						}
+						family := c.Args().Get(0)
+						if family == "" || c.Args().Len() < 2 {
+							return fmt.Errorf("expected arguments to be <family> <name>...")
+						}
+						return nameManager.DefinePool(context.Background(), family, c.Args().Slice()[1:])
+					},
+				},
 			},
 		},
 		{
 			Name:  "list",
 			Usage: "lists all names",
+			Flags: []cli.Flag{
+				outputFlag,
+			},
 			Action: func(c *cli.Context) error {
 				nameManager, err := getNameManager(c)
 				if err != nil {
 					return err
 				}
+				out, err := parseOutput(c.String("output"))
+				if err != nil {
+					return err
+				}
 				names, err := nameManager.List()
 				if err != nil {
 					return err
 				}
-				printNames(names)
+				utcNames(names)
+				return out.print(os.Stdout, names, nameColumns(names))
+			},
+		},
+		{
+			Name:      "status",
+			Usage:     "prints the number of names held, free and quarantined, and of waiters, for all the families or the given ones",
+			ArgsUsage: "[family...]",
+			Flags: []cli.Flag{
+				outputFlag,
+			},
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				out, err := parseOutput(c.String("output"))
+				if err != nil {
+					return err
+				}
+				statuses, err := getStatus(context.Background(), nameManager, c.Args().Slice())
+				if err != nil {
+					return err
+				}
+				return out.print(os.Stdout, statuses, statusColumns(statuses))
+			},
+		},
+		{
+			Name:  "queue",
+			Usage: "lists the waiters for a family, in order of arrival",
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				family := c.Args().Get(0)
+				if family == "" {
+					return fmt.Errorf("expected arguments to be <family>")
+				}
+				tickets, err := nameManager.Queue(context.Background(), family)
+				if err != nil {
+					return err
+				}
+				printTickets(tickets)
+				return nil
+			},
+		},
+		{
+			Name:      "gc",
+			Usage:     "releases the names that were not kept alive, for all the families or the given ones",
+			ArgsUsage: "[family...]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "on-destroy",
+					Usage: "shell command run on the released names, to tear down their resources",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				ctx := context.Background()
+				leases, err := nameManager.Reap(ctx, c.Args().Slice()...)
+				if err != nil {
+					return err
+				}
+				printLeases(leases)
+				if onDestroy := destroyHook(c); onDestroy != nil {
+					return destroy(ctx, nameManager, onDestroy, leases)
+				}
 				return nil
 			},
 		},
+		{
+			Name:  "delete",
+			Usage: "deletes a name",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "delete the name even if it is held",
+				},
+				&cli.BoolFlag{
+					Name:  "recycle",
+					Usage: "generate the name again before generating new names",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				family := c.Args().Get(0)
+				name := c.Args().Get(1)
+				if family == "" || name == "" {
+					return fmt.Errorf("expected arguments to be <family> <name>")
+				}
+				var opts []name_manager.DeleteOption
+				if c.Bool("force") {
+					opts = append(opts, name_manager.WithForce())
+				}
+				if c.Bool("recycle") {
+					opts = append(opts, name_manager.WithRecycle())
+				}
+				return nameManager.Delete(context.Background(), family, name, opts...)
+			},
+		},
+		{
+			Name:  "delete_family",
+			Usage: "deletes all the names of a family, along with its settings",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "delete the family even if names are held",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				nameManager, err := getNameManager(c)
+				if err != nil {
+					return err
+				}
+				family := c.Args().Get(0)
+				if family == "" {
+					return fmt.Errorf("expected argument to be <family>")
+				}
+				var opts []name_manager.DeleteOption
+				if c.Bool("force") {
+					opts = append(opts, name_manager.WithForce())
+				}
+				return nameManager.DeleteFamily(context.Background(), family, opts...)
+			},
+		},
 		{
 			Name:  "reset",
 			Usage: "resets the backend",
@@ -195,6 +1189,10 @@ func main() {
 					Usage: "address to listen to",
 					Value: ":9008",
 				},
+				&cli.DurationFlag{
+					Name:  "reap-interval",
+					Usage: "interval between two collections of the names that were not kept alive (0 to only collect them on acquisition)",
+				},
 			},
 			Action: func(c *cli.Context) error {
 				nameManager, err := getNameManager(c)
@@ -207,6 +1205,11 @@ func main() {
 					return err
 				}
 				fmt.Printf("Listening on %s\n", address)
+				if interval := c.Duration("reap-interval"); interval > 0 {
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					go server.Reap(ctx, nameManager, interval)
+				}
 				return server.Serve(listener, nameManager)
 			},
 		},
@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hchauvin/name_manager/pkg/name_manager"
+	"github.com/olekukonko/tablewriter"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// outputFlag selects the output format of the commands that print names,
+// leases, or the status of families.
+var outputFlag = &cli.StringFlag{
+	Name:    "output",
+	Aliases: []string{"o"},
+	Usage:   "output format: table, json, yaml, csv, or template=<go-template> (executed for each item)",
+}
+
+// output is an output format.
+type output struct {
+	// format is table, json, yaml, csv, or template.
+	format string
+	// template is the template of the template format.
+	template *template.Template
+}
+
+// parseOutput parses an output format, as given to --output.  The
+// default format is table.
+func parseOutput(format string) (*output, error) {
+	switch format {
+	case "":
+		return &output{format: "table"}, nil
+	case "table", "json", "yaml", "csv":
+		return &output{format: format}, nil
+	}
+	if strings.HasPrefix(format, "template=") {
+		tmpl, err := template.New("output").Parse(strings.TrimPrefix(format, "template="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid output template: %v", err)
+		}
+		return &output{format: "template", template: tmpl}, nil
+	}
+	return nil, fmt.Errorf("invalid output format '%s': expected table, json, yaml, csv, or template=<go-template>", format)
+}
+
+// getOutput gets the output format from the --output flag, or nil if the
+// flag is not set, for the commands whose default output is not a
+// table.
+func getOutput(c *cli.Context) (*output, error) {
+	if !c.IsSet("output") {
+		return nil, nil
+	}
+	return parseOutput(c.String("output"))
+}
+
+// columns gives the header and the rows of items in the table and csv
+// formats.  human is true for the table format, where the values are
+// humanized.  The header of the csv format has the keys of the json
+// format.
+type columns func(human bool) (header []string, rows [][]string)
+
+// print prints items, either a slice or a single item, in the output
+// format.  The timestamps of the items must be in UTC, for a stable
+// output.
+func (o *output) print(w io.Writer, items interface{}, columns columns) error {
+	switch o.format {
+	case "table":
+		header, rows := columns(true)
+		table := tablewriter.NewWriter(w)
+		table.SetHeader(header)
+		table.AppendBulk(rows)
+		table.Render()
+		return nil
+	case "csv":
+		header, rows := columns(false)
+		writer := csv.NewWriter(w)
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		return writer.WriteAll(rows)
+	case "json":
+		b, err := json.MarshalIndent(items, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case "yaml":
+		b, err := yaml.Marshal(items)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		v = reflect.ValueOf([]interface{}{items})
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := o.template.Execute(w, v.Index(i).Interface()); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatTime formats a timestamp in the table format, where it is
+// humanized, or else in the RFC 3339 format.
+func formatTime(t time.Time, human bool) string {
+	if human {
+		return humanize.Time(t)
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// utcNames converts the timestamps of names to UTC.
+func utcNames(names []name_manager.Name) {
+	for i := range names {
+		names[i].CreatedAt = names[i].CreatedAt.UTC()
+		names[i].UpdatedAt = names[i].UpdatedAt.UTC()
+	}
+}
+
+// nameColumns gives the columns for names.
+func nameColumns(names []name_manager.Name) columns {
+	return func(human bool) ([]string, [][]string) {
+		header := []string{"name", "family", "createdAt", "updatedAt", "free", "pool", "quarantine", "token", "labels", "attributes"}
+		separator := ","
+		if human {
+			header = []string{"Name", "Family", "Created At", "Updated At", "Free", "Pool", "Quarantine", "Token", "Labels", "Attributes"}
+			separator = ", "
+		}
+		rows := make([][]string, 0, len(names))
+		for _, name := range names {
+			updatedAtStr := formatTime(name.UpdatedAt, human)
+			if human && name.UpdatedAt.Equal(name.CreatedAt) {
+				updatedAtStr = ""
+			}
+			rows = append(rows, []string{
+				name.Name,
+				name.Family,
+				formatTime(name.CreatedAt, human),
+				updatedAtStr,
+				formatBool(name.Free, human),
+				formatBool(name.Pool, human),
+				name.Quarantine,
+				strconv.FormatInt(name.Token, 10),
+				strings.Join(name_manager.FormatKeyValues(name.Labels), separator),
+				strings.Join(name_manager.FormatKeyValues(name.Attributes), separator),
+			})
+		}
+		return header, rows
+	}
+}
+
+// formatBool formats a boolean in the table format, where it is "X" or
+// "", or else as "true" or "false".
+func formatBool(b bool, human bool) string {
+	if !human {
+		return strconv.FormatBool(b)
+	}
+	if b {
+		return "X"
+	}
+	return ""
+}
+
+// leaseColumns gives the columns for leases.
+func leaseColumns(leases []name_manager.Lease) columns {
+	return func(human bool) ([]string, [][]string) {
+		header := []string{"family", "name", "token"}
+		rows := make([][]string, 0, len(leases))
+		for _, lease := range leases {
+			rows = append(rows, []string{
+				lease.Family,
+				lease.Name,
+				strconv.FormatInt(lease.Token, 10),
+			})
+		}
+		return header, rows
+	}
+}
@@ -0,0 +1,259 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hchauvin/name_manager/pkg/name_manager"
+	"github.com/olekukonko/tablewriter"
+)
+
+// runTest is a test run by "run".
+type runTest struct {
+	// index is the 1-based index of the test.
+	index int
+	// command is the shell command of the test.
+	command string
+	// name is the name held for the test, or "" if the test did not
+	// start.
+	name string
+	// logPath is the path to the file that receives the output of the
+	// test.
+	logPath string
+	// duration is the time it took to run the test.
+	duration time.Duration
+	// result is the outcome of the test, or nil if it did not run.
+	result *outcome
+	// err is the error that prevented the test from running, if any.
+	err error
+}
+
+// Statuses of the tests run by "run".
+const (
+	statusPass        = "PASS"
+	statusFail        = "FAIL"
+	statusTimeout     = "TIMEOUT"
+	statusLost        = "LOST"
+	statusInterrupted = "INTERRUPTED"
+	statusError       = "ERROR"
+	statusSkipped     = "SKIPPED"
+)
+
+// status gives the status of a test.
+func (test *runTest) status() string {
+	switch {
+	case test.err != nil:
+		return statusError
+	case test.result == nil:
+		return statusSkipped
+	case test.result.interrupted:
+		return statusInterrupted
+	case test.result.lost != nil:
+		return statusLost
+	case test.result.timedOut:
+		return statusTimeout
+	case test.result.exitCode != 0:
+		return statusFail
+	}
+	return statusPass
+}
+
+// message describes why a test did not pass.
+func (test *runTest) message() string {
+	switch test.status() {
+	case statusError:
+		return test.err.Error()
+	case statusSkipped:
+		return "not run"
+	case statusInterrupted:
+		return "interrupted"
+	case statusLost:
+		return fmt.Sprintf("the name is not held anymore: %v", test.result.lost)
+	case statusTimeout:
+		return fmt.Sprintf("timed out after %v", test.duration.Round(time.Second))
+	case statusFail:
+		return fmt.Sprintf("exit code %d", test.result.exitCode)
+	}
+	return ""
+}
+
+// runConfig configures "run".
+type runConfig struct {
+	// family is the family of the names held for the tests.
+	family string
+	// concurrency is the number of tests that run concurrently.
+	concurrency int
+	// shell runs the tests, with "-c".
+	shell string
+	// env is the environment variable in which the name is exported to
+	// the tests.
+	env string
+	// supervision configures the supervision of the tests.
+	supervision supervision
+	// opts are the options for the acquisition of the names.
+	opts []name_manager.AcquireOption
+}
+
+// readTests reads the tests in a file, one per line.  The blank lines
+// and the lines starting with "#" are skipped.
+func readTests(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tests []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tests = append(tests, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tests, nil
+}
+
+// runTests runs tests, each while a name is held for it.  The tests are
+// taken from a queue by concurrency workers, so that a worker that is
+// done with a test immediately takes the next one.  On SIGINT or
+// SIGTERM, the signal is forwarded to the tests that run, and the
+// remaining tests are skipped.
+func runTests(mng name_manager.NameManager, tests []*runTest, config *runConfig) {
+	queue := make(chan *runTest, len(tests))
+	for _, test := range tests {
+		queue <- test
+	}
+	close(queue)
+
+	// ctx is cancelled on SIGINT or SIGTERM.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			fmt.Fprintln(os.Stderr, "interrupted: the remaining tests are skipped")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < config.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for test := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				runOneTest(ctx, mng, test, config)
+				mu.Lock()
+				fmt.Fprintf(os.Stderr, "%s %s (%s:%s, %v)\n",
+					test.status(), test.command, config.family, test.name, test.duration.Round(time.Millisecond))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runOneTest runs a test while a name is held for it.  The output of the
+// test goes to its log file.
+func runOneTest(ctx context.Context, mng name_manager.NameManager, test *runTest, config *runConfig) {
+	log, err := os.Create(test.logPath)
+	if err != nil {
+		test.err = err
+		return
+	}
+	defer log.Close()
+
+	start := time.Now()
+	defer func() {
+		test.duration = time.Since(start)
+	}()
+	holding, err := mng.HoldWait(ctx, config.family, config.opts...)
+	if err != nil {
+		if ctx.Err() == nil {
+			test.err = err
+		}
+		return
+	}
+	test.name = holding.Name
+
+	token := strconv.FormatInt(holding.Token, 10)
+	command := substitutePlaceholders([]string{test.command}, map[string]string{
+		"{name}":   holding.Name,
+		"{family}": config.family,
+		"{token}":  token,
+	})[0]
+	c := exec.Command(config.shell, "-c", command)
+	c.Env = append(os.Environ(),
+		config.env+"="+holding.Name,
+		"NAME_MANAGER_FAMILY="+config.family,
+		"NAME_MANAGER_TOKEN="+token)
+	c.Stdout = log
+	c.Stderr = log
+
+	// The signals are forwarded to all the tests that run.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	test.result, test.err = supervise(c, sig, holding.Context, config.supervision)
+	signal.Stop(sig)
+
+	if err := holding.Release(); err != nil && test.err == nil && test.result.lost == nil {
+		test.err = err
+	}
+}
+
+// printTests prints the summary of the tests.
+func printTests(tests []*runTest, family string) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"#", "Test", "Name", "Status", "Duration", "Log"})
+	table.SetAutoWrapText(false)
+	for _, test := range tests {
+		name := ""
+		if test.name != "" {
+			name = family + ":" + test.name
+		}
+		// The tests that did not run have no log.
+		duration, log := "", ""
+		if test.result != nil {
+			duration, log = test.duration.Round(time.Millisecond).String(), test.logPath
+		}
+		table.Append([]string{
+			strconv.Itoa(test.index),
+			test.command,
+			name,
+			test.status(),
+			duration,
+			log,
+		})
+	}
+	table.Render()
+}
+
+// logPath gives the path to the log file of a test.
+func logPath(logDir string, index int) string {
+	return filepath.Join(logDir, fmt.Sprintf("test_%d.log", index))
+}
@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/hchauvin/name_manager/pkg/name_manager"
+)
+
+// familyStatus is the status of a family, as printed by "status".
+type familyStatus struct {
+	// Family is the family.
+	Family string `json:"family" yaml:"family"`
+	// Names is the number of names of the family.
+	Names int `json:"names" yaml:"names"`
+	// Held is the number of names that are held.
+	Held int `json:"held" yaml:"held"`
+	// Free is the number of names that are free and not quarantined.
+	Free int `json:"free" yaml:"free"`
+	// Quarantined is the number of names that are quarantined.
+	Quarantined int `json:"quarantined" yaml:"quarantined"`
+	// Waiters is the number of waiters in the queue of the family.
+	Waiters int `json:"waiters" yaml:"waiters"`
+}
+
+// getStatus gives the status of the given families, or of all the
+// families if none is given, sorted by family.
+func getStatus(ctx context.Context, mng name_manager.NameManager, families []string) ([]familyStatus, error) {
+	names, err := mng.ListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]*familyStatus)
+	for _, family := range families {
+		statuses[family] = &familyStatus{Family: family}
+	}
+	for _, name := range names {
+		status, ok := statuses[name.Family]
+		if !ok {
+			if len(families) > 0 {
+				continue
+			}
+			status = &familyStatus{Family: name.Family}
+			statuses[name.Family] = status
+		}
+		status.Names++
+		_, quarantined := name.Quarantined()
+		if quarantined {
+			status.Quarantined++
+		}
+		if !name.Free {
+			status.Held++
+		} else if !quarantined {
+			status.Free++
+		}
+	}
+
+	sorted := make([]familyStatus, 0, len(statuses))
+	for _, status := range statuses {
+		tickets, err := mng.Queue(ctx, status.Family)
+		if err != nil {
+			return nil, err
+		}
+		status.Waiters = len(tickets)
+		sorted = append(sorted, *status)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Family < sorted[j].Family
+	})
+	return sorted, nil
+}
+
+// statusColumns gives the columns for the status of families.
+func statusColumns(statuses []familyStatus) columns {
+	return func(human bool) ([]string, [][]string) {
+		header := []string{"family", "names", "held", "free", "quarantined", "waiters"}
+		rows := make([][]string, 0, len(statuses))
+		for _, status := range statuses {
+			rows = append(rows, []string{
+				status.Family,
+				strconv.Itoa(status.Names),
+				strconv.Itoa(status.Held),
+				strconv.Itoa(status.Free),
+				strconv.Itoa(status.Quarantined),
+				strconv.Itoa(status.Waiters),
+			})
+		}
+		return header, rows
+	}
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/hchauvin/name_manager/pkg/name_manager"
+)
+
+// exitCodeLeaseLost is the exit code of "hold" when a name is not held
+// anymore, e.g., because the keep-alive gave up.  It is EX_TEMPFAIL in
+// sysexits.h, as the command can usually be run again.
+const exitCodeLeaseLost = 75
+
+// exitCodeTimeout is the exit code of "hold" when the command timed out,
+// as with the timeout command of coreutils.
+const exitCodeTimeout = 124
+
+// supervision configures the supervision of a command.
+type supervision struct {
+	// timeout is the time after which the command is terminated.  Zero
+	// means no timeout.
+	timeout time.Duration
+	// gracePeriod is the time given to the command to exit after
+	// SIGTERM, before it is killed.
+	gracePeriod time.Duration
+	// detached is true if the command must never be put in the
+	// foreground of the terminal, e.g., because several commands run
+	// concurrently.
+	detached bool
+}
+
+// outcome is the outcome of a supervised command.
+type outcome struct {
+	// exitCode is the exit code of the command.
+	exitCode int
+	// lost, if not nil, is why the names were lost while the command ran.
+	lost error
+	// timedOut is true if the command was terminated after the timeout.
+	timedOut bool
+	// interrupted is true if a signal was forwarded to the command.
+	interrupted bool
+}
+
+// supervise runs a command until it exits.  The signals received on sig
+// are forwarded to the command.  When ctx is done, i.e., when the names
+// are not held anymore, or after the timeout, the command is sent
+// SIGTERM, then SIGKILL if it is still running after the grace period.
+func supervise(
+	c *exec.Cmd,
+	sig <-chan os.Signal,
+	ctx context.Context,
+	s supervision,
+) (*outcome, error) {
+	restore, err := startCommand(c, s.detached)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	result := &outcome{}
+	holdingDone := ctx.Done()
+	var timeout, kill <-chan time.Time
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	terminate := func(reason string) {
+		holdingDone, timeout = nil, nil
+		fmt.Fprintf(os.Stderr, "%s: terminating the command\n", reason)
+		if err := signalCommand(c, syscall.SIGTERM); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot terminate the command: %v\n", err)
+		}
+		kill = time.After(s.gracePeriod)
+	}
+	for {
+		select {
+		case sig := <-sig:
+			result.interrupted = true
+			if err := signalCommand(c, sig.(syscall.Signal)); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot forward %v to the command: %v\n", sig, err)
+			}
+		case <-holdingDone:
+			result.lost = name_manager.Cause(ctx)
+			terminate(fmt.Sprintf("the name is not held anymore (%v)", result.lost))
+		case <-timeout:
+			result.timedOut = true
+			terminate(fmt.Sprintf("the command timed out after %v", s.timeout))
+		case <-kill:
+			kill = nil
+			fmt.Fprintf(os.Stderr, "the command is still running after %v: killing it\n", s.gracePeriod)
+			if err := signalCommand(c, syscall.SIGKILL); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot kill the command: %v\n", err)
+			}
+		case err := <-done:
+			restore()
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				result.exitCode = exitStatus(exitErr)
+			} else if err != nil {
+				return nil, err
+			}
+			return result, nil
+		}
+	}
+}
+
+// exitStatus gives the exit code of a command that failed.  As with
+// shells, the exit code of a command killed by a signal is 128 plus the
+// signal number.
+func exitStatus(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return err.ExitCode()
+}
@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// startCommand starts a command in its own process group, so that the
+// signals reach the command and all its children.  When name_manager is
+// in the foreground of a terminal, and the command is not detached, the
+// process group of the command is put in the foreground instead, so that
+// the command can be interactive and directly receives Ctl-C; the
+// returned function gives the terminal back to name_manager after the
+// command exited.
+func startCommand(c *exec.Cmd, detached bool) (restore func(), err error) {
+	pgrp := syscall.Getpgrp()
+	foreground := false
+	if fg, err := tcgetpgrp(os.Stdin.Fd()); err == nil && fg == pgrp && !detached {
+		foreground = true
+	}
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Foreground: foreground,
+		// Ctty is the file descriptor of the terminal in the command,
+		// which is its stdin.
+		Ctty: 0,
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	if !foreground {
+		return func() {}, nil
+	}
+	return func() {
+		// name_manager is in the background until then.
+		signal.Ignore(syscall.SIGTTOU)
+		defer signal.Reset(syscall.SIGTTOU)
+		_ = tcsetpgrp(os.Stdin.Fd(), pgrp)
+	}, nil
+}
+
+// signalCommand sends a signal to the process group of a command.
+func signalCommand(c *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-c.Process.Pid, sig)
+}
+
+// tcgetpgrp gives the foreground process group of a terminal.
+func tcgetpgrp(fd uintptr) (int, error) {
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
+
+// tcsetpgrp puts a process group in the foreground of a terminal.
+func tcsetpgrp(fd uintptr, pgrp int) error {
+	pgrp32 := int32(pgrp)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&pgrp32))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startCommand starts a command.  On Windows, the command shares the
+// console of name_manager, and thus directly receives Ctl-C.
+func startCommand(c *exec.Cmd, detached bool) (restore func(), err error) {
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
+
+// signalCommand emulates the sending of a signal to a command.  SIGINT
+// is ignored, as it is also received by the command, and the command is
+// killed on any other signal.
+func signalCommand(c *exec.Cmd, sig syscall.Signal) error {
+	if sig == syscall.SIGINT {
+		return nil
+	}
+	return c.Process.Kill()
+}
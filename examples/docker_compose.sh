@@ -5,7 +5,9 @@
 
 set -eou pipefail
 
-source "examples/executor.sh"
+function name_manager {
+  ./bin/name_manager "$@"
+}
 
 function docker_compose_test {
   local idx=$1
@@ -18,6 +20,8 @@ function docker_compose_test {
   address=$(docker-compose -p "$docker_compose_project_name" -f examples/docker-compose.yml port server 80)
   echo "<Actual test placeholder: $idx for stack $stack_name; server address: $address>"
 }
+# The tests are run by "name_manager run" in a child shell.
+export -f docker_compose_test
 
 TESTS=(
   "docker_compose_test 1 \$STACK_NAME"
@@ -26,7 +30,7 @@ TESTS=(
   "docker_compose_test 4 \$STACK_NAME"
   "docker_compose_test 5 \$STACK_NAME"
 )
-execute_tests 3 "${TESTS[@]}"
+name_manager run --family stack --env STACK_NAME --concurrency 3 --shell bash -- "${TESTS[@]}"
 
 echo ""
 echo "Stacks:"
@@ -7,20 +7,28 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatalf("expected two cmd arguments, got: %v", os.Args)
+	if len(os.Args) < 2 {
+		log.Fatalf("expected at least two cmd arguments, got: %v", os.Args)
 	}
 	if os.Args[1] != "__expected__" {
 		log.Fatalf("unexpected cmd argument: '%s'", os.Args[1])
 	}
 
-	fmt.Print(os.Getenv("STDOUT"))
+	// The environment variables in STDOUT are expanded, and the
+	// additional arguments and stdin are echoed.
+	fmt.Print(os.ExpandEnv(os.Getenv("STDOUT")))
+	fmt.Print(strings.Join(os.Args[2:], " "))
+	if _, err := io.Copy(os.Stdout, os.Stdin); err != nil {
+		log.Fatalf("cannot copy stdin: %v", err)
+	}
 	fmt.Fprint(os.Stderr, os.Getenv("STDERR"))
 
 	exitCodeStr := os.Getenv("EXIT_CODE")
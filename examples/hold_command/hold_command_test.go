@@ -6,12 +6,15 @@
 package hold_command
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -75,9 +78,168 @@ func TestExitCode(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+// TestReleaseOnExitCode tests that "hold" releases the name when the
+// command fails.
+func TestReleaseOnExitCode(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		actual, err := hold(backend, "failure", []string{commandPath, "__expected__"}, []string{
+			"STDOUT=$NAME_MANAGER_NAME",
+			"EXIT_CODE=3",
+		}, "")
+		assert.NoError(t, err)
+		assert.Equal(t, &behavior{stdout: "0", exitCode: 3}, actual)
+	}
+}
+
+// TestSignal tests that "hold" forwards SIGTERM to the command, and
+// releases the name.
+func TestSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be sent on Windows")
+	}
+
+	cmd := nameManagerCommand(backend, "hold", "signal", "sh", "-c",
+		`trap 'echo terminated; exit 3' TERM; echo $NAME_MANAGER_NAME; while true; do sleep 0.1; done`)
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, cmd.Start())
+	r := bufio.NewReader(stdout)
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "0\n", line)
+
+	assert.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	line, err = r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "terminated\n", line)
+	err = cmd.Wait()
+	if assert.IsType(t, &exec.ExitError{}, err) {
+		assert.Equal(t, 3, err.(*exec.ExitError).ExitCode())
+	}
+
+	actual, err := hold(backend, "signal", []string{commandPath, "__expected__"}, []string{
+		"STDOUT=$NAME_MANAGER_NAME",
+		"EXIT_CODE=0",
+	}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", actual.stdout)
+}
+
+// TestLeaseLost tests that "hold" terminates the command, then kills it
+// after the grace period, when the name is lost.
+func TestLeaseLost(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be sent on Windows")
+	}
+
+	cmd := nameManagerCommand(backend, "hold", "--grace-period", "100ms", "lost", "sh", "-c",
+		`trap 'echo terminated' TERM; echo $NAME_MANAGER_NAME; while true; do sleep 0.1; done`)
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	assert.NoError(t, cmd.Start())
+	r := bufio.NewReader(stdout)
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+
+	assert.NoError(t, nameManagerCommand(backend, "delete", "--force", "lost", strings.TrimSpace(line)).Run())
+	line, err = r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "terminated\n", line)
+	err = cmd.Wait()
+	if assert.IsType(t, &exec.ExitError{}, err) {
+		assert.Equal(t, 75, err.(*exec.ExitError).ExitCode())
+	}
+	assert.Contains(t, stderr.String(), "killing it")
+	assert.Contains(t, stderr.String(), "the name is not held anymore")
+}
+
+// TestRetries tests that "hold" runs a failing command again, on the
+// same name or on a name held again.
+func TestRetries(t *testing.T) {
+	env := []string{
+		"STDOUT=$NAME_MANAGER_NAME:$NAME_MANAGER_TOKEN ",
+		"EXIT_CODE=3",
+	}
+
+	actual, err := hold(backend, "retries", []string{"--retries", "2", commandPath, "__expected__"}, env, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "0:1 0:1 0:1 ", actual.stdout)
+	assert.Equal(t, 3, actual.exitCode)
+	assert.Contains(t, actual.stderr, "attempt 2 of 3 failed (exit code 3): retrying")
+
+	actual, err = hold(backend, "retries", []string{"--retries", "1", "--retry-new-name=true", commandPath, "__expected__"}, env, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "0:2 0:3 ", actual.stdout)
+	assert.Equal(t, 3, actual.exitCode)
+}
+
+// TestTimeout tests that "hold" terminates the command after the
+// timeout, and releases the name.
+func TestTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be sent on Windows")
+	}
+
+	actual, err := hold(backend, "timeout", []string{"--timeout", "1s", "--", "sh", "-c",
+		`trap 'echo terminated; exit 3' TERM; echo $NAME_MANAGER_NAME; while true; do sleep 0.1; done`}, nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "0\nterminated\n", actual.stdout)
+	assert.Equal(t, 124, actual.exitCode)
+	assert.Contains(t, actual.stderr, "the command timed out after 1s")
+
+	actual, err = hold(backend, "timeout", []string{commandPath, "__expected__"}, []string{
+		"STDOUT=$NAME_MANAGER_NAME",
+		"EXIT_CODE=0",
+	}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", actual.stdout)
+}
+
+// TestEnv tests that "hold" exports the name to the command.
+func TestEnv(t *testing.T) {
+	expected := &behavior{
+		stdout: "env:0:1",
+	}
+
+	actual, err := hold(backend, "env", []string{commandPath, "__expected__"}, []string{
+		"STDOUT=$NAME_MANAGER_FAMILY:$NAME_MANAGER_NAME:$NAME_MANAGER_TOKEN",
+		"EXIT_CODE=0",
+	}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	actual, err = hold(backend, "env", []string{"--env", "STACK_NAME", commandPath, "__expected__"}, []string{
+		"STDOUT=$STACK_NAME",
+		"EXIT_CODE=0",
+	}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", actual.stdout)
+}
+
+// TestPlaceholders tests that "hold" substitutes the placeholders in the
+// arguments of the command.
+func TestPlaceholders(t *testing.T) {
+	actual, err := hold(backend, "placeholders", []string{commandPath, "__expected__", "stack-{name}", "{family}"}, []string{
+		"EXIT_CODE=0",
+	}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "stack-0 placeholders", actual.stdout)
+}
+
+// TestStdin tests that "hold" passes stdin to the command.
+func TestStdin(t *testing.T) {
+	actual, err := hold(backend, "foo", []string{commandPath, "__expected__"}, []string{
+		"EXIT_CODE=0",
+	}, "__in__")
+	assert.NoError(t, err)
+	assert.Equal(t, "__in__", actual.stdout)
+}
+
 // TestCommandNotFound tests that "hold" fails when the command cannot be found.
 func TestCommandNotFound(t *testing.T) {
-	bh, err := hold(backend, "foo", []string{"__not_found__"}, []string{})
+	bh, err := hold(backend, "foo", []string{"__not_found__"}, []string{}, "")
 	assert.NoError(t, err)
 
 	assert.Equal(t, 1, bh.exitCode)
@@ -113,14 +275,27 @@ func holdStub(backend, family string, expected *behavior) (*behavior, error) {
 			"STDERR=" + expected.stderr,
 			fmt.Sprintf("EXIT_CODE=%d", expected.exitCode),
 		},
+		"",
 	)
 }
 
-func hold(backend, family string, command []string, env []string) (*behavior, error) {
-	args := []string{"hold", family}
+func hold(backend, family string, command []string, env []string, stdin string) (*behavior, error) {
+	args := []string{"hold"}
+	// The flags of "hold" come before the family.
+	for len(command) > 0 && strings.HasPrefix(command[0], "--") && command[0] != "--" {
+		if strings.Contains(command[0], "=") {
+			args = append(args, command[0])
+			command = command[1:]
+		} else {
+			args = append(args, command[0], command[1])
+			command = command[2:]
+		}
+	}
+	args = append(args, family)
 	args = append(args, command...)
 	cmd := nameManagerCommand(backend, args...)
 	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
 
 	rout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+// output_formats tests/demonstrates the machine-readable output formats
+// of the name_manager commands.
+package output_formats
+
+import (
+	"encoding/json"
+	"github.com/hchauvin/name_manager/pkg/name_manager"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backend contains the name_manager backend URL, after initialization.
+var backend string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "output_formats")
+	if err != nil {
+		panic(err.Error())
+	}
+	backend = "local://" + filepath.Join(dir, "db")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// TestOutputFormats tests the output formats of "acquire", "list" and
+// "status".
+func TestOutputFormats(t *testing.T) {
+	out, err := nameManager("acquire", "--label", "job=1", "stack")
+	assert.NoError(t, err)
+	assert.Equal(t, "0\n", out)
+
+	out, err = nameManager("acquire", "--output", "json", "stack")
+	assert.NoError(t, err)
+	var lease name_manager.Lease
+	assert.NoError(t, json.Unmarshal([]byte(out), &lease))
+	assert.Equal(t, name_manager.Lease{Family: "stack", Name: "1", Token: 1, Created: true}, lease)
+
+	out, err = nameManager("list", "--output", "json")
+	assert.NoError(t, err)
+	var names []name_manager.Name
+	assert.NoError(t, json.Unmarshal([]byte(out), &names))
+	if assert.Len(t, names, 2) {
+		assert.Equal(t, "0", names[0].Name)
+		assert.Equal(t, map[string]string{"job": "1"}, names[0].Labels)
+		assert.Equal(t, time.UTC, names[0].CreatedAt.Location())
+	}
+	assert.Contains(t, out, `"createdAt": "`)
+
+	out, err = nameManager("list", "--output", "csv")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, "name,family,createdAt,updatedAt,free,pool,quarantine,token,labels,attributes", lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "0,stack,"))
+		assert.True(t, strings.HasSuffix(lines[1], ",false,false,,1,job=1,"))
+	}
+
+	out, err = nameManager("list", "--output", "template={{.Family}}:{{.Name}}")
+	assert.NoError(t, err)
+	assert.Equal(t, "stack:0\nstack:1\n", out)
+
+	out, err = nameManager("status", "--output", "yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "- family: stack\n  names: 2\n  held: 2\n  free: 0\n  quarantined: 0\n  waiters: 0\n", out)
+
+	_, err = nameManager("list", "--output", "xml")
+	assert.Error(t, err)
+}
+
+func nameManager(args ...string) (string, error) {
+	commandName := "../../bin/name_manager"
+	if runtime.GOOS == "windows" {
+		commandName += ".exe"
+	}
+	cmd := exec.Command(commandName, append([]string{"--backend=" + backend}, args...)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	return string(out), err
+}
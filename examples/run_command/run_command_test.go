@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+// run_command tests/demonstrates the "name_manager run" command.
+package run_command
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestRun tests that "run" runs all the tests, writes their logs and a
+// JUnit XML report, and fails when a test fails.
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the tests are shell commands")
+	}
+
+	dir, err := ioutil.TempDir("", "run_command")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	testsPath := filepath.Join(dir, "tests.txt")
+	assert.NoError(t, ioutil.WriteFile(testsPath, []byte("# Comment\n\necho third {family}\n"), 0644))
+
+	var stdout, stderr strings.Builder
+	cmd := nameManagerCommand(
+		"local://"+filepath.Join(dir, "db"),
+		"run", "--family", "stack", "--env", "STACK_NAME", "--concurrency", "2",
+		"--file", testsPath, "--log-dir", filepath.Join(dir, "logs"), "--junit", filepath.Join(dir, "junit.xml"),
+		"--", "echo first $STACK_NAME", "echo second; exit 3")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if assert.IsType(t, &exec.ExitError{}, err) {
+		assert.Equal(t, 1, err.(*exec.ExitError).ExitCode())
+	}
+	assert.Contains(t, stderr.String(), "1 of 3 tests did not pass")
+	assert.Contains(t, stdout.String(), "FAIL")
+
+	log, err := ioutil.ReadFile(filepath.Join(dir, "logs", "test_1.log"))
+	assert.NoError(t, err)
+	assert.Regexp(t, "^first [01]\n$", string(log))
+	log, err = ioutil.ReadFile(filepath.Join(dir, "logs", "test_3.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "third stack\n", string(log))
+
+	junit, err := ioutil.ReadFile(filepath.Join(dir, "junit.xml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(junit), `<testsuite name="stack" tests="3" failures="1" errors="0" skipped="0"`)
+	assert.Contains(t, string(junit), `<failure message="exit code 3"></failure>`)
+}
+
+func nameManagerCommand(backend string, args ...string) *exec.Cmd {
+	fullArgs := make([]string, 0, len(args)+1)
+	fullArgs = append(fullArgs, "--backend="+backend)
+	fullArgs = append(fullArgs, args...)
+	return exec.Command("../../bin/name_manager", fullArgs...)
+}
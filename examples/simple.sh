@@ -5,7 +5,9 @@
 
 set -eou pipefail
 
-source "examples/executor.sh"
+function name_manager {
+  ./bin/name_manager "$@"
+}
 
 TESTS=(
   "echo Test 1 with stack \$STACK_NAME"
@@ -14,7 +16,7 @@ TESTS=(
   "echo Test 4 with stack \$STACK_NAME"
   "echo Test 5 with stack \$STACK_NAME"
 )
-execute_tests 2 "${TESTS[@]}"
+name_manager run --family stack --env STACK_NAME --concurrency 2 -- "${TESTS[@]}"
 
 echo ""
 echo "Stacks:"
@@ -11,7 +11,9 @@ import (
 	"github.com/hchauvin/name_manager/pkg/internal/hold"
 	"github.com/hchauvin/name_manager/pkg/name_manager"
 	"google.golang.org/api/iterator"
-	"strconv"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
 	"time"
 )
 
@@ -43,6 +45,7 @@ func createNameManager(backendURL string) (name_manager.NameManager, error) {
 // The database is comprised of the following documents:
 // - "families/{families}" (of type familyData): global info on families.
 // - "families/{families}/names/{names}" (of type nameData): one entry per name in a family.
+// - "families/{families}/tickets/{tickets}" (of type ticketData): one entry per waiter.
 //
 // The CreatedAt/UpdatedAt fields come directly from Firestore.
 type firestoreBackend struct {
@@ -54,133 +57,559 @@ type firestoreBackend struct {
 type familyData struct {
 	// Count contains the number of names for the family.
 	Count int `firestore:"count"`
+	// Limit is the maximum number of names for the family, or zero
+	// if the backend-wide limit applies.
+	Limit int `firestore:"limit"`
+	// TicketCount contains the number of tickets ever given to the
+	// waiters of the family.
+	TicketCount int `firestore:"ticketCount"`
+	// Generator is the specification of the name generator of the
+	// family, or an empty string for the default generator.
+	Generator string `firestore:"generator"`
+	// Skipped contains the number of generated names that were skipped
+	// because they were already registered, or that were deleted.  The
+	// next index in the name generator is Count + Skipped.
+	Skipped int `firestore:"skipped"`
+	// Recycled are the sorted indexes of the deleted names that are
+	// generated again before the next index (see
+	// name_manager.WithRecycle).
+	Recycled []int `firestore:"recycled"`
+	// Token is the highest token of the deleted names of the family.  The
+	// names that are registered afterwards start from this token, so that
+	// the tokens of a name that is deleted then registered again keep
+	// increasing.
+	Token int64 `firestore:"token"`
+}
+
+// ticketData contains the data that goes in "families/{family}/tickets/{ticket}"
+// documents.
+type ticketData struct {
+	// Seq is the sequence number of the ticket, which gives the arrival order.
+	Seq int `firestore:"seq"`
 }
 
 // nameData contains the data that goes in "names/{family}/{name}" documents.
 type nameData struct {
 	// Free is true if the name was acquired in the past but is now free.
 	Free bool `firestore:"free"`
+	// Token is the token of the last lease on the name.
+	Token int64 `firestore:"token"`
+	// Fresh is true if the name was registered but never acquired, as
+	// the names of a pool are when the pool is defined.
+	Fresh bool `firestore:"fresh"`
+	// Labels are the labels attached to the name by its last holder.
+	Labels map[string]string `firestore:"labels"`
+	// Attributes are the durable attributes of the name.
+	Attributes map[string]string `firestore:"attributes"`
+	// Quarantine is the reason for the quarantine of the name, or empty
+	// if the name is not quarantined (see NameManager.Quarantine).
+	Quarantine string `firestore:"quarantine"`
+	// Claim is the secret of the claim ticket of the lease, if the name
+	// is being transferred (see NameManager.Transfer).
+	Claim string `firestore:"claim"`
+	// TTL is the time after which the name is automatically released if
+	// it is not kept alive, or zero if the default of the backend
+	// applies.
+	TTL time.Duration `firestore:"ttl"`
 }
 
 func (fbk *firestoreBackend) Hold(family string) (string, <-chan error, name_manager.ReleaseFunc, error) {
 	return fbk.hold().Hold(family)
 }
 
-func (fbk *firestoreBackend) Acquire(family string) (string, error) {
-	ctx := context.Background()
+func (fbk *firestoreBackend) HoldContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return fbk.hold().HoldContext(ctx, family, opts...)
+}
 
-	client, err := fbk.client()
+func (fbk *firestoreBackend) Acquire(family string) (string, error) {
+	lease, err := fbk.AcquireContext(context.Background(), family)
 	if err != nil {
 		return "", err
 	}
+	return lease.Name, nil
+}
+
+func (fbk *firestoreBackend) AcquireContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
 	defer client.Close()
 
-	// We cannot release the zombies in the transaction as listing does not work in transactions
-	// (at least in Firestore emulators).
-	if autoReleaseAfter := fbk.options.autoReleaseAfter; autoReleaseAfter > 0 {
-		if err := fbk.releaseZombies(ctx, client, autoReleaseAfter, family); err != nil {
-			return "", err
-		}
+	if _, err := fbk.releaseZombies(ctx, client, family); err != nil {
+		return name_manager.Lease{}, err
 	}
 
-	name := ""
+	var lease name_manager.Lease
 	if err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		// Try to get the first free name
-		nameDoc, err := tx.Documents(client.Collection(fbk.options.prefix+"families/"+family+"/names").
-			Where("free", "==", true).
-			Limit(1)).Next()
-		if err == nil {
-			// A free name could be found
-			name = nameDoc.Ref.ID
+		familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+		familyD, err := txGetFamilyData(tx, familyRef)
+		if err != nil {
+			return err
+		}
+		limit := fbk.familyLimit(familyD)
+		// The free names are reserved for the waiters: a family at
+		// capacity is full, and only new names can be acquired in the
+		// other families.
+		waiting, err := fbk.hasTickets(client, tx, family)
+		if err != nil {
+			return err
+		}
+		if waiting && limit > 0 {
+			return name_manager.ErrFamilyFull
+		}
+		l, err := fbk.acquireName(client, tx, family, familyRef, familyD, limit, fbk.acquireOptions(opts), waiting)
+		if err != nil {
+			return err
+		}
+		lease = l
+		return nil
+	}); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return lease, nil
+}
 
-			// Acquire the free name
-			if err := tx.Set(nameDoc.Ref, nameData{Free: false}); err != nil {
+func (fbk *firestoreBackend) AcquireMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) ([]name_manager.Lease, error) {
+	families, err := name_manager.SortedFamilies(counts)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	for _, family := range families {
+		if _, err := fbk.releaseZombies(ctx, client, family); err != nil {
+			return nil, err
+		}
+	}
+
+	options := fbk.acquireOptions(opts)
+	var leases []name_manager.Lease
+	if err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		leases = nil
+		// All the reads are done before any write.
+		var writes []txWrite
+		for _, family := range families {
+			familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+			familyD, err := txGetFamilyData(tx, familyRef)
+			if err != nil {
+				return err
+			}
+			limit := fbk.familyLimit(familyD)
+			// The free names are reserved for the waiters.
+			waiting, err := fbk.hasTickets(client, tx, family)
+			if err != nil {
+				return err
+			}
+			if waiting && limit > 0 {
+				return name_manager.ErrFamilyFull
+			}
+			familyLeases, familyWrites, err := fbk.acquireNames(client, tx, family, familyRef, familyD, limit, options, counts[family], waiting)
+			if err != nil {
 				return err
 			}
-			return nil
+			leases = append(leases, familyLeases...)
+			writes = append(writes, familyWrites...)
 		}
+		return applyWrites(tx, writes)
+	}); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
 
-		if err != iterator.Done {
-			// There was an error during the search for a free name
-			return err
-		}
+func (fbk *firestoreBackend) HoldMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) (*name_manager.Holdings, error) {
+	return fbk.hold().HoldMany(ctx, counts, opts...)
+}
 
-		// No free name could be found: a new name will be created using the
-		// counter stored at the family level.
+// acquireName acquires a name inside a Firestore transaction, regardless
+// of the waiters in the queue of the family.  familyD is the data
+// associated with familyRef, as read in the transaction.  If newName is
+// true, the free names are skipped, and a new name is created.
+func (fbk *firestoreBackend) acquireName(
+	client *firestore.Client,
+	tx *firestore.Transaction,
+	family string,
+	familyRef *firestore.DocumentRef,
+	familyD *familyData,
+	limit int,
+	options *name_manager.AcquireOptions,
+	newName bool,
+) (name_manager.Lease, error) {
+	leases, writes, err := fbk.acquireNames(client, tx, family, familyRef, familyD, limit, options, 1, newName)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	if err := applyWrites(tx, writes); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return leases[0], nil
+}
 
-		familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+// hasTickets returns whether a family has waiters in its queue, inside a
+// Firestore transaction.
+func (fbk *firestoreBackend) hasTickets(client *firestore.Client, tx *firestore.Transaction, family string) (bool, error) {
+	_, err := tx.Documents(fbk.tickets(client, family).Limit(1)).Next()
+	if err == iterator.Done {
+		return false, nil
+	}
+	return err == nil, err
+}
 
-		familyDoc, err := txGet(tx, familyRef)
-		if err != nil {
+// txWrite is a write that is deferred until all the reads of a Firestore
+// transaction are done, as Firestore transactions cannot read after they
+// write.
+type txWrite struct {
+	ref  *firestore.DocumentRef
+	data interface{}
+}
+
+// applyWrites applies deferred writes.
+func applyWrites(tx *firestore.Transaction, writes []txWrite) error {
+	for _, write := range writes {
+		if err := tx.Set(write.ref, write.data); err != nil {
 			return err
 		}
-		familyD := familyData{}
-		if familyDoc.Exists() {
-			if err := familyDoc.DataTo(&familyD); err != nil {
-				return err
+	}
+	return nil
+}
+
+// acquireNames acquires count names of a family inside a Firestore
+// transaction, regardless of the waiters in the queue of the family.
+// It only reads: the writes that complete the acquisition are returned.
+// familyD is the data associated with familyRef, as read in the
+// transaction.  If newNames is true, the free names are skipped, and new
+// names are created.
+func (fbk *firestoreBackend) acquireNames(
+	client *firestore.Client,
+	tx *firestore.Transaction,
+	family string,
+	familyRef *firestore.DocumentRef,
+	familyD *familyData,
+	limit int,
+	options *name_manager.AcquireOptions,
+	count int,
+	newNames bool,
+) ([]name_manager.Lease, []txWrite, error) {
+	var leases []name_manager.Lease
+	var writes []txWrite
+
+	// Try to get the first free names matching the selector.  The equality
+	// requirements are part of the query, and the other requirements are
+	// checked on the documents read in the transaction.
+	query := client.Collection(fbk.options.prefix+"families/"+family+"/names").
+		Where("free", "==", true)
+	exact := true
+	for _, requirement := range options.Selector {
+		if requirement.Operator == name_manager.Equals {
+			query = query.WherePath(firestore.FieldPath{"attributes", requirement.Key}, "==", requirement.Value)
+		} else {
+			exact = false
+		}
+	}
+	if exact {
+		// Only read the documents that are needed so that the transaction
+		// does not conflict with the acquisition of the other free names.
+		// The quarantined names among them are skipped, so the documents
+		// are read page by page until enough names are found.
+		query = query.OrderBy(firestore.DocumentID, firestore.Asc)
+	}
+	var last *firestore.DocumentSnapshot
+	for !newNames && len(leases) < count {
+		page := query
+		pageSize := count - len(leases)
+		if exact {
+			page = page.Limit(pageSize)
+			if last != nil {
+				page = page.StartAfter(last)
+			}
+		}
+		read := 0
+		nameIter := tx.Documents(page)
+		for len(leases) < count {
+			nameDoc, err := nameIter.Next()
+			if err == iterator.Done {
+				break
 			}
+			if err != nil {
+				// There was an error during the search for a free name
+				nameIter.Stop()
+				return nil, nil, err
+			}
+			read += 1
+			last = nameDoc
+
+			nameD := nameData{}
+			if err := nameDoc.DataTo(&nameD); err != nil {
+				nameIter.Stop()
+				return nil, nil, err
+			}
+			if nameD.Quarantine != "" || !options.Matches(nameD.Attributes) {
+				continue
+			}
+
+			// Acquire the free name
+			created := nameD.Fresh
+			nameD.Free = false
+			nameD.Token += 1
+			nameD.Fresh = false
+			nameD.Labels = options.Labels
+			nameD.Claim = ""
+			nameD.TTL = options.TTL
+			writes = append(writes, txWrite{ref: nameDoc.Ref, data: nameD})
+			leases = append(leases, name_manager.Lease{Family: family, Name: nameDoc.Ref.ID, Token: nameD.Token, Created: created})
+		}
+		nameIter.Stop()
+		// Without a limit, the whole query was read, and a page that is
+		// not full is the last one.
+		if !exact || read < pageSize {
+			break
 		}
-		name = strconv.Itoa(familyD.Count)
+	}
+	if len(leases) == count {
+		return leases, writes, nil
+	}
 
-		if err := tx.Set(
-			client.Doc(fmt.Sprintf(fbk.options.prefix+"families/%s/names/%s", family, name)),
-			nameData{Free: false},
-		); err != nil {
-			return err
+	if !options.CanCreateName() {
+		// The acquisition can wait for the matching names that are in
+		// use to be released.
+		matching, err := fbk.hasMatchingName(client, tx, family, options.Selector)
+		if err != nil {
+			return nil, nil, err
 		}
+		if matching {
+			return nil, nil, name_manager.ErrFamilyFull
+		}
+		return nil, nil, name_manager.ErrNoMatchingName
+	}
 
+	// Not enough free names could be found: new names will be created
+	// using the name generator and the counter stored at the family level.
+
+	if limit > 0 && familyD.Count+count-len(leases) > limit {
+		return nil, nil, name_manager.ErrFamilyFull
+	}
+	generator, err := name_manager.ParseNameGenerator(familyD.Generator)
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(leases) < count && len(familyD.Recycled) > 0 {
+		index := familyD.Recycled[0]
+		familyD.Recycled = familyD.Recycled[1:]
+		name, err := generator.Generate(index)
+		if err != nil {
+			return nil, nil, err
+		}
+		nameRef := fbk.nameRef(client, family, name)
+		nameDoc, err := txGet(tx, nameRef)
+		if err != nil {
+			return nil, nil, err
+		}
+		if nameDoc.Exists() || hasLease(leases, name) {
+			continue
+		}
+		// The recycled index was counted as skipped when the name was
+		// deleted.
 		familyD.Count += 1
-		err = tx.Set(familyRef, familyD)
-		return err
-	}); err != nil {
-		return "", err
+		familyD.Skipped -= 1
+		writes = append(writes, txWrite{ref: nameRef, data: nameData{Free: false, Token: familyD.Token + 1, Labels: options.Labels, TTL: options.TTL}})
+		leases = append(leases, name_manager.Lease{Family: family, Name: name, Token: familyD.Token + 1, Created: true})
+	}
+	skipped := 0
+	for len(leases) < count {
+		if skipped == name_manager.NameGenerationAttempts {
+			return nil, nil, fmt.Errorf("could not generate a new name for family %s", family)
+		}
+		name, err := generator.Generate(familyD.Count + familyD.Skipped)
+		if err != nil {
+			return nil, nil, err
+		}
+		nameRef := fbk.nameRef(client, family, name)
+		nameDoc, err := txGet(tx, nameRef)
+		if err != nil {
+			return nil, nil, err
+		}
+		if nameDoc.Exists() || hasLease(leases, name) {
+			familyD.Skipped += 1
+			skipped += 1
+			continue
+		}
+		skipped = 0
+		familyD.Count += 1
+		writes = append(writes, txWrite{ref: nameRef, data: nameData{Free: false, Token: familyD.Token + 1, Labels: options.Labels, TTL: options.TTL}})
+		leases = append(leases, name_manager.Lease{Family: family, Name: name, Token: familyD.Token + 1, Created: true})
+	}
+	writes = append(writes, txWrite{ref: familyRef, data: *familyD})
+	return leases, writes, nil
+}
+
+// hasMatchingName returns whether a name of the given family, free or
+// not, matches a selector.
+func (fbk *firestoreBackend) hasMatchingName(
+	client *firestore.Client,
+	tx *firestore.Transaction,
+	family string,
+	selector name_manager.Selector,
+) (bool, error) {
+	query := client.Collection(fbk.options.prefix + "families/" + family + "/names").Query
+	for _, requirement := range selector {
+		if requirement.Operator == name_manager.Equals {
+			query = query.WherePath(firestore.FieldPath{"attributes", requirement.Key}, "==", requirement.Value)
+		}
+	}
+	nameIter := tx.Documents(query)
+	defer nameIter.Stop()
+	for {
+		nameDoc, err := nameIter.Next()
+		if err == iterator.Done {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		nameD := nameData{}
+		if err := nameDoc.DataTo(&nameD); err != nil {
+			return false, err
+		}
+		if selector.Matches(nameD.Attributes) {
+			return true, nil
+		}
+	}
+}
+
+// hasLease returns whether there is a lease on a name in a list of leases.
+func hasLease(leases []name_manager.Lease, name string) bool {
+	for _, lease := range leases {
+		if lease.Name == name {
+			return true
+		}
 	}
-	return name, nil
+	return false
+}
+
+func (fbk *firestoreBackend) AcquireWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	return fbk.hold().AcquireWait(ctx, family, opts...)
+}
+
+func (fbk *firestoreBackend) HoldWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return fbk.hold().HoldWait(ctx, family, opts...)
 }
 
 func (fbk *firestoreBackend) KeepAlive(family, name string) error {
-	ctx := context.Background()
+	return fbk.KeepAliveContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
 
-	client, err := fbk.client()
+func (fbk *firestoreBackend) KeepAliveContext(ctx context.Context, lease name_manager.Lease) error {
+	client, err := fbk.client(ctx)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
 	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		nameRef := client.Doc(fmt.Sprintf(fbk.options.prefix+"families/%s/names/%s", family, name))
-		doc, err := txGet(tx, nameRef)
+		nameRef := fbk.nameRef(client, lease.Family, lease.Name)
+		// The lease is checked separately, to tell names that are not
+		// held from names that are held with another lease.
+		nameD, err := txGetLeasedName(tx, nameRef, name_manager.Lease{Family: lease.Family, Name: lease.Name})
 		if err != nil {
 			return err
 		}
-
-		if !doc.Exists() {
-			return nil
-		}
-		nameD := nameData{}
-		if err := doc.DataTo(&nameD); err != nil {
-			return err
+		if nameD == nil {
+			return name_manager.ErrNotHeld
 		}
-		if nameD.Free {
-			return nil
+		if lease.Token != 0 && nameD.Token != lease.Token {
+			return name_manager.ErrLeaseLost
 		}
 
-		err = tx.Set(nameRef, nameD)
+		err = tx.Set(nameRef, *nameD)
 		return err
 	})
 }
 
+func (fbk *firestoreBackend) Transfer(ctx context.Context, lease name_manager.Lease) (name_manager.ClaimTicket, error) {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	defer client.Close()
+
+	var ticket name_manager.ClaimTicket
+	if err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		nameRef := fbk.nameRef(client, lease.Family, lease.Name)
+		nameD, err := txGetLeasedName(tx, nameRef, name_manager.Lease{Family: lease.Family, Name: lease.Name})
+		if err != nil {
+			return err
+		}
+		if nameD == nil {
+			return name_manager.ErrNotHeld
+		}
+		if lease.Token != 0 && nameD.Token != lease.Token {
+			return name_manager.ErrLeaseLost
+		}
+		ticket, err = name_manager.NewClaimTicket(name_manager.Lease{
+			Family: lease.Family,
+			Name:   lease.Name,
+			Token:  nameD.Token,
+		})
+		if err != nil {
+			return err
+		}
+		nameD.Claim = ticket.Secret
+		return tx.Set(nameRef, *nameD)
+	}); err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	return ticket, nil
+}
+
+func (fbk *firestoreBackend) Claim(ctx context.Context, ticket name_manager.ClaimTicket, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	defer client.Close()
+
+	var lease name_manager.Lease
+	if err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		nameRef := fbk.nameRef(client, ticket.Family, ticket.Name)
+		nameD, err := txGetLeasedName(tx, nameRef, name_manager.Lease{Family: ticket.Family, Name: ticket.Name})
+		if err != nil {
+			return err
+		}
+		if nameD == nil || nameD.Token != ticket.Token || nameD.Claim == "" || nameD.Claim != ticket.Secret {
+			return name_manager.ErrInvalidClaim
+		}
+		nameD.Token += 1
+		options := fbk.acquireOptions(opts)
+		nameD.Labels = options.Labels
+		nameD.Claim = ""
+		nameD.TTL = options.TTL
+		lease = name_manager.Lease{Family: ticket.Family, Name: ticket.Name, Token: nameD.Token}
+		return tx.Set(nameRef, *nameD)
+	}); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return lease, nil
+}
+
 func (fbk *firestoreBackend) Release(family, name string) error {
-	ctx := context.Background()
+	return fbk.ReleaseContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
 
-	client, err := fbk.client()
+func (fbk *firestoreBackend) ReleaseContext(ctx context.Context, lease name_manager.Lease) error {
+	client, err := fbk.client(ctx)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
 	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		return fbk.release(client, tx, family, name)
+		return fbk.release(client, tx, lease)
 	})
 }
 
@@ -188,17 +617,29 @@ func (fbk *firestoreBackend) TryHold(family, name string) (<-chan error, name_ma
 	return fbk.hold().TryHold(family, name)
 }
 
+func (fbk *firestoreBackend) TryHoldContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return fbk.hold().TryHoldContext(ctx, family, name, opts...)
+}
+
 func (fbk *firestoreBackend) TryAcquire(family, name string) error {
-	ctx := context.Background()
+	_, err := fbk.TryAcquireContext(context.Background(), family, name)
+	return err
+}
 
-	client, err := fbk.client()
+func (fbk *firestoreBackend) TryAcquireContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	client, err := fbk.client(ctx)
 	if err != nil {
-		return err
+		return name_manager.Lease{}, err
 	}
 	defer client.Close()
 
-	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		nameRef := client.Doc(fmt.Sprintf(fbk.options.prefix+"families/%s/names/%s", family, name))
+	if _, err := fbk.releaseZombies(ctx, client, family); err != nil {
+		return name_manager.Lease{}, err
+	}
+
+	var lease name_manager.Lease
+	if err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		nameRef := fbk.nameRef(client, family, name)
 		nameDoc, err := txGet(tx, nameRef)
 		if err != nil {
 			return err
@@ -213,15 +654,28 @@ func (fbk *firestoreBackend) TryAcquire(family, name string) error {
 		if !nameD.Free {
 			return name_manager.ErrInUse
 		}
+		created := nameD.Fresh
 		nameD.Free = false
+		nameD.Token += 1
+		nameD.Fresh = false
+		options := fbk.acquireOptions(opts)
+		nameD.Labels = options.Labels
+		nameD.Claim = ""
+		nameD.TTL = options.TTL
+		lease = name_manager.Lease{Family: family, Name: name, Token: nameD.Token, Created: created}
 		return tx.Set(nameRef, nameD)
-	})
+	}); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return lease, nil
 }
 
 func (fbk *firestoreBackend) List() ([]name_manager.Name, error) {
-	ctx := context.Background()
+	return fbk.ListContext(context.Background())
+}
 
-	client, err := fbk.client()
+func (fbk *firestoreBackend) ListContext(ctx context.Context) ([]name_manager.Name, error) {
+	client, err := fbk.client(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -237,6 +691,10 @@ func (fbk *firestoreBackend) List() ([]name_manager.Name, error) {
 			}
 			return nil, err
 		}
+		familyD := familyData{}
+		if err := familyDoc.DataTo(&familyD); err != nil {
+			return nil, err
+		}
 
 		nameIter := familyDoc.Ref.Collection("names").Documents(ctx)
 		for {
@@ -252,13 +710,22 @@ func (fbk *firestoreBackend) List() ([]name_manager.Name, error) {
 			if err := nameDoc.DataTo(&nameD); err != nil {
 				return nil, err
 			}
+			var labels map[string]string
+			if !nameD.Free {
+				labels = nameD.Labels
+			}
 
 			names = append(names, name_manager.Name{
-				Name:      nameDoc.Ref.ID,
-				Family:    familyDoc.Ref.ID,
-				CreatedAt: nameDoc.CreateTime,
-				UpdatedAt: nameDoc.UpdateTime,
-				Free:      nameD.Free,
+				Name:       nameDoc.Ref.ID,
+				Family:     familyDoc.Ref.ID,
+				CreatedAt:  nameDoc.CreateTime,
+				UpdatedAt:  nameDoc.UpdateTime,
+				Free:       nameD.Free,
+				Quarantine: nameD.Quarantine,
+				Token:      nameD.Token,
+				Labels:     labels,
+				Attributes: nameD.Attributes,
+				Pool:       name_manager.IsPoolMember(familyD.Generator, nameDoc.Ref.ID),
 			})
 		}
 	}
@@ -266,9 +733,11 @@ func (fbk *firestoreBackend) List() ([]name_manager.Name, error) {
 }
 
 func (fbk *firestoreBackend) Reset() error {
-	ctx := context.Background()
+	return fbk.ResetContext(context.Background())
+}
 
-	client, err := fbk.client()
+func (fbk *firestoreBackend) ResetContext(ctx context.Context) error {
+	client, err := fbk.client(ctx)
 	if err != nil {
 		return err
 	}
@@ -284,18 +753,20 @@ func (fbk *firestoreBackend) Reset() error {
 			return err
 		}
 
-		nameIter := familyDoc.Ref.Collection("names").Documents(ctx)
-		for {
-			nameDoc, err := nameIter.Next()
-			if err != nil {
-				if err == iterator.Done {
-					break
+		for _, collection := range []string{"names", "tickets"} {
+			docIter := familyDoc.Ref.Collection(collection).Documents(ctx)
+			for {
+				doc, err := docIter.Next()
+				if err != nil {
+					if err == iterator.Done {
+						break
+					}
+					return err
 				}
-				return err
-			}
 
-			if _, err := nameDoc.Ref.Delete(ctx); err != nil {
-				return err
+				if _, err := doc.Ref.Delete(ctx); err != nil {
+					return err
+				}
 			}
 		}
 
@@ -307,69 +778,632 @@ func (fbk *firestoreBackend) Reset() error {
 	return nil
 }
 
-func (fbk *firestoreBackend) client() (*firestore.Client, error) {
-	connectCtx, cancelConnect := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancelConnect()
-	return firestore.NewClient(connectCtx, fbk.options.projectID)
-}
-
-func (fbk *firestoreBackend) hold() *hold.Hold {
-	return &hold.Hold{
-		Manager:           fbk,
-		Clock:             clock.New(),
-		KeepAliveInterval: fbk.options.autoReleaseAfter / 3,
-	}
-}
-
-// release implements name release inside a Firestore transaction.
-func (fbk *firestoreBackend) release(client *firestore.Client, tx *firestore.Transaction, family, name string) error {
-	nameRef := client.Doc(fmt.Sprintf(fbk.options.prefix+"families/%s/names/%s", family, name))
-	nameDoc, err := txGet(tx, nameRef)
+func (fbk *firestoreBackend) Reap(ctx context.Context, families ...string) ([]name_manager.Lease, error) {
+	client, err := fbk.client(ctx)
 	if err != nil {
-		return err
-	}
-	// We only add a free name if the name has some data associated to
-	// it.
-	if !nameDoc.Exists() {
-		return nil
+		return nil, err
 	}
-	return tx.Set(nameRef, nameData{Free: true})
-}
-
-// releaseZombies releases the zombie names (that is, those that are not kept alive anymore
-// and should be garbage-collected).
-func (fbk *firestoreBackend) releaseZombies(ctx context.Context, client *firestore.Client, autoReleaseAfter time.Duration, family string) error {
-	now := time.Now()
-	familyIter := client.Collection(fbk.options.prefix + "families").Documents(ctx)
-	for {
-		familyDoc, err := familyIter.Next()
-		if err != nil {
-			if err == iterator.Done {
-				break
-			}
-			return err
-		}
+	defer client.Close()
 
-		nameIter := familyDoc.Ref.Collection("names").Documents(ctx)
+	reaped := append([]string(nil), families...)
+	if len(reaped) == 0 {
+		familyIter := client.Collection(fbk.options.prefix + "families").Documents(ctx)
 		for {
-			nameDoc, err := nameIter.Next()
+			familyDoc, err := familyIter.Next()
 			if err != nil {
 				if err == iterator.Done {
 					break
 				}
-				return err
+				return nil, err
 			}
+			reaped = append(reaped, familyDoc.Ref.ID)
+		}
+	}
+	sort.Strings(reaped)
 
-			if now.Sub(nameDoc.UpdateTime) > autoReleaseAfter {
-				if err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-					return fbk.release(client, tx, family, nameDoc.Ref.ID)
-				}); err != nil {
-					return err
-				}
-			}
+	var released []name_manager.Lease
+	for _, family := range reaped {
+		leases, err := fbk.releaseZombies(ctx, client, family)
+		if err != nil {
+			return nil, err
 		}
+		released = append(released, leases...)
 	}
-	return nil
+	return released, nil
+}
+
+func (fbk *firestoreBackend) Delete(ctx context.Context, family, name string, opts ...name_manager.DeleteOption) error {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	options := name_manager.NewDeleteOptions(opts...)
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+		familyD, err := txGetFamilyData(tx, familyRef)
+		if err != nil {
+			return err
+		}
+		nameRef := fbk.nameRef(client, family, name)
+		nameDoc, err := txGet(tx, nameRef)
+		if err != nil {
+			return err
+		}
+		if !nameDoc.Exists() {
+			return name_manager.ErrNotExist
+		}
+		nameD := nameData{}
+		if err := nameDoc.DataTo(&nameD); err != nil {
+			return err
+		}
+		if !nameD.Free && !options.Force {
+			return name_manager.ErrInUse
+		}
+
+		if options.Recycle {
+			generator, err := name_manager.ParseNameGenerator(familyD.Generator)
+			if err != nil {
+				return err
+			}
+			if index := name_manager.NameIndex(generator, name, familyD.Count+familyD.Skipped); index >= 0 {
+				familyD.Recycled = name_manager.InsertIndex(familyD.Recycled, index)
+			}
+		}
+		// The next index is unchanged.
+		familyD.Count -= 1
+		familyD.Skipped += 1
+		if nameD.Token > familyD.Token {
+			familyD.Token = nameD.Token
+		}
+		if err := tx.Delete(nameRef); err != nil {
+			return err
+		}
+		return tx.Set(familyRef, *familyD)
+	})
+}
+
+func (fbk *firestoreBackend) DeleteFamily(ctx context.Context, family string, opts ...name_manager.DeleteOption) error {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	options := name_manager.NewDeleteOptions(opts...)
+	familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+
+	// The names are checked and deleted in the same transaction, so that
+	// no name can be acquired in the meantime.
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		nameDocs, err := tx.Documents(familyRef.Collection("names")).GetAll()
+		if err != nil {
+			return err
+		}
+		if !options.Force {
+			for _, nameDoc := range nameDocs {
+				nameD := nameData{}
+				if err := nameDoc.DataTo(&nameD); err != nil {
+					return err
+				}
+				if !nameD.Free {
+					return name_manager.ErrInUse
+				}
+			}
+		}
+		ticketDocs, err := tx.Documents(familyRef.Collection("tickets")).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, doc := range append(nameDocs, ticketDocs...) {
+			if err := tx.Delete(doc.Ref); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(familyRef)
+	})
+}
+
+func (fbk *firestoreBackend) Enqueue(ctx context.Context, family string) (name_manager.Ticket, error) {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return name_manager.Ticket{}, err
+	}
+	defer client.Close()
+
+	if _, err := fbk.releaseZombies(ctx, client, family); err != nil {
+		return name_manager.Ticket{}, err
+	}
+
+	var ticketRef *firestore.DocumentRef
+	position := 0
+	if err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+		familyD, err := txGetFamilyData(tx, familyRef)
+		if err != nil {
+			return err
+		}
+		waiters, err := tx.Documents(fbk.tickets(client, family)).GetAll()
+		if err != nil {
+			return err
+		}
+		position = len(waiters)
+
+		familyD.TicketCount += 1
+		ticketRef = client.Doc(fmt.Sprintf(fbk.options.prefix+"families/%s/tickets/%d", family, familyD.TicketCount))
+		if err := tx.Set(ticketRef, ticketData{Seq: familyD.TicketCount}); err != nil {
+			return err
+		}
+		return tx.Set(familyRef, *familyD)
+	}); err != nil {
+		return name_manager.Ticket{}, err
+	}
+
+	ticketDoc, err := ticketRef.Get(ctx)
+	if err != nil {
+		return name_manager.Ticket{}, err
+	}
+	return name_manager.Ticket{
+		ID:        ticketRef.ID,
+		Family:    family,
+		Position:  position,
+		CreatedAt: ticketDoc.CreateTime,
+		UpdatedAt: ticketDoc.UpdateTime,
+	}, nil
+}
+
+func (fbk *firestoreBackend) PollTicket(ctx context.Context, family, ticketID string, opts ...name_manager.AcquireOption) (name_manager.Lease, int, error) {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	defer client.Close()
+
+	if _, err := fbk.releaseZombies(ctx, client, family); err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+
+	var lease name_manager.Lease
+	position := 0
+	if err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		lease = name_manager.Lease{}
+		ticketRef := client.Doc(fmt.Sprintf(fbk.options.prefix+"families/%s/tickets/%s", family, ticketID))
+		ticketDoc, err := txGet(tx, ticketRef)
+		if err != nil {
+			return err
+		}
+		if !ticketDoc.Exists() {
+			return name_manager.ErrTicketExpired
+		}
+		ticketD := ticketData{}
+		if err := ticketDoc.DataTo(&ticketD); err != nil {
+			return err
+		}
+
+		familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+		familyD, err := txGetFamilyData(tx, familyRef)
+		if err != nil {
+			return err
+		}
+
+		ahead, err := tx.Documents(fbk.tickets(client, family).Where("seq", "<", ticketD.Seq)).GetAll()
+		if err != nil {
+			return err
+		}
+		position = len(ahead)
+
+		if position == 0 {
+			l, err := fbk.acquireName(client, tx, family, familyRef, familyD, fbk.familyLimit(familyD), fbk.acquireOptions(opts), false)
+			if err == nil {
+				lease = l
+				return tx.Delete(ticketRef)
+			}
+			if err != name_manager.ErrFamilyFull && err != name_manager.ErrPoolExhausted {
+				return err
+			}
+		}
+
+		// Setting the ticket document updates its UpdateTime, which is used
+		// to expire abandoned tickets.
+		return tx.Set(ticketRef, ticketD)
+	}); err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	return lease, position, nil
+}
+
+func (fbk *firestoreBackend) CancelTicket(ctx context.Context, family, ticketID string) error {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.Doc(fmt.Sprintf(fbk.options.prefix+"families/%s/tickets/%s", family, ticketID)).Delete(ctx)
+	return err
+}
+
+func (fbk *firestoreBackend) Queue(ctx context.Context, family string) ([]name_manager.Ticket, error) {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	if _, err := fbk.releaseZombies(ctx, client, family); err != nil {
+		return nil, err
+	}
+
+	var tickets []name_manager.Ticket
+	ticketIter := fbk.tickets(client, family).OrderBy("seq", firestore.Asc).Documents(ctx)
+	for {
+		ticketDoc, err := ticketIter.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+
+		tickets = append(tickets, name_manager.Ticket{
+			ID:        ticketDoc.Ref.ID,
+			Family:    family,
+			Position:  len(tickets),
+			CreatedAt: ticketDoc.CreateTime,
+			UpdatedAt: ticketDoc.UpdateTime,
+		})
+	}
+	return tickets, nil
+}
+
+func (fbk *firestoreBackend) SetFamilyLimit(ctx context.Context, family string, limit int) error {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+		familyD, err := txGetFamilyData(tx, familyRef)
+		if err != nil {
+			return err
+		}
+		familyD.Limit = limit
+		return tx.Set(familyRef, *familyD)
+	})
+}
+
+func (fbk *firestoreBackend) GetAttributes(ctx context.Context, family, name string) (map[string]string, error) {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	nameDoc, err := fbk.nameRef(client, family, name).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, name_manager.ErrNotExist
+		}
+		return nil, err
+	}
+	nameD := nameData{}
+	if err := nameDoc.DataTo(&nameD); err != nil {
+		return nil, err
+	}
+	return nameD.Attributes, nil
+}
+
+func (fbk *firestoreBackend) SetAttributes(ctx context.Context, family, name string, attributes map[string]string) error {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		nameRef := fbk.nameRef(client, family, name)
+		nameDoc, err := txGet(tx, nameRef)
+		if err != nil {
+			return err
+		}
+		if !nameDoc.Exists() {
+			return name_manager.ErrNotExist
+		}
+		nameD := nameData{}
+		if err := nameDoc.DataTo(&nameD); err != nil {
+			return err
+		}
+		for key, value := range attributes {
+			if value == "" {
+				delete(nameD.Attributes, key)
+				continue
+			}
+			if nameD.Attributes == nil {
+				nameD.Attributes = make(map[string]string)
+			}
+			nameD.Attributes[key] = value
+		}
+		return tx.Set(nameRef, nameD)
+	})
+}
+
+func (fbk *firestoreBackend) Quarantine(ctx context.Context, family, name, reason string) error {
+	return fbk.quarantine(ctx, family, name, name_manager.QuarantineReason(reason))
+}
+
+func (fbk *firestoreBackend) Unquarantine(ctx context.Context, family, name string) error {
+	return fbk.quarantine(ctx, family, name, "")
+}
+
+// quarantine sets the reason for the quarantine of a name, or lifts the
+// quarantine if the reason is empty.
+func (fbk *firestoreBackend) quarantine(ctx context.Context, family, name, reason string) error {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		nameRef := fbk.nameRef(client, family, name)
+		nameDoc, err := txGet(tx, nameRef)
+		if err != nil {
+			return err
+		}
+		if !nameDoc.Exists() {
+			return name_manager.ErrNotExist
+		}
+		nameD := nameData{}
+		if err := nameDoc.DataTo(&nameD); err != nil {
+			return err
+		}
+		nameD.Quarantine = reason
+		return tx.Set(nameRef, nameD)
+	})
+}
+
+func (fbk *firestoreBackend) SetNameGenerator(ctx context.Context, family string, generator name_manager.NameGenerator) error {
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+		familyD, err := txGetFamilyData(tx, familyRef)
+		if err != nil {
+			return err
+		}
+		familyD.Generator = generator.Spec()
+		return tx.Set(familyRef, *familyD)
+	})
+}
+
+func (fbk *firestoreBackend) DefinePool(ctx context.Context, family string, names []string) error {
+	pool, err := name_manager.NewPoolGenerator(names)
+	if err != nil {
+		return err
+	}
+
+	client, err := fbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		familyRef := client.Doc(fbk.options.prefix + "families/" + family)
+		familyD, err := txGetFamilyData(tx, familyRef)
+		if err != nil {
+			return err
+		}
+		nameDocs, err := tx.Documents(familyRef.Collection("names")).GetAll()
+		if err != nil {
+			return err
+		}
+		registered := make(map[string]bool, len(nameDocs))
+		for _, nameDoc := range nameDocs {
+			if !pool.Contains(nameDoc.Ref.ID) {
+				return fmt.Errorf("name '%s' of family '%s' is not in the pool", nameDoc.Ref.ID, family)
+			}
+			registered[nameDoc.Ref.ID] = true
+		}
+
+		for _, name := range pool.Names {
+			if registered[name] {
+				continue
+			}
+			if err := tx.Set(fbk.nameRef(client, family, name), nameData{Free: true, Token: familyD.Token, Fresh: true}); err != nil {
+				return err
+			}
+		}
+
+		// All the names of the pool are registered: the generator must
+		// not generate any new name.
+		familyD.Count = len(pool.Names)
+		familyD.Skipped = 0
+		familyD.Generator = pool.Spec()
+		return tx.Set(familyRef, *familyD)
+	})
+}
+
+func (fbk *firestoreBackend) client(ctx context.Context) (*firestore.Client, error) {
+	connectCtx, cancelConnect := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelConnect()
+	return firestore.NewClient(connectCtx, fbk.options.projectID)
+}
+
+func (fbk *firestoreBackend) hold() *hold.Hold {
+	return &hold.Hold{
+		Manager: fbk,
+		Clock:   clock.New(),
+		KeepAlivePolicy: fbk.options.keepAlive.Merge(
+			name_manager.DefaultKeepAlivePolicy(0)),
+		DefaultTTL:   fbk.options.autoReleaseAfter,
+		MaxTTL:       fbk.options.maxTTL,
+		PollInterval: fbk.options.pollInterval,
+	}
+}
+
+// release implements name release inside a Firestore transaction.
+func (fbk *firestoreBackend) release(client *firestore.Client, tx *firestore.Transaction, lease name_manager.Lease) error {
+	nameRef := fbk.nameRef(client, lease.Family, lease.Name)
+	nameD, err := txGetLeasedName(tx, nameRef, lease)
+	if err != nil {
+		return err
+	}
+	// We only add a free name if the name is in use.
+	if nameD == nil {
+		return nil
+	}
+	nameD.Free = true
+	return tx.Set(nameRef, *nameD)
+}
+
+// nameRef returns the reference to the document of a name.
+func (fbk *firestoreBackend) nameRef(client *firestore.Client, family, name string) *firestore.DocumentRef {
+	return client.Doc(fmt.Sprintf(fbk.options.prefix+"families/%s/names/%s", family, name))
+}
+
+// releaseZombies releases the zombie names (that is, those that are not kept alive anymore
+// and should be garbage-collected), and expires the tickets that are not polled anymore.
+// We cannot release the zombies in a transaction as listing does not work in transactions
+// (at least in Firestore emulators).  It returns the leases that were released.
+func (fbk *firestoreBackend) releaseZombies(ctx context.Context, client *firestore.Client, family string) ([]name_manager.Lease, error) {
+	autoReleaseAfter := fbk.options.autoReleaseAfter
+
+	now := time.Now()
+	var released []name_manager.Lease
+	nameIter := client.Collection(fbk.options.prefix + "families/" + family + "/names").Documents(ctx)
+	for {
+		nameDoc, err := nameIter.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+
+		nameD := nameData{}
+		if err := nameDoc.DataTo(&nameD); err != nil {
+			return nil, err
+		}
+		ttl := nameD.TTL
+		if ttl <= 0 {
+			ttl = autoReleaseAfter
+		}
+		if !nameD.Free && ttl > 0 && now.Sub(nameDoc.UpdateTime) > ttl {
+			if nameD.Claim != "" {
+				// The names that are being transferred wait for their claim.
+				continue
+			}
+			// The token ensures that a name acquired again in the meantime
+			// is not released.
+			lease := name_manager.Lease{Family: family, Name: nameDoc.Ref.ID, Token: nameD.Token}
+			err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+				return fbk.release(client, tx, lease)
+			})
+			if err == name_manager.ErrLeaseLost {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			released = append(released, lease)
+		}
+	}
+
+	if autoReleaseAfter <= 0 {
+		return released, nil
+	}
+	ticketIter := fbk.tickets(client, family).Documents(ctx)
+	for {
+		ticketDoc, err := ticketIter.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+
+		if now.Sub(ticketDoc.UpdateTime) > autoReleaseAfter {
+			// The precondition ensures that a ticket that was polled in the
+			// meantime is not expired.
+			_, err := ticketDoc.Ref.Delete(ctx, firestore.LastUpdateTime(ticketDoc.UpdateTime))
+			if err != nil && status.Code(err) != codes.FailedPrecondition {
+				return nil, err
+			}
+		}
+	}
+	return released, nil
+}
+
+// acquireOptions applies acquisition options, and resolves the TTL of
+// the lease.
+func (fbk *firestoreBackend) acquireOptions(opts []name_manager.AcquireOption) *name_manager.AcquireOptions {
+	options := name_manager.NewAcquireOptions(opts...)
+	options.TTL = options.LeaseTTL(fbk.options.autoReleaseAfter, fbk.options.maxTTL)
+	return options
+}
+
+// tickets returns the query for the tickets of a family.
+func (fbk *firestoreBackend) tickets(client *firestore.Client, family string) firestore.Query {
+	return client.Collection(fbk.options.prefix + "families/" + family + "/tickets").Query
+}
+
+// familyLimit returns the maximum number of names for a family, or zero
+// if there is no limit.
+func (fbk *firestoreBackend) familyLimit(familyD *familyData) int {
+	if familyD.Limit > 0 {
+		return familyD.Limit
+	}
+	return fbk.options.familyLimit
+}
+
+// txGetFamilyData gets the data associated with a family inside a Firestore
+// transaction.  If the family document does not exist, empty data is
+// returned.
+func txGetFamilyData(tx *firestore.Transaction, familyRef *firestore.DocumentRef) (*familyData, error) {
+	familyDoc, err := txGet(tx, familyRef)
+	if err != nil {
+		return nil, err
+	}
+	familyD := &familyData{}
+	if familyDoc.Exists() {
+		if err := familyDoc.DataTo(familyD); err != nil {
+			return nil, err
+		}
+	}
+	return familyD, nil
+}
+
+// txGetLeasedName gets the data associated with a name in use inside a
+// Firestore transaction.  nil is returned if the name is free or does
+// not exist.  If the lease has a token, ErrLeaseLost is returned when
+// the lease is not the current lease on the name.
+func txGetLeasedName(tx *firestore.Transaction, nameRef *firestore.DocumentRef, lease name_manager.Lease) (*nameData, error) {
+	nameDoc, err := txGet(tx, nameRef)
+	if err != nil {
+		return nil, err
+	}
+	var nameD *nameData
+	if nameDoc.Exists() {
+		nameD = &nameData{}
+		if err := nameDoc.DataTo(nameD); err != nil {
+			return nil, err
+		}
+		if nameD.Free {
+			nameD = nil
+		}
+	}
+	if lease.Token != 0 && (nameD == nil || nameD.Token != lease.Token) {
+		return nil, name_manager.ErrLeaseLost
+	}
+	return nameD, nil
 }
 
 // txGet, contrary to tx.Get, does not error when the document does not exist.
@@ -6,20 +6,36 @@ package firestore_backend
 import (
 	"errors"
 	"fmt"
+	"github.com/hchauvin/name_manager/pkg/name_manager"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type options struct {
-	projectID        string
-	prefix           string
+	projectID string
+	prefix    string
+	// autoReleaseAfter is the default TTL of the leases.
 	autoReleaseAfter time.Duration
+	// maxTTL is the maximum TTL of the leases, or zero for no maximum.
+	maxTTL       time.Duration
+	familyLimit  int
+	pollInterval time.Duration
+	// keepAlive overrides the default keep-alive policy, which is
+	// derived from autoReleaseAfter.
+	keepAlive name_manager.KeepAlivePolicy
 }
 
+// defaultPollInterval is the default interval between two acquisition
+// attempts when waiting for a name.
+const defaultPollInterval = 1 * time.Second
+
 func parseBackendURL(backendURL string) (*options, error) {
 	components := strings.Split(backendURL, ";")
 
-	opts := &options{}
+	opts := &options{
+		pollInterval: defaultPollInterval,
+	}
 	for _, s := range components {
 		components := strings.SplitN(s, "=", 2)
 		if len(components) != 2 {
@@ -41,8 +57,35 @@ func parseBackendURL(backendURL string) (*options, error) {
 				return nil, fmt.Errorf("cannot parse duration for autoReleaseAfter: %v", err)
 			}
 
+		case "maxTTL":
+			var err error
+			opts.maxTTL, err = time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse duration for maxTTL: %v", err)
+			}
+
+		case "familyLimit":
+			var err error
+			opts.familyLimit, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse integer for familyLimit: %v", err)
+			}
+
+		case "pollInterval":
+			var err error
+			opts.pollInterval, err = time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse duration for pollInterval: %v", err)
+			}
+
 		default:
-			return nil, fmt.Errorf("unrecognized option \"%s\"", key)
+			ok, err := opts.keepAlive.SetOption(key, value)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("unrecognized option \"%s\"", key)
+			}
 		}
 	}
 
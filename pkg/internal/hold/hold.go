@@ -5,87 +5,442 @@
 package hold
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/avast/retry-go"
 	"github.com/benbjohnson/clock"
 	"github.com/hchauvin/name_manager/pkg/name_manager"
-	"os"
+	"sync"
 	"time"
 )
 
 type Hold struct {
 	Manager name_manager.NameManager
 	// clock is the clock used to get the CreatedAt/UpdatedAt timestamps.
-	Clock             clock.Clock
-	KeepAliveInterval time.Duration
+	Clock clock.Clock
+	// KeepAlivePolicy is the keep-alive policy of the backend.  It can be
+	// overridden with name_manager.WithKeepAlivePolicy.  When the lease
+	// has a TTL, it is merged with the default policy for the TTL.
+	KeepAlivePolicy name_manager.KeepAlivePolicy
+	// DefaultTTL and MaxTTL are the default and maximum TTL of the
+	// leases (see name_manager.WithTTL).
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+	// Logger receives the log entries of the keep-alive.  If nil,
+	// name_manager.DefaultLogger is used.  It can be overridden with
+	// name_manager.WithLogger.
+	Logger name_manager.Logger
+	// PollInterval is the interval between two acquisition attempts
+	// in AcquireWait.
+	PollInterval time.Duration
 }
 
 func (h *Hold) Hold(family string) (string, <-chan error, name_manager.ReleaseFunc, error) {
-	name, err := h.Manager.Acquire(family)
+	holding, err := h.HoldContext(context.Background(), family)
 	if err != nil {
 		return "", nil, nil, err
 	}
+	return holding.Name, holding.Errors, holding.Release, nil
+}
 
-	errc, releaseFunc, err := h.holdCommon(family, name)
+func (h *Hold) HoldContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	lease, err := h.Manager.AcquireContext(ctx, family, opts...)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
+	}
+	options := name_manager.NewAcquireOptions(opts...)
+	if err := h.prepare(ctx, []name_manager.Lease{lease}, options); err != nil {
+		return nil, err
+	}
+	return h.holdCommon(ctx, lease, options), nil
+}
+
+func (h *Hold) HoldWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	lease, err := h.Manager.AcquireWait(ctx, family, opts...)
+	if err != nil {
+		return nil, err
+	}
+	options := name_manager.NewAcquireOptions(opts...)
+	if err := h.prepare(ctx, []name_manager.Lease{lease}, options); err != nil {
+		return nil, err
+	}
+	return h.holdCommon(ctx, lease, options), nil
+}
+
+// AcquireWait implements AcquireWait.  If the name cannot be acquired
+// right away, a ticket is taken in the queue of the family and polled
+// until a name is acquired.
+func (h *Hold) AcquireWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	lease, err := h.Manager.AcquireContext(ctx, family, opts...)
+	if err != name_manager.ErrFamilyFull && err != name_manager.ErrPoolExhausted {
+		return lease, err
+	}
+
+	ticket, err := h.Manager.Enqueue(ctx, family)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	for {
+		lease, _, err := h.Manager.PollTicket(ctx, family, ticket.ID, opts...)
+		if err == nil && lease.Name != "" {
+			return lease, nil
+		}
+		if err == nil {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-h.Clock.After(h.PollInterval):
+				continue
+			}
+		}
+
+		// The ticket is abandoned: it must not block the other waiters.
+		// The context might be done, so we cannot use it.
+		if err != name_manager.ErrTicketExpired {
+			h.Manager.CancelTicket(context.Background(), family, ticket.ID)
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return name_manager.Lease{}, ctxErr
+		}
+		return name_manager.Lease{}, err
 	}
-	return name, errc, releaseFunc, nil
 }
 
 func (h *Hold) TryHold(family, name string) (<-chan error, name_manager.ReleaseFunc, error) {
-	if err := h.Manager.TryAcquire(family, name); err != nil {
+	holding, err := h.TryHoldContext(context.Background(), family, name)
+	if err != nil {
 		return nil, nil, err
 	}
+	return holding.Errors, holding.Release, nil
+}
+
+func (h *Hold) TryHoldContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	lease, err := h.Manager.TryAcquireContext(ctx, family, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	options := name_manager.NewAcquireOptions(opts...)
+	if err := h.prepare(ctx, []name_manager.Lease{lease}, options); err != nil {
+		return nil, err
+	}
+	return h.holdCommon(ctx, lease, options), nil
+}
 
-	errc, releaseFunc, err := h.holdCommon(family, name)
+func (h *Hold) HoldMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) (*name_manager.Holdings, error) {
+	leases, err := h.Manager.AcquireMany(ctx, counts, opts...)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	options := name_manager.NewAcquireOptions(opts...)
+	if err := h.prepare(ctx, leases, options); err != nil {
+		return nil, err
+	}
+	return h.holdManyCommon(ctx, leases, options), nil
+}
+
+// prepare runs the OnCreate or OnAcquire hooks on acquired names before
+// they are handed out.  When a hook fails, all the names are released.
+func (h *Hold) prepare(ctx context.Context, leases []name_manager.Lease, options *name_manager.AcquireOptions) error {
+	if options.Hooks == nil {
+		return nil
+	}
+	for _, lease := range leases {
+		hook, fn := "onAcquire", options.Hooks.OnAcquire
+		if lease.Created {
+			hook, fn = "onCreate", options.Hooks.OnCreate
+		}
+		if err := name_manager.RunHook(ctx, h.Manager, hook, fn, lease); err != nil {
+			// The context might be done, so we cannot use it.
+			for _, lease := range leases {
+				h.Manager.ReleaseContext(context.Background(), lease)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// holdManyCommon holds names together: the errors of the keep-alive of
+// all the names are sent to the same channel, and all the names are
+// released at once.
+func (h *Hold) holdManyCommon(
+	ctx context.Context,
+	leases []name_manager.Lease,
+	options *name_manager.AcquireOptions,
+) *name_manager.Holdings {
+	errc := make(chan error, len(leases))
+	holdingsCtx, cancel := name_manager.WithCancelCause(ctx)
+	holdings := make([]*name_manager.Holding, len(leases))
+	var wg sync.WaitGroup
+	for i, lease := range leases {
+		// Each name keeps being kept alive, even when another one is not
+		// held anymore, until all the names are released.
+		holding := h.holdCommon(ctx, lease, options)
+		holdings[i] = holding
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for err := range holding.Errors {
+				cancel(err)
+				errc <- err
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(errc)
+	}()
+
+	releaseFunc := func() error {
+		var firstErr error
+		for _, holding := range holdings {
+			if err := holding.Release(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		cancel(nil)
+		return firstErr
+	}
+
+	return &name_manager.Holdings{
+		Leases:  leases,
+		Errors:  errc,
+		Context: holdingsCtx,
+		Release: releaseFunc,
 	}
-	return errc, releaseFunc, nil
 }
 
-func (h *Hold) holdCommon(family, name string) (<-chan error, name_manager.ReleaseFunc, error) {
+func (h *Hold) holdCommon(
+	ctx context.Context,
+	lease name_manager.Lease,
+	options *name_manager.AcquireOptions,
+) *name_manager.Holding {
 	errc := make(chan error, 1)
+	// holdingCtx is cancelled as soon as the name is not held anymore.
+	holdingCtx, cancel := name_manager.WithCancelCause(ctx)
+
+	policy := h.KeepAlivePolicy
+	if ttl := options.LeaseTTL(h.DefaultTTL, h.MaxTTL); ttl > 0 {
+		policy = policy.Merge(name_manager.DefaultKeepAlivePolicy(ttl))
+	}
+	if options.KeepAlivePolicy != nil {
+		policy = options.KeepAlivePolicy.Merge(policy)
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = h.Logger
+	}
+	if logger == nil {
+		logger = name_manager.DefaultLogger
+	}
+
+	// currentLease is the lease on the name, which changes when the name
+	// is reclaimed, and lost is true when the keep-alive gave up.
+	var mu sync.Mutex
+	currentLease := lease
+	lost := false
 
 	var stopKeepAlive, keepAliveDone chan struct{}
-	if h.KeepAliveInterval > 0 {
+	if policy.Interval > 0 {
 		stopKeepAlive = make(chan struct{})
 		keepAliveDone = make(chan struct{})
 		go func() {
 			defer close(keepAliveDone)
 
+			lease := lease
+			var err error
 			for {
-				select {
-				case <-stopKeepAlive:
-					return
-				case <-h.Clock.After(h.KeepAliveInterval):
+				err = h.keepAlive(ctx, lease, policy, logger, stopKeepAlive)
+				if err == nil || err == ctx.Err() || !options.Reclaim {
+					break
 				}
-
-				if err := retry.Do(func() error {
-					return h.Manager.KeepAlive(family, name)
-				}, retry.Delay(200*time.Millisecond), retry.Attempts(3)); err != nil {
-					msg := fmt.Sprintf("cannot keep alive %s:%s: %v\n", family, name, err)
-					fmt.Fprintf(os.Stderr, msg)
-					errc <- errors.New(msg)
-					return
+				reclaimed, reclaimErr := h.reclaim(ctx, lease, policy, logger, stopKeepAlive, options)
+				if reclaimErr != nil {
+					if reclaimErr == errStopped {
+						err = nil
+					}
+					break
+				}
+				mu.Lock()
+				currentLease = reclaimed
+				mu.Unlock()
+				reclaim := name_manager.Reclaim{
+					Lost:       lease,
+					Lease:      reclaimed,
+					Cause:      err,
+					Continuous: reclaimed.Token == lease.Token || reclaimed.Token == lease.Token+1,
 				}
+				logger.Log(name_manager.LogLevelWarn, "name reclaimed", map[string]interface{}{
+					"family":     reclaimed.Family,
+					"name":       reclaimed.Name,
+					"token":      reclaimed.Token,
+					"continuous": reclaim.Continuous,
+					"cause":      err,
+				})
+				if options.OnReclaim != nil {
+					options.OnReclaim(reclaim)
+				}
+				lease = reclaimed
+			}
+			if err == nil {
+				return
+			}
+			if err != ctx.Err() {
+				mu.Lock()
+				lost = true
+				mu.Unlock()
+				err = fmt.Errorf("cannot keep alive %s:%s: %w", lease.Family, lease.Name, err)
+				logger.Log(name_manager.LogLevelError, "keep-alive given up", map[string]interface{}{
+					"family": lease.Family,
+					"name":   lease.Name,
+					"token":  lease.Token,
+					"error":  err,
+				})
 			}
+			cancel(err)
+			errc <- err
 		}()
 	}
 
 	releaseFunc := func() error {
-		if h.KeepAliveInterval > 0 {
+		if policy.Interval > 0 {
 			close(stopKeepAlive)
 			<-keepAliveDone
 		}
 		close(errc)
-		if err := h.Manager.Release(family, name); err != nil {
+		cancel(nil)
+		mu.Lock()
+		lease, lost := currentLease, lost
+		mu.Unlock()
+		// The resource must not be cleaned on behalf of another holder.
+		var hookErr error
+		if options.Hooks != nil && !lost {
+			hookErr = name_manager.RunHook(
+				context.Background(), h.Manager, "onRelease", options.Hooks.OnRelease, lease)
+		}
+		if err := h.Manager.ReleaseContext(context.Background(), lease); err != nil {
 			return err
 		}
-		return nil
+		return hookErr
+	}
+
+	return &name_manager.Holding{
+		Lease:   lease,
+		Errors:  errc,
+		Context: holdingCtx,
+		Release: releaseFunc,
+	}
+}
+
+// keepAlive keeps a name alive until stop is closed, in which case it
+// returns nil, or until the keep-alive gives up.  It returns the error
+// of the context when the context is done.
+func (h *Hold) keepAlive(
+	ctx context.Context,
+	lease name_manager.Lease,
+	policy name_manager.KeepAlivePolicy,
+	logger name_manager.Logger,
+	stop <-chan struct{},
+) error {
+	lastKeepAlive := h.Clock.Now()
+	wait := policy.NextInterval()
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-h.Clock.After(wait):
+		}
+
+		err := h.Manager.KeepAliveContext(ctx, lease)
+		if err == nil {
+			lastKeepAlive = h.Clock.Now()
+			wait = policy.NextInterval()
+			failures = 0
+			continue
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err == name_manager.ErrLeaseLost || err == name_manager.ErrNotHeld {
+			// Retrying cannot get the lease back.
+			return err
+		}
+
+		failures++
+		fields := map[string]interface{}{
+			"family":   lease.Family,
+			"name":     lease.Name,
+			"token":    lease.Token,
+			"failures": failures,
+			"error":    err,
+		}
+		if failures >= policy.MaxFailures {
+			logger.Log(name_manager.LogLevelWarn, "keep-alive failed", fields)
+			return err
+		}
+		wait = policy.NextRetryDelay(failures)
+		if policy.Deadline > 0 {
+			if elapsed := h.Clock.Now().Sub(lastKeepAlive); elapsed+wait >= policy.Deadline {
+				// The name could be released on behalf of the holder
+				// before the next attempt.
+				logger.Log(name_manager.LogLevelWarn, "keep-alive failed", fields)
+				return fmt.Errorf("%w: no keep-alive for %v, and the deadline is %v: %v",
+					name_manager.ErrLeaseLost, elapsed, policy.Deadline, err)
+			}
+		}
+		fields["retryIn"] = wait
+		logger.Log(name_manager.LogLevelWarn, "keep-alive failed, retrying", fields)
 	}
+}
 
-	return errc, releaseFunc, nil
+// errStopped is returned by reclaim when the keep-alive is stopped.
+var errStopped = errors.New("keep-alive stopped")
+
+// reclaim acquires a name again after its keep-alive gave up.  It fails
+// if the name was acquired by someone else in the meantime, or if it
+// cannot be acquired after policy.MaxFailures attempts.  It fails with
+// errStopped if stop is closed.
+func (h *Hold) reclaim(
+	ctx context.Context,
+	lease name_manager.Lease,
+	policy name_manager.KeepAlivePolicy,
+	logger name_manager.Logger,
+	stop <-chan struct{},
+	options *name_manager.AcquireOptions,
+) (name_manager.Lease, error) {
+	for attempt := 1; ; attempt++ {
+		reclaimed, err := h.Manager.TryAcquireContext(ctx, lease.Family, lease.Name, name_manager.WithLabels(options.Labels))
+		if err == nil {
+			return reclaimed, nil
+		}
+		if err == name_manager.ErrInUse {
+			// The keep-alive may have given up while the lease was still
+			// valid, e.g., because of a network outage.
+			if h.Manager.KeepAliveContext(ctx, lease) == nil {
+				return lease, nil
+			}
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return name_manager.Lease{}, ctxErr
+		}
+		logger.Log(name_manager.LogLevelWarn, "cannot reclaim name", map[string]interface{}{
+			"family":  lease.Family,
+			"name":    lease.Name,
+			"attempt": attempt,
+			"error":   err,
+		})
+		if err == name_manager.ErrInUse || err == name_manager.ErrNotExist || attempt >= policy.MaxFailures {
+			return name_manager.Lease{}, err
+		}
+		select {
+		case <-stop:
+			return name_manager.Lease{}, errStopped
+		case <-ctx.Done():
+			return name_manager.Lease{}, ctx.Err()
+		case <-h.Clock.After(policy.NextRetryDelay(attempt)):
+		}
+	}
 }
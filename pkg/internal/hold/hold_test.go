@@ -4,19 +4,22 @@
 package hold
 
 import (
+	"context"
 	"errors"
 	"github.com/benbjohnson/clock"
 	"github.com/hchauvin/name_manager/pkg/name_manager"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestKeepAliveErrorOnHold(t *testing.T) {
 	hold := &Hold{
-		Manager:           &testNameManager{},
-		Clock:             clock.New(),
-		KeepAliveInterval: 1 * time.Millisecond,
+		Manager:         &testNameManager{},
+		Clock:           clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{Interval: 1 * time.Millisecond},
 	}
 
 	_, errc, releaseFunc, err := hold.Hold("foo")
@@ -38,9 +41,9 @@ func TestKeepAliveErrorOnHold(t *testing.T) {
 
 func TestKeepAliveErrorOnTryHold(t *testing.T) {
 	hold := &Hold{
-		Manager:           &testNameManager{},
-		Clock:             clock.New(),
-		KeepAliveInterval: 1 * time.Millisecond,
+		Manager:         &testNameManager{},
+		Clock:           clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{Interval: 1 * time.Millisecond},
 	}
 
 	errc, releaseFunc, err := hold.TryHold("foo", "bar")
@@ -60,17 +63,371 @@ func TestKeepAliveErrorOnTryHold(t *testing.T) {
 	}
 }
 
-type testNameManager struct{}
+func TestKeepAliveStopsWhenContextIsDone(t *testing.T) {
+	hold := &Hold{
+		Manager:         &testNameManager{},
+		Clock:           clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{Interval: 1 * time.Hour},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	holding, err := hold.HoldContext(ctx, "foo")
+	assert.NoError(t, err)
+
+	cancel()
+
+	select {
+	case err := <-holding.Errors:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "expected the keep-alive to stop")
+	}
+
+	err = holding.Release()
+	assert.NoError(t, err)
+}
+
+func TestKeepAliveIsNotRetriedWhenLeaseIsLost(t *testing.T) {
+	for _, keepAliveErr := range []error{name_manager.ErrLeaseLost, name_manager.ErrNotHeld} {
+		testKeepAliveIsNotRetried(t, keepAliveErr)
+	}
+}
+
+func testKeepAliveIsNotRetried(t *testing.T, keepAliveErr error) {
+	mng := &testNameManager{keepAliveErr: keepAliveErr}
+	hold := &Hold{
+		Manager: mng,
+		Clock:   clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{
+			Interval:    1 * time.Millisecond,
+			RetryDelay:  1 * time.Millisecond,
+			MaxFailures: 3,
+		},
+	}
+
+	holding, err := hold.HoldContext(context.Background(), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, name_manager.Lease{Family: "foo", Name: "foo", Token: 1, Created: true}, holding.Lease)
+
+	select {
+	case err := <-holding.Errors:
+		assert.True(t, errors.Is(err, keepAliveErr), "expected %v, got %v", keepAliveErr, err)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "expected a detached error")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mng.keepAliveCalls))
+
+	err = holding.Release()
+	assert.NoError(t, err)
+}
+
+func TestKeepAliveIsRetried(t *testing.T) {
+	mng := &testNameManager{keepAliveFailures: 2}
+	var retries int32
+	hold := &Hold{
+		Manager: mng,
+		Clock:   clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{
+			Interval:    1 * time.Millisecond,
+			RetryDelay:  1 * time.Millisecond,
+			MaxFailures: 3,
+		},
+		Logger: name_manager.LoggerFunc(func(level name_manager.LogLevel, msg string, fields map[string]interface{}) {
+			assert.Equal(t, name_manager.LogLevelWarn, level)
+			assert.Equal(t, "keep-alive failed, retrying", msg)
+			assert.Equal(t, "foo", fields["family"])
+			atomic.AddInt32(&retries, 1)
+		}),
+	}
+
+	holding, err := hold.HoldContext(context.Background(), "foo")
+	assert.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	err = holding.Release()
+	assert.NoError(t, err)
+
+	for err := range holding.Errors {
+		assert.Fail(t, "unexpected error", "%v", err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&retries))
+	assert.True(t, atomic.LoadInt32(&mng.keepAliveCalls) > 2)
+}
+
+func TestKeepAliveGivesUpBeforeDeadline(t *testing.T) {
+	mng := &testNameManager{}
+	hold := &Hold{
+		Manager:         mng,
+		Clock:           clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{Interval: 1 * time.Hour},
+		Logger:          name_manager.NewWriterLogger(ioutil.Discard, name_manager.LogLevelDebug),
+	}
+
+	// The policy of the backend is overridden.
+	holding, err := hold.HoldContext(context.Background(), "foo", name_manager.WithKeepAlivePolicy(
+		name_manager.KeepAlivePolicy{
+			Interval:    1 * time.Millisecond,
+			RetryDelay:  1 * time.Second,
+			MaxFailures: 10,
+			Deadline:    100 * time.Millisecond,
+		}))
+	assert.NoError(t, err)
+
+	select {
+	case err := <-holding.Errors:
+		assert.True(t, errors.Is(err, name_manager.ErrLeaseLost), "expected lease lost, got %v", err)
+		assert.Contains(t, err.Error(), "keep-alive error")
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "expected a detached error")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mng.keepAliveCalls))
+
+	err = holding.Release()
+	assert.NoError(t, err)
+}
+
+func TestKeepAliveFollowsTTL(t *testing.T) {
+	mng := &testNameManager{}
+	hold := &Hold{
+		Manager: mng,
+		Clock:   clock.New(),
+		MaxTTL:  30 * time.Millisecond,
+		Logger:  name_manager.NewWriterLogger(ioutil.Discard, name_manager.LogLevelDebug),
+	}
+
+	// The TTL is capped, and the keep-alive is derived from it.
+	holding, err := hold.HoldContext(context.Background(), "foo", name_manager.WithTTL(1*time.Hour))
+	assert.NoError(t, err)
+
+	select {
+	case err := <-holding.Errors:
+		assert.True(t, errors.Is(err, name_manager.ErrLeaseLost), "expected lease lost, got %v", err)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "expected a detached error")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mng.keepAliveCalls))
+
+	err = holding.Release()
+	assert.NoError(t, err)
+}
+
+func TestHooks(t *testing.T) {
+	mng := &testNameManager{}
+	hold := &Hold{
+		Manager: mng,
+		Clock:   clock.New(),
+	}
+
+	var calls []string
+	hook := func(name string, err error) name_manager.HookFunc {
+		return func(ctx context.Context, lease name_manager.Lease) error {
+			calls = append(calls, name+" "+lease.Name)
+			return err
+		}
+	}
+	hooks := name_manager.Hooks{
+		OnCreate:  hook("create", nil),
+		OnAcquire: hook("acquire", nil),
+		OnRelease: hook("release", nil),
+	}
+
+	// AcquireContext gives a brand-new name.
+	holding, err := hold.HoldContext(context.Background(), "foo", name_manager.WithHooks(hooks))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"create foo"}, calls)
+	err = holding.Release()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"create foo", "release foo"}, calls)
+
+	calls = nil
+	holding, err = hold.TryHoldContext(context.Background(), "foo", "bar", name_manager.WithHooks(hooks))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"acquire bar"}, calls)
+
+	// When a hook fails, the name is quarantined and released.
+	hooks.OnRelease = hook("release", errors.New("cannot clean"))
+	holding, err = hold.HoldContext(context.Background(), "foo", name_manager.WithHooks(hooks))
+	assert.NoError(t, err)
+	err = holding.Release()
+	var hookErr *name_manager.HookError
+	assert.True(t, errors.As(err, &hookErr), "expected hook error, got %v", err)
+	assert.Equal(t, "onRelease", hookErr.Hook)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&mng.releasedToken))
+	assert.Equal(t, "onRelease hook failed for foo:foo: cannot clean", mng.quarantine)
+
+	mng.releasedToken = 0
+	hooks.OnCreate = hook("create", errors.New("cannot provision"))
+	_, err = hold.HoldContext(context.Background(), "foo", name_manager.WithHooks(hooks))
+	assert.True(t, errors.As(err, &hookErr), "expected hook error, got %v", err)
+	assert.Equal(t, "onCreate", hookErr.Hook)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&mng.releasedToken))
+}
+
+func TestReclaim(t *testing.T) {
+	mng := &testNameManager{keepAliveErr: name_manager.ErrNotHeld, keepAliveFailures: 1}
+	hold := &Hold{
+		Manager:         mng,
+		Clock:           clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{Interval: 1 * time.Millisecond},
+		Logger:          name_manager.NewWriterLogger(ioutil.Discard, name_manager.LogLevelDebug),
+	}
+
+	reclaims := make(chan name_manager.Reclaim, 1)
+	holding, err := hold.HoldContext(context.Background(), "foo", name_manager.WithReclaim(func(reclaim name_manager.Reclaim) {
+		reclaims <- reclaim
+	}))
+	assert.NoError(t, err)
+
+	select {
+	case reclaim := <-reclaims:
+		assert.Equal(t, name_manager.Lease{Family: "foo", Name: "foo", Token: 1, Created: true}, reclaim.Lost)
+		assert.Equal(t, name_manager.Lease{Family: "foo", Name: "foo", Token: 2}, reclaim.Lease)
+		assert.True(t, errors.Is(reclaim.Cause, name_manager.ErrNotHeld))
+		assert.True(t, reclaim.Continuous)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "expected the name to be reclaimed")
+	}
+
+	// The keep-alive goes on with the new lease.
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, holding.Context.Err())
+
+	err = holding.Release()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&mng.releasedToken))
+}
+
+func TestContextIsCancelledWhenLeaseIsLost(t *testing.T) {
+	hold := &Hold{
+		Manager:         &testNameManager{keepAliveErr: name_manager.ErrLeaseLost},
+		Clock:           clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{Interval: 1 * time.Millisecond},
+	}
+
+	holding, err := hold.TryHoldContext(context.Background(), "foo", "bar")
+	assert.NoError(t, err)
+
+	select {
+	case <-holding.Context.Done():
+		cause := name_manager.Cause(holding.Context)
+		assert.True(t, errors.Is(cause, name_manager.ErrLeaseLost), "expected lease lost, got %v", cause)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "expected the context to be cancelled")
+	}
+
+	err = holding.Release()
+	assert.NoError(t, err)
+}
+
+func TestContextIsCancelledOnRelease(t *testing.T) {
+	hold := &Hold{
+		Manager:         &testNameManager{},
+		Clock:           clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{Interval: 1 * time.Hour},
+	}
+
+	holding, err := hold.HoldContext(context.Background(), "foo")
+	assert.NoError(t, err)
+	assert.NoError(t, holding.Context.Err())
+
+	err = holding.Release()
+	assert.NoError(t, err)
+	assert.Equal(t, context.Canceled, name_manager.Cause(holding.Context))
+}
+
+func TestKeepAliveErrorOnHoldMany(t *testing.T) {
+	hold := &Hold{
+		Manager:         &testNameManager{},
+		Clock:           clock.New(),
+		KeepAlivePolicy: name_manager.KeepAlivePolicy{Interval: 1 * time.Millisecond},
+	}
+
+	holdings, err := hold.HoldMany(context.Background(), map[string]int{"foo": 1, "bar": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []name_manager.Lease{
+		{Family: "bar", Name: "foo", Token: 1, Created: true},
+		{Family: "bar", Name: "foo", Token: 1, Created: true},
+		{Family: "foo", Name: "foo", Token: 1, Created: true},
+	}, holdings.Leases)
+
+	select {
+	case err := <-holdings.Errors:
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "keep-alive error")
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "expected a detached error")
+	}
+	<-holdings.Context.Done()
+	assert.Contains(t, name_manager.Cause(holdings.Context).Error(), "keep-alive error")
+
+	err = holdings.Release()
+	assert.NoError(t, err)
+
+	// The errors of all the names are received before the channel is
+	// closed.
+	count := 1
+	for range holdings.Errors {
+		count++
+	}
+	assert.Equal(t, 3, count)
+}
+
+type testNameManager struct {
+	// keepAliveErr is the error returned by KeepAliveContext.  When it
+	// is nil, an arbitrary error is returned.
+	keepAliveErr error
+	// keepAliveCalls is the number of calls to KeepAliveContext.
+	keepAliveCalls int32
+	// keepAliveFailures, if positive, is the number of calls to
+	// KeepAliveContext that fail before the others succeed.
+	keepAliveFailures int32
+	// tryAcquireCalls is the number of calls to TryAcquireContext.
+	tryAcquireCalls int32
+	// releasedToken is the token of the last lease that was released.
+	releasedToken int64
+	// attributes are the last attributes that were set.
+	attributes map[string]string
+	// quarantine is the reason for the last quarantine.
+	quarantine string
+}
 
 func (tnm *testNameManager) Hold(family string) (string, <-chan error, name_manager.ReleaseFunc, error) {
 	return "foo", nil, nil, nil
 }
 
+func (tnm *testNameManager) HoldContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return nil, nil
+}
+
 func (tnm *testNameManager) Acquire(family string) (string, error) {
 	return "foo", nil
 }
 
+func (tnm *testNameManager) AcquireContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	return name_manager.Lease{Family: family, Name: "foo", Token: 1, Created: true}, nil
+}
+
+func (tnm *testNameManager) AcquireWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	return tnm.AcquireContext(ctx, family)
+}
+
+func (tnm *testNameManager) HoldWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return nil, nil
+}
+
 func (tnm *testNameManager) KeepAlive(family, name string) error {
+	return tnm.KeepAliveContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
+
+func (tnm *testNameManager) KeepAliveContext(ctx context.Context, lease name_manager.Lease) error {
+	calls := atomic.AddInt32(&tnm.keepAliveCalls, 1)
+	if tnm.keepAliveFailures > 0 && calls > tnm.keepAliveFailures {
+		return nil
+	}
+	if tnm.keepAliveErr != nil {
+		return tnm.keepAliveErr
+	}
 	return errors.New("keep-alive error")
 }
 
@@ -78,18 +435,130 @@ func (tnm *testNameManager) Release(family, name string) error {
 	return nil
 }
 
+func (tnm *testNameManager) ReleaseContext(ctx context.Context, lease name_manager.Lease) error {
+	atomic.StoreInt64(&tnm.releasedToken, lease.Token)
+	return nil
+}
+
 func (tnm *testNameManager) TryAcquire(family, name string) error {
 	return nil
 }
 
+func (tnm *testNameManager) TryAcquireContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	// Names are acquired with the token 1 by AcquireContext.
+	token := 1 + atomic.AddInt32(&tnm.tryAcquireCalls, 1)
+	return name_manager.Lease{Family: family, Name: name, Token: int64(token)}, nil
+}
+
 func (tnm *testNameManager) TryHold(family, name string) (<-chan error, name_manager.ReleaseFunc, error) {
 	return nil, nil, nil
 }
 
+func (tnm *testNameManager) TryHoldContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return nil, nil
+}
+
 func (tnm *testNameManager) List() ([]name_manager.Name, error) {
 	return nil, nil
 }
 
+func (tnm *testNameManager) ListContext(ctx context.Context) ([]name_manager.Name, error) {
+	return tnm.List()
+}
+
 func (tnm *testNameManager) Reset() error {
 	return nil
 }
+
+func (tnm *testNameManager) ResetContext(ctx context.Context) error {
+	return tnm.Reset()
+}
+
+func (tnm *testNameManager) Reap(ctx context.Context, families ...string) ([]name_manager.Lease, error) {
+	return nil, nil
+}
+
+func (tnm *testNameManager) Delete(ctx context.Context, family, name string, opts ...name_manager.DeleteOption) error {
+	return nil
+}
+
+func (tnm *testNameManager) DeleteFamily(ctx context.Context, family string, opts ...name_manager.DeleteOption) error {
+	return nil
+}
+
+func (tnm *testNameManager) Enqueue(ctx context.Context, family string) (name_manager.Ticket, error) {
+	return name_manager.Ticket{}, nil
+}
+
+func (tnm *testNameManager) PollTicket(ctx context.Context, family, ticketID string, opts ...name_manager.AcquireOption) (name_manager.Lease, int, error) {
+	return name_manager.Lease{}, 0, nil
+}
+
+func (tnm *testNameManager) CancelTicket(ctx context.Context, family, ticketID string) error {
+	return nil
+}
+
+func (tnm *testNameManager) Queue(ctx context.Context, family string) ([]name_manager.Ticket, error) {
+	return nil, nil
+}
+
+func (tnm *testNameManager) SetFamilyLimit(ctx context.Context, family string, limit int) error {
+	return nil
+}
+
+func (tnm *testNameManager) GetAttributes(ctx context.Context, family, name string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (tnm *testNameManager) SetAttributes(ctx context.Context, family, name string, attributes map[string]string) error {
+	tnm.attributes = attributes
+	return nil
+}
+
+func (tnm *testNameManager) Quarantine(ctx context.Context, family, name, reason string) error {
+	tnm.quarantine = reason
+	return nil
+}
+
+func (tnm *testNameManager) Unquarantine(ctx context.Context, family, name string) error {
+	tnm.quarantine = ""
+	return nil
+}
+
+func (tnm *testNameManager) SetNameGenerator(ctx context.Context, family string, generator name_manager.NameGenerator) error {
+	return nil
+}
+
+func (tnm *testNameManager) DefinePool(ctx context.Context, family string, names []string) error {
+	return nil
+}
+
+func (tnm *testNameManager) AcquireMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) ([]name_manager.Lease, error) {
+	families, err := name_manager.SortedFamilies(counts)
+	if err != nil {
+		return nil, err
+	}
+	var leases []name_manager.Lease
+	for _, family := range families {
+		for i := 0; i < counts[family]; i++ {
+			lease, err := tnm.AcquireContext(ctx, family, opts...)
+			if err != nil {
+				return nil, err
+			}
+			leases = append(leases, lease)
+		}
+	}
+	return leases, nil
+}
+
+func (tnm *testNameManager) Transfer(ctx context.Context, lease name_manager.Lease) (name_manager.ClaimTicket, error) {
+	return name_manager.ClaimTicket{}, nil
+}
+
+func (tnm *testNameManager) Claim(ctx context.Context, ticket name_manager.ClaimTicket, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	return name_manager.Lease{}, nil
+}
+
+func (tnm *testNameManager) HoldMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) (*name_manager.Holdings, error) {
+	return nil, nil
+}
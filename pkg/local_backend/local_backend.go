@@ -5,10 +5,13 @@ package local_backend
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hchauvin/name_manager/pkg/internal/hold"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -68,8 +71,57 @@ type localBackendData struct {
 	// not changed when the name is released, only when it is acquired
 	// again or kept alive.  It is marshalled to the RFC3339 format.
 	UpdatedAt time.Time `json:"updatedAt"`
+	// Token is the token of the last lease on the name.
+	Token int64 `json:"token"`
+	// Fresh is true if the name was registered but never acquired, as
+	// the names of a pool are when the pool is defined.
+	Fresh bool `json:"fresh,omitempty"`
+	// Labels are the labels attached to the name by its last holder.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Attributes are the durable attributes of the name.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Quarantine is the reason why the name is quarantined, or "" if the
+	// name is not quarantined (see NameManager.Quarantine).
+	Quarantine string `json:"quarantine,omitempty"`
+	// Claim is the secret of the claim ticket of the lease, if the name
+	// is being transferred (see NameManager.Transfer).
+	Claim string `json:"claim,omitempty"`
+	// TTL is the time after which the name is automatically released if
+	// it is not kept alive, or zero if the default of the backend
+	// applies.  It is marshalled to nanoseconds.
+	TTL time.Duration `json:"ttl,omitempty"`
 }
 
+// localFamilyData contains the metadata associated to a family.
+type localFamilyData struct {
+	// Limit is the maximum number of names for the family, or zero
+	// if the backend-wide limit applies.
+	Limit int `json:"limit,omitempty"`
+	// Generator is the specification of the name generator of the
+	// family, or an empty string for the default generator.
+	Generator string `json:"generator,omitempty"`
+	// Recycled are the sorted indexes of the deleted names that are
+	// generated again before the counter of the family is incremented
+	// (see name_manager.WithRecycle).
+	Recycled []int `json:"recycled,omitempty"`
+	// Token is the highest token of the deleted names of the family.  The
+	// names that are registered afterwards start from this token, so that
+	// the tokens of a name that is deleted then registered again keep
+	// increasing.
+	Token int64 `json:"token,omitempty"`
+}
+
+// localTicketData contains the metadata associated to a waiter.
+type localTicketData struct {
+	// CreatedAt is the time at which the waiter was enqueued.
+	CreatedAt time.Time `json:"createdAt"`
+	// UpdatedAt is the time at which the ticket was last polled.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ticketIDLength is the length of the zero-padded ticket IDs in the DB keys.
+const ticketIDLength = 20
+
 // familyNameSep is the separator between the family and the name in the DB keys.
 const familyNameSep = ":"
 
@@ -92,6 +144,19 @@ var (
 	// names, and the values are itoa-formatted counters.
 	countersBucket = []byte("counters")
 
+	// familiesBucket is the name of the Bolt bucket that contains the
+	// metadata associated to a family.  In this bucket, there is at most
+	// one entry per family, the keys are the family names, and the values
+	// are json-marshalled `localFamilyData` objects.
+	familiesBucket = []byte("families")
+
+	// ticketsBucket is the name of the Bolt bucket that holds the queues
+	// of waiters.  In this bucket, there is one entry per waiter, the
+	// keys have the format `<family>:<zero-padded ticket ID>` and the
+	// values are json-marshalled `localTicketData` objects.  The ticket
+	// IDs are given by the sequence of the bucket.
+	ticketsBucket = []byte("tickets")
+
 	// freeValue is the placeholder that is used for the values in
 	// `freeNamesBucket`, as this bucket is only used for its keys and
 	// its values have no meaning at all.
@@ -102,53 +167,132 @@ func (lbk *localBackend) Hold(family string) (string, <-chan error, name_manager
 	return lbk.hold().Hold(family)
 }
 
+func (lbk *localBackend) HoldContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return lbk.hold().HoldContext(ctx, family, opts...)
+}
+
 func (lbk *localBackend) Acquire(family string) (string, error) {
-	db, err := lbk.openDB()
+	lease, err := lbk.AcquireContext(context.Background(), family)
 	if err != nil {
 		return "", err
 	}
+	return lease.Name, nil
+}
+
+func (lbk *localBackend) AcquireContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
 	defer db.Close()
 
-	name := ""
+	var lease name_manager.Lease
 	if err := db.Update(func(tx *bolt.Tx) error {
-		if autoReleaseAfter := lbk.options.autoReleaseAfter; autoReleaseAfter > 0 {
-			if err := releaseZombies(tx, lbk.clock, autoReleaseAfter, family); err != nil {
-				return err
-			}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := lbk.collectZombies(tx, family); err != nil {
+			return err
 		}
-		n, err := acquire(tx, lbk.clock, family)
+		l, err := acquire(tx, lbk.clock, family, lbk.options.familyLimit, lbk.acquireOptions(opts))
 		if err != nil {
 			return err
 		}
-		name = n
+		lease = l
 		return nil
 	}); err != nil {
-		return "", err
+		return name_manager.Lease{}, err
+	}
+	return lease, nil
+}
+
+func (lbk *localBackend) AcquireWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	return lbk.hold().AcquireWait(ctx, family, opts...)
+}
+
+func (lbk *localBackend) HoldWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return lbk.hold().HoldWait(ctx, family, opts...)
+}
+
+func (lbk *localBackend) AcquireMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) ([]name_manager.Lease, error) {
+	families, err := name_manager.SortedFamilies(counts)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	options := lbk.acquireOptions(opts)
+	var leases []name_manager.Lease
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// All the names are acquired in the same transaction: if one
+		// acquisition fails, the transaction is rolled back.
+		leases = nil
+		for _, family := range families {
+			if _, err := lbk.collectZombies(tx, family); err != nil {
+				return err
+			}
+			for i := 0; i < counts[family]; i++ {
+				lease, err := acquire(tx, lbk.clock, family, lbk.options.familyLimit, options)
+				if err != nil {
+					return err
+				}
+				leases = append(leases, lease)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	return name, nil
+	return leases, nil
+}
+
+func (lbk *localBackend) HoldMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) (*name_manager.Holdings, error) {
+	return lbk.hold().HoldMany(ctx, counts, opts...)
 }
 
 func (lbk *localBackend) KeepAlive(family, name string) error {
-	db, err := lbk.openDB()
+	return lbk.KeepAliveContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
+
+func (lbk *localBackend) KeepAliveContext(ctx context.Context, lease name_manager.Lease) error {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
 	return db.Update(func(tx *bolt.Tx) error {
-		return keepAlive(tx, lbk.clock, family, name)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return keepAlive(tx, lbk.clock, lease)
 	})
 }
 
 func (lbk *localBackend) Release(family, name string) error {
-	db, err := lbk.openDB()
+	return lbk.ReleaseContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
+
+func (lbk *localBackend) ReleaseContext(ctx context.Context, lease name_manager.Lease) error {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
 	return db.Update(func(tx *bolt.Tx) error {
-		return release(tx, family, name)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return release(tx, lease)
 	})
 }
 
@@ -156,20 +300,48 @@ func (lbk *localBackend) TryHold(family, name string) (<-chan error, name_manage
 	return lbk.hold().TryHold(family, name)
 }
 
+func (lbk *localBackend) TryHoldContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return lbk.hold().TryHoldContext(ctx, family, name, opts...)
+}
+
 func (lbk *localBackend) TryAcquire(family, name string) error {
-	db, err := lbk.openDB()
+	_, err := lbk.TryAcquireContext(context.Background(), family, name)
+	return err
+}
+
+func (lbk *localBackend) TryAcquireContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
-		return err
+		return name_manager.Lease{}, err
 	}
 	defer db.Close()
 
-	return db.Update(func(tx *bolt.Tx) error {
-		return tryAcquire(tx, lbk.clock, family, name)
-	})
+	var lease name_manager.Lease
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := lbk.collectZombies(tx, family); err != nil {
+			return err
+		}
+		l, err := tryAcquire(tx, lbk.clock, family, name, lbk.acquireOptions(opts))
+		if err != nil {
+			return err
+		}
+		lease = l
+		return nil
+	}); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return lease, nil
 }
 
 func (lbk *localBackend) List() ([]name_manager.Name, error) {
-	db, err := lbk.openDB()
+	return lbk.ListContext(context.Background())
+}
+
+func (lbk *localBackend) ListContext(ctx context.Context) ([]name_manager.Name, error) {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -190,6 +362,13 @@ func (lbk *localBackend) List() ([]name_manager.Name, error) {
 }
 
 func (lbk *localBackend) Reset() error {
+	return lbk.ResetContext(context.Background())
+}
+
+func (lbk *localBackend) ResetContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	err := os.Remove(lbk.path)
 	if err != nil {
 		if pathError, ok := err.(*os.PathError); ok {
@@ -201,186 +380,1211 @@ func (lbk *localBackend) Reset() error {
 	return err
 }
 
-// openDB opens the Bolt DB associated with this local backend.
-func (lbk *localBackend) openDB() (*bolt.DB, error) {
-	return bolt.Open(lbk.path, 0666, nil)
-}
-
-// acquire implements name acquisition inside a Bolt transaction.
-func acquire(tx *bolt.Tx, clk clock.Clock, family string) (string, error) {
-	nameBytes, err := getAnyFreeName(tx, family)
+func (lbk *localBackend) Reap(ctx context.Context, families ...string) ([]name_manager.Lease, error) {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var name string
-	var data *localBackendData
-	now := clk.Now().UTC()
-	if nameBytes != nil {
-		name = string(nameBytes)
-		data, err = getData(tx, family, name)
-		if err != nil {
-			return "", err
-		}
-		if data == nil {
-			return "", fmt.Errorf("inconsistent database")
-		}
-		if err = removeFreeName(tx, family, name); err != nil {
-			return "", err
+	defer db.Close()
+
+	var released []name_manager.Lease
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-	} else {
-		counter, err := getAndIncrementCounter(tx, family)
-		if err != nil {
-			return "", err
+		released = nil
+		reaped := families
+		if len(reaped) == 0 {
+			reaped = listFamilies(tx)
+		} else {
+			reaped = append([]string(nil), families...)
+			sort.Strings(reaped)
 		}
-		name = strconv.Itoa(counter)
-		nameBytes = []byte(name)
-		data = &localBackendData{
-			CreatedAt: now,
+		for _, family := range reaped {
+			leases, err := lbk.collectZombies(tx, family)
+			if err != nil {
+				return err
+			}
+			released = append(released, leases...)
 		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	data.UpdatedAt = now
-	if err = setData(tx, family, name, data); err != nil {
-		return "", err
-	}
-	return name, nil
+	return released, nil
 }
 
-// keepAlive implements keep alive inside a Bolt transaction.
-func keepAlive(tx *bolt.Tx, clk clock.Clock, family, name string) error {
-	if isNameFree(tx, family, name) {
-		return nil
-	}
-	// We only keep alive if the name has some data associated to it.
-	data, err := getData(tx, family, name)
+func (lbk *localBackend) Delete(ctx context.Context, family, name string, opts ...name_manager.DeleteOption) error {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
 		return err
 	}
-	if data == nil {
-		return nil
-	}
-	data.UpdatedAt = clk.Now().UTC()
-	if err = setData(tx, family, name, data); err != nil {
+	defer db.Close()
+
+	options := name_manager.NewDeleteOptions(opts...)
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return deleteName(tx, family, name, options)
+	})
+}
+
+func (lbk *localBackend) DeleteFamily(ctx context.Context, family string, opts ...name_manager.DeleteOption) error {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer db.Close()
+
+	options := name_manager.NewDeleteOptions(opts...)
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return deleteFamily(tx, family, options)
+	})
 }
 
-// release implements name release inside a Bolt transaction.
-func release(tx *bolt.Tx, family, name string) error {
-	if isNameFree(tx, family, name) {
-		return nil
-	}
-	// We only add a free name if the name has some data associated to
-	// it.
-	dat, err := getData(tx, family, name)
+func (lbk *localBackend) Enqueue(ctx context.Context, family string) (name_manager.Ticket, error) {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
-		return err
+		return name_manager.Ticket{}, err
 	}
-	if dat == nil {
+	defer db.Close()
+
+	var ticket *name_manager.Ticket
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := lbk.collectZombies(tx, family); err != nil {
+			return err
+		}
+		t, err := enqueue(tx, lbk.clock, family)
+		if err != nil {
+			return err
+		}
+		ticket = t
 		return nil
+	}); err != nil {
+		return name_manager.Ticket{}, err
 	}
-	return addFreeName(tx, family, name)
+	return *ticket, nil
 }
 
-// tryAcquire implements name acquisition inside a Bolt transaction.
-func tryAcquire(tx *bolt.Tx, clk clock.Clock, family, name string) error {
-	if !isNameFree(tx, family, name) {
-		return name_manager.ErrInUse
-	}
-
-	var data *localBackendData
-	now := clk.Now().UTC()
-	data, err := getData(tx, family, name)
+func (lbk *localBackend) PollTicket(ctx context.Context, family, ticketID string, opts ...name_manager.AcquireOption) (name_manager.Lease, int, error) {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
-		return err
+		return name_manager.Lease{}, 0, err
 	}
-	if data == nil {
-		return name_manager.ErrNotExist
-	}
-	if err = removeFreeName(tx, family, name); err != nil {
-		return err
+	defer db.Close()
+
+	var lease name_manager.Lease
+	position := 0
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := lbk.collectZombies(tx, family); err != nil {
+			return err
+		}
+		l, p, err := pollTicket(tx, lbk.clock, family, ticketID, lbk.options.familyLimit, lbk.acquireOptions(opts))
+		if err != nil {
+			return err
+		}
+		lease = l
+		position = p
+		return nil
+	}); err == errNotServed {
+		// The acquisition was rolled back: the ticket is only kept alive.
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return touchTicket(tx, lbk.clock, family, ticketID)
+		}); err != nil {
+			return name_manager.Lease{}, 0, err
+		}
+	} else if err != nil {
+		return name_manager.Lease{}, 0, err
 	}
-	data.UpdatedAt = now
-	if err = setData(tx, family, name, data); err != nil {
+	return lease, position, nil
+}
+
+func (lbk *localBackend) CancelTicket(ctx context.Context, family, ticketID string) error {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
 		return err
 	}
-	return nil
-}
+	defer db.Close()
 
-// list implements name listing inside a Bolt transaction.
-func list(tx *bolt.Tx) ([]name_manager.Name, error) {
-	var names []name_manager.Name
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return cancelTicket(tx, family, ticketID)
+	})
+}
 
-	b := tx.Bucket(dataBucket)
-	if b == nil {
-		return nil, nil
+func (lbk *localBackend) Queue(ctx context.Context, family string) ([]name_manager.Ticket, error) {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return nil, err
 	}
-	c := b.Cursor()
-	for k, v := c.First(); k != nil; k, v = c.Next() {
-		family, name := keyToFamilyName(k)
-		data := localBackendData{}
-		if err := json.Unmarshal(v, &data); err != nil {
-			return nil, err
+	defer db.Close()
+
+	var tickets []name_manager.Ticket
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		free := isNameFree(tx, family, name)
-		var updatedAt time.Time
-		if !free {
-			updatedAt = data.UpdatedAt
+		if _, err := lbk.collectZombies(tx, family); err != nil {
+			return err
 		}
-		names = append(names, name_manager.Name{
-			Name:      name,
-			Family:    family,
-			CreatedAt: data.CreatedAt,
-			UpdatedAt: updatedAt,
-			Free:      free,
-		})
+		t, err := queue(tx, family)
+		if err != nil {
+			return err
+		}
+		tickets = t
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-
-	return names, nil
+	return tickets, nil
 }
 
-func releaseZombies(tx *bolt.Tx, clk clock.Clock, autoReleaseAfter time.Duration, family string) error {
-	b, err := tx.CreateBucketIfNotExists(dataBucket)
+func (lbk *localBackend) SetFamilyLimit(ctx context.Context, family string, limit int) error {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
 		return err
 	}
-	now := clk.Now()
-	prefix := []byte(family + familyNameSep)
-	c := b.Cursor()
-	for k, v := c.Seek(prefix); k != nil; k, v = c.Next() {
-		if !bytes.HasPrefix(k, prefix) {
-			break
-		}
-		data := &localBackendData{}
-		if err := json.Unmarshal(v, data); err != nil {
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if now.Sub(data.UpdatedAt) > autoReleaseAfter {
-			_, name := keyToFamilyName(k)
-			if err := release(tx, family, name); err != nil {
-				return err
-			}
+		data, err := getFamilyData(tx, family)
+		if err != nil {
+			return err
 		}
-	}
-	return nil
+		data.Limit = limit
+		return setFamilyData(tx, family, data)
+	})
 }
 
-// getAnyFreeName returns any free name for the given family, or `nil`
-// if there is no such name, in which case a new name must be generated.
-func getAnyFreeName(tx *bolt.Tx, family string) ([]byte, error) {
-	b, err := tx.CreateBucketIfNotExists(freeNamesBucket)
+func (lbk *localBackend) GetAttributes(ctx context.Context, family, name string) (map[string]string, error) {
+	db, err := lbk.openDB(ctx)
 	if err != nil {
 		return nil, err
 	}
-	prefix := []byte(family + familyNameSep)
+	defer db.Close()
+
+	var attributes map[string]string
+	if err := db.View(func(tx *bolt.Tx) error {
+		data, err := getData(tx, family, name)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return name_manager.ErrNotExist
+		}
+		attributes = data.Attributes
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+func (lbk *localBackend) SetAttributes(ctx context.Context, family, name string, attributes map[string]string) error {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return setAttributes(tx, family, name, attributes)
+	})
+}
+
+func (lbk *localBackend) Quarantine(ctx context.Context, family, name, reason string) error {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return quarantine(tx, family, name, name_manager.QuarantineReason(reason))
+	})
+}
+
+func (lbk *localBackend) Unquarantine(ctx context.Context, family, name string) error {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return quarantine(tx, family, name, "")
+	})
+}
+
+func (lbk *localBackend) Transfer(ctx context.Context, lease name_manager.Lease) (name_manager.ClaimTicket, error) {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	defer db.Close()
+
+	var ticket name_manager.ClaimTicket
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t, err := transfer(tx, lbk.clock, lease)
+		if err != nil {
+			return err
+		}
+		ticket = t
+		return nil
+	}); err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	return ticket, nil
+}
+
+func (lbk *localBackend) Claim(ctx context.Context, ticket name_manager.ClaimTicket, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	defer db.Close()
+
+	var lease name_manager.Lease
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l, err := claim(tx, lbk.clock, ticket, lbk.acquireOptions(opts))
+		if err != nil {
+			return err
+		}
+		lease = l
+		return nil
+	}); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return lease, nil
+}
+
+func (lbk *localBackend) SetNameGenerator(ctx context.Context, family string, generator name_manager.NameGenerator) error {
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := getFamilyData(tx, family)
+		if err != nil {
+			return err
+		}
+		data.Generator = generator.Spec()
+		return setFamilyData(tx, family, data)
+	})
+}
+
+func (lbk *localBackend) DefinePool(ctx context.Context, family string, names []string) error {
+	pool, err := name_manager.NewPoolGenerator(names)
+	if err != nil {
+		return err
+	}
+
+	db, err := lbk.openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return definePool(tx, lbk.clock, family, pool)
+	})
+}
+
+// collectZombies releases the names of a family that were not kept alive,
+// and expires the tickets of the family that were not polled, inside a
+// Bolt transaction.  It returns the leases that were released.
+func (lbk *localBackend) collectZombies(tx *bolt.Tx, family string) ([]name_manager.Lease, error) {
+	// The leases can have their own TTL even when there is no default.
+	released, err := releaseZombies(tx, lbk.clock, lbk.options.autoReleaseAfter, family)
+	if err != nil {
+		return nil, err
+	}
+	autoReleaseAfter := lbk.options.autoReleaseAfter
+	if autoReleaseAfter <= 0 {
+		return released, nil
+	}
+	return released, expireTickets(tx, lbk.clock, autoReleaseAfter, family)
+}
+
+// acquireOptions applies acquisition options, and resolves the TTL of
+// the lease.
+func (lbk *localBackend) acquireOptions(opts []name_manager.AcquireOption) *name_manager.AcquireOptions {
+	options := name_manager.NewAcquireOptions(opts...)
+	options.TTL = options.LeaseTTL(lbk.options.autoReleaseAfter, lbk.options.maxTTL)
+	return options
+}
+
+// openDB opens the Bolt DB associated with this local backend.  The
+// Bolt DB is protected by a file lock: when the context has a deadline,
+// we stop waiting for the lock when the deadline is exceeded.
+func (lbk *localBackend) openDB(ctx context.Context) (*bolt.DB, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	options := *bolt.DefaultOptions
+	if deadline, ok := ctx.Deadline(); ok {
+		options.Timeout = time.Until(deadline)
+		if options.Timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	db, err := bolt.Open(lbk.path, 0666, &options)
+	if err == bolt.ErrTimeout && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return db, err
+}
+
+// acquire implements name acquisition inside a Bolt transaction.
+// defaultLimit is the family limit to use when no limit was set
+// specifically for the family.
+func acquire(
+	tx *bolt.Tx,
+	clk clock.Clock,
+	family string,
+	defaultLimit int,
+	options *name_manager.AcquireOptions,
+) (name_manager.Lease, error) {
+	limit, err := getFamilyLimit(tx, family, defaultLimit)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	// The free names are reserved for the waiters: a family at capacity
+	// is full, and only new names can be acquired in the other families.
+	waiting, err := hasTickets(tx, family)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	if waiting && limit > 0 {
+		return name_manager.Lease{}, name_manager.ErrFamilyFull
+	}
+	return acquireName(tx, clk, family, limit, options, waiting)
+}
+
+// acquireName acquires a name, regardless of the waiters in the queue
+// of the family, inside a Bolt transaction.  If newName is true, the
+// free names are skipped, and a new name is created.
+func acquireName(
+	tx *bolt.Tx,
+	clk clock.Clock,
+	family string,
+	limit int,
+	options *name_manager.AcquireOptions,
+	newName bool,
+) (name_manager.Lease, error) {
+	var nameBytes []byte
+	var err error
+	if !newName {
+		nameBytes, err = getAnyFreeName(tx, family, options)
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+	}
+	if nameBytes == nil && !options.CanCreateName() {
+		// The acquisition can wait for the matching names that are in
+		// use to be released.
+		matching, err := hasMatchingName(tx, family, options.Selector)
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+		if matching {
+			return name_manager.Lease{}, name_manager.ErrFamilyFull
+		}
+		return name_manager.Lease{}, name_manager.ErrNoMatchingName
+	}
+	var name string
+	var data *localBackendData
+	now := clk.Now().UTC()
+	if nameBytes != nil {
+		name = string(nameBytes)
+		data, err = getData(tx, family, name)
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+		if data == nil {
+			return name_manager.Lease{}, fmt.Errorf("inconsistent database")
+		}
+		if err = removeFreeName(tx, family, name); err != nil {
+			return name_manager.Lease{}, err
+		}
+	} else {
+		if limit > 0 {
+			count, err := countNames(tx, family)
+			if err != nil {
+				return name_manager.Lease{}, err
+			}
+			if count >= limit {
+				return name_manager.Lease{}, name_manager.ErrFamilyFull
+			}
+		}
+		name, err = generateName(tx, family)
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+		nameBytes = []byte(name)
+		familyData, err := getFamilyData(tx, family)
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+		data = &localBackendData{
+			CreatedAt: now,
+			Token:     familyData.Token,
+			Fresh:     true,
+		}
+	}
+	created := data.Fresh
+	data.UpdatedAt = now
+	data.Token++
+	data.Fresh = false
+	data.Labels = options.Labels
+	data.Claim = ""
+	data.TTL = options.TTL
+	if err = setData(tx, family, name, data); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return name_manager.Lease{Family: family, Name: name, Token: data.Token, Created: created}, nil
+}
+
+// keepAlive implements keep alive inside a Bolt transaction.
+func keepAlive(tx *bolt.Tx, clk clock.Clock, lease name_manager.Lease) error {
+	// We only keep alive if the name is in use.
+	if isNameFree(tx, lease.Family, lease.Name) {
+		return name_manager.ErrNotHeld
+	}
+	data, err := getLeasedData(tx, lease)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return name_manager.ErrNotHeld
+	}
+	data.UpdatedAt = clk.Now().UTC()
+	if err = setData(tx, lease.Family, lease.Name, data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// release implements name release inside a Bolt transaction.
+func release(tx *bolt.Tx, lease name_manager.Lease) error {
+	// We only add a free name if the name is in use.
+	data, err := getLeasedData(tx, lease)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+	return addFreeName(tx, lease.Family, lease.Name)
+}
+
+// getLeasedData returns the metadata for a name in use, or `nil` if the
+// name is free or could not be found.  If the lease has a token, it fails
+// with ErrLeaseLost when the lease is not the current lease on the name.
+func getLeasedData(tx *bolt.Tx, lease name_manager.Lease) (*localBackendData, error) {
+	var data *localBackendData
+	if !isNameFree(tx, lease.Family, lease.Name) {
+		d, err := getData(tx, lease.Family, lease.Name)
+		if err != nil {
+			return nil, err
+		}
+		data = d
+	}
+	if lease.Token != 0 && (data == nil || data.Token != lease.Token) {
+		return nil, name_manager.ErrLeaseLost
+	}
+	return data, nil
+}
+
+// tryAcquire implements name acquisition inside a Bolt transaction.
+func tryAcquire(
+	tx *bolt.Tx,
+	clk clock.Clock,
+	family, name string,
+	options *name_manager.AcquireOptions,
+) (name_manager.Lease, error) {
+	if !isNameFree(tx, family, name) {
+		return name_manager.Lease{}, name_manager.ErrInUse
+	}
+
+	var data *localBackendData
+	now := clk.Now().UTC()
+	data, err := getData(tx, family, name)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	if data == nil {
+		return name_manager.Lease{}, name_manager.ErrNotExist
+	}
+	if err = removeFreeName(tx, family, name); err != nil {
+		return name_manager.Lease{}, err
+	}
+	created := data.Fresh
+	data.UpdatedAt = now
+	data.Token++
+	data.Fresh = false
+	data.Labels = options.Labels
+	data.Claim = ""
+	data.TTL = options.TTL
+	if err = setData(tx, family, name, data); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return name_manager.Lease{Family: family, Name: name, Token: data.Token, Created: created}, nil
+}
+
+// transfer implements the preparation of a hand-off inside a Bolt
+// transaction.
+func transfer(tx *bolt.Tx, clk clock.Clock, lease name_manager.Lease) (name_manager.ClaimTicket, error) {
+	if isNameFree(tx, lease.Family, lease.Name) {
+		return name_manager.ClaimTicket{}, name_manager.ErrNotHeld
+	}
+	data, err := getLeasedData(tx, lease)
+	if err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	if data == nil {
+		return name_manager.ClaimTicket{}, name_manager.ErrNotHeld
+	}
+	ticket, err := name_manager.NewClaimTicket(name_manager.Lease{
+		Family: lease.Family,
+		Name:   lease.Name,
+		Token:  data.Token,
+	})
+	if err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	data.UpdatedAt = clk.Now().UTC()
+	data.Claim = ticket.Secret
+	if err := setData(tx, lease.Family, lease.Name, data); err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	return ticket, nil
+}
+
+// claim implements the redemption of a claim ticket inside a Bolt
+// transaction.
+func claim(
+	tx *bolt.Tx,
+	clk clock.Clock,
+	ticket name_manager.ClaimTicket,
+	options *name_manager.AcquireOptions,
+) (name_manager.Lease, error) {
+	if isNameFree(tx, ticket.Family, ticket.Name) {
+		return name_manager.Lease{}, name_manager.ErrInvalidClaim
+	}
+	data, err := getData(tx, ticket.Family, ticket.Name)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	if data == nil || data.Token != ticket.Token || data.Claim == "" || data.Claim != ticket.Secret {
+		return name_manager.Lease{}, name_manager.ErrInvalidClaim
+	}
+	data.UpdatedAt = clk.Now().UTC()
+	data.Token++
+	data.Labels = options.Labels
+	data.Claim = ""
+	data.TTL = options.TTL
+	if err := setData(tx, ticket.Family, ticket.Name, data); err != nil {
+		return name_manager.Lease{}, err
+	}
+	return name_manager.Lease{Family: ticket.Family, Name: ticket.Name, Token: data.Token}, nil
+}
+
+// list implements name listing inside a Bolt transaction.
+func list(tx *bolt.Tx) ([]name_manager.Name, error) {
+	var names []name_manager.Name
+
+	b := tx.Bucket(dataBucket)
+	if b == nil {
+		return nil, nil
+	}
+	generators := make(map[string]string)
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		family, name := keyToFamilyName(k)
+		generator, ok := generators[family]
+		if !ok {
+			familyData, err := getFamilyData(tx, family)
+			if err != nil {
+				return nil, err
+			}
+			generator = familyData.Generator
+			generators[family] = generator
+		}
+		data := localBackendData{}
+		if err := json.Unmarshal(v, &data); err != nil {
+			return nil, err
+		}
+		free := isNameFree(tx, family, name)
+		var updatedAt time.Time
+		var labels map[string]string
+		if !free {
+			updatedAt = data.UpdatedAt
+			labels = data.Labels
+		}
+		names = append(names, name_manager.Name{
+			Name:       name,
+			Family:     family,
+			CreatedAt:  data.CreatedAt,
+			UpdatedAt:  updatedAt,
+			Free:       free,
+			Quarantine: data.Quarantine,
+			Token:      data.Token,
+			Labels:     labels,
+			Attributes: data.Attributes,
+			Pool:       name_manager.IsPoolMember(generator, name),
+		})
+	}
+
+	return names, nil
+}
+
+// definePool implements the definition of a pool inside a Bolt
+// transaction.
+func definePool(tx *bolt.Tx, clk clock.Clock, family string, pool *name_manager.PoolGenerator) error {
+	b, err := tx.CreateBucketIfNotExists(dataBucket)
+	if err != nil {
+		return err
+	}
+	prefix := []byte(family + familyNameSep)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		_, name := keyToFamilyName(k)
+		if !pool.Contains(name) {
+			return fmt.Errorf("name '%s' of family '%s' is not in the pool", name, family)
+		}
+	}
+
+	familyData, err := getFamilyData(tx, family)
+	if err != nil {
+		return err
+	}
+	now := clk.Now().UTC()
+	for _, name := range pool.Names {
+		data, err := getData(tx, family, name)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			continue
+		}
+		data = &localBackendData{CreatedAt: now, UpdatedAt: now, Token: familyData.Token, Fresh: true}
+		if err := setData(tx, family, name, data); err != nil {
+			return err
+		}
+		if err := addFreeName(tx, family, name); err != nil {
+			return err
+		}
+	}
+
+	// All the names of the pool are registered: the generator must not
+	// generate any new name.
+	counters, err := tx.CreateBucketIfNotExists(countersBucket)
+	if err != nil {
+		return err
+	}
+	if err := counters.Put([]byte(family), []byte(strconv.Itoa(len(pool.Names)))); err != nil {
+		return err
+	}
+
+	familyData.Generator = pool.Spec()
+	return setFamilyData(tx, family, familyData)
+}
+
+// setAttributes implements attribute update inside a Bolt transaction.
+func setAttributes(tx *bolt.Tx, family, name string, attributes map[string]string) error {
+	data, err := getData(tx, family, name)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return name_manager.ErrNotExist
+	}
+	for key, value := range attributes {
+		if value == "" {
+			delete(data.Attributes, key)
+			continue
+		}
+		if data.Attributes == nil {
+			data.Attributes = make(map[string]string)
+		}
+		data.Attributes[key] = value
+	}
+	return setData(tx, family, name, data)
+}
+
+// quarantine implements the quarantine of a name inside a Bolt
+// transaction.  An empty reason puts the name back in rotation.
+func quarantine(tx *bolt.Tx, family, name, reason string) error {
+	data, err := getData(tx, family, name)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return name_manager.ErrNotExist
+	}
+	data.Quarantine = reason
+	return setData(tx, family, name, data)
+}
+
+// releaseZombies releases the names of a family that were not kept alive
+// during their TTL, inside a Bolt transaction.  autoReleaseAfter is the
+// TTL of the names that were acquired without one.  It returns the leases
+// that were released.
+func releaseZombies(tx *bolt.Tx, clk clock.Clock, autoReleaseAfter time.Duration, family string) ([]name_manager.Lease, error) {
+	b, err := tx.CreateBucketIfNotExists(dataBucket)
+	if err != nil {
+		return nil, err
+	}
+	now := clk.Now()
+	prefix := []byte(family + familyNameSep)
+	var released []name_manager.Lease
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil; k, v = c.Next() {
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		_, name := keyToFamilyName(k)
+		if isNameFree(tx, family, name) {
+			continue
+		}
+		data := &localBackendData{}
+		if err := json.Unmarshal(v, data); err != nil {
+			return nil, err
+		}
+		ttl := data.TTL
+		if ttl <= 0 {
+			ttl = autoReleaseAfter
+		}
+		// The names that are being transferred wait for their claim.
+		if ttl > 0 && now.Sub(data.UpdatedAt) > ttl && data.Claim == "" {
+			lease := name_manager.Lease{Family: family, Name: name, Token: data.Token}
+			if err := release(tx, lease); err != nil {
+				return nil, err
+			}
+			released = append(released, lease)
+		}
+	}
+	return released, nil
+}
+
+// listFamilies lists the families with names or waiters, inside a Bolt
+// transaction.
+func listFamilies(tx *bolt.Tx) []string {
+	seen := make(map[string]bool)
+	var families []string
+	add := func(family string) {
+		if !seen[family] {
+			seen[family] = true
+			families = append(families, family)
+		}
+	}
+	if b := tx.Bucket(countersBucket); b != nil {
+		b.ForEach(func(k, _ []byte) error {
+			add(string(k))
+			return nil
+		})
+	}
+	if b := tx.Bucket(ticketsBucket); b != nil {
+		b.ForEach(func(k, _ []byte) error {
+			add(strings.SplitN(string(k), familyNameSep, 2)[0])
+			return nil
+		})
+	}
+	sort.Strings(families)
+	return families
+}
+
+// deleteName implements the deletion of a name inside a Bolt
+// transaction.
+func deleteName(tx *bolt.Tx, family, name string, options *name_manager.DeleteOptions) error {
+	data, err := getData(tx, family, name)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return name_manager.ErrNotExist
+	}
+	if !isNameFree(tx, family, name) {
+		if !options.Force {
+			return name_manager.ErrInUse
+		}
+	} else if err := removeFreeName(tx, family, name); err != nil {
+		return err
+	}
+	if err := tx.Bucket(dataBucket).Delete(familyNameToKey(family, name)); err != nil {
+		return err
+	}
+	familyData, err := getFamilyData(tx, family)
+	if err != nil {
+		return err
+	}
+	if data.Token > familyData.Token {
+		familyData.Token = data.Token
+	}
+	if !options.Recycle {
+		return setFamilyData(tx, family, familyData)
+	}
+	generator, err := name_manager.ParseNameGenerator(familyData.Generator)
+	if err != nil {
+		return err
+	}
+	counter, err := getCounter(tx, family)
+	if err != nil {
+		return err
+	}
+	n := name_manager.NameIndex(generator, name, counter)
+	if n < 0 {
+		return setFamilyData(tx, family, familyData)
+	}
+	familyData.Recycled = name_manager.InsertIndex(familyData.Recycled, n)
+	return setFamilyData(tx, family, familyData)
+}
+
+// deleteFamily implements the deletion of a family inside a Bolt
+// transaction.
+func deleteFamily(tx *bolt.Tx, family string, options *name_manager.DeleteOptions) error {
+	prefix := []byte(family + familyNameSep)
+	if b := tx.Bucket(dataBucket); b != nil && !options.Force {
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if !isNameFree(tx, family, string(k[len(prefix):])) {
+				return name_manager.ErrInUse
+			}
+		}
+	}
+	for _, bucket := range [][]byte{dataBucket, freeNamesBucket, ticketsBucket} {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			continue
+		}
+		// The cursor is repositioned after each deletion.
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	for _, bucket := range [][]byte{countersBucket, familiesBucket} {
+		if b := tx.Bucket(bucket); b != nil {
+			if err := b.Delete([]byte(family)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enqueue implements the registration of a waiter inside a Bolt
+// transaction.
+func enqueue(tx *bolt.Tx, clk clock.Clock, family string) (*name_manager.Ticket, error) {
+	b, err := tx.CreateBucketIfNotExists(ticketsBucket)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	now := clk.Now().UTC()
+	data := &localTicketData{
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	id := strconv.FormatUint(seq, 10)
+	if err := setTicketData(tx, family, id, data); err != nil {
+		return nil, err
+	}
+	position, err := ticketPosition(tx, family, id)
+	if err != nil {
+		return nil, err
+	}
+	return &name_manager.Ticket{
+		ID:        id,
+		Family:    family,
+		Position:  position,
+		CreatedAt: data.CreatedAt,
+		UpdatedAt: data.UpdatedAt,
+	}, nil
+}
+
+// pollTicket implements ticket polling inside a Bolt transaction.
+func pollTicket(
+	tx *bolt.Tx,
+	clk clock.Clock,
+	family, id string,
+	defaultLimit int,
+	options *name_manager.AcquireOptions,
+) (name_manager.Lease, int, error) {
+	data, err := getTicketData(tx, family, id)
+	if err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	if data == nil {
+		return name_manager.Lease{}, 0, name_manager.ErrTicketExpired
+	}
+	position, err := ticketPosition(tx, family, id)
+	if err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	if position == 0 {
+		limit, err := getFamilyLimit(tx, family, defaultLimit)
+		if err != nil {
+			return name_manager.Lease{}, 0, err
+		}
+		lease, err := acquireName(tx, clk, family, limit, options, false)
+		if err == nil {
+			return lease, 0, tx.Bucket(ticketsBucket).Delete(ticketKey(family, id))
+		}
+		if err == name_manager.ErrFamilyFull || err == name_manager.ErrPoolExhausted {
+			// The transaction must be rolled back, as the name generator
+			// may have counted a name that could not be created.
+			return name_manager.Lease{}, 0, errNotServed
+		}
+		return name_manager.Lease{}, 0, err
+	}
+	return name_manager.Lease{}, position, touchTicket(tx, clk, family, id)
+}
+
+// errNotServed is returned by pollTicket when the waiter at the head of
+// the queue could not acquire a name yet.
+var errNotServed = errors.New("not served")
+
+// touchTicket keeps a ticket alive inside a Bolt transaction.
+func touchTicket(tx *bolt.Tx, clk clock.Clock, family, id string) error {
+	data, err := getTicketData(tx, family, id)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return name_manager.ErrTicketExpired
+	}
+	data.UpdatedAt = clk.Now().UTC()
+	return setTicketData(tx, family, id, data)
+}
+
+// cancelTicket implements ticket cancellation inside a Bolt transaction.
+func cancelTicket(tx *bolt.Tx, family, id string) error {
+	b := tx.Bucket(ticketsBucket)
+	if b == nil {
+		return nil
+	}
+	return b.Delete(ticketKey(family, id))
+}
+
+// queue implements the listing of the waiters inside a Bolt transaction.
+func queue(tx *bolt.Tx, family string) ([]name_manager.Ticket, error) {
+	var tickets []name_manager.Ticket
+
+	b := tx.Bucket(ticketsBucket)
+	if b == nil {
+		return nil, nil
+	}
+	prefix := []byte(family + familyNameSep)
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		data := localTicketData{}
+		if err := json.Unmarshal(v, &data); err != nil {
+			return nil, err
+		}
+		_, paddedID := keyToFamilyName(k)
+		tickets = append(tickets, name_manager.Ticket{
+			ID:        strings.TrimLeft(paddedID, "0"),
+			Family:    family,
+			Position:  len(tickets),
+			CreatedAt: data.CreatedAt,
+			UpdatedAt: data.UpdatedAt,
+		})
+	}
+	return tickets, nil
+}
+
+// expireTickets removes from the queue of a family the tickets that were
+// not polled for more than autoReleaseAfter.
+func expireTickets(tx *bolt.Tx, clk clock.Clock, autoReleaseAfter time.Duration, family string) error {
+	b := tx.Bucket(ticketsBucket)
+	if b == nil {
+		return nil
+	}
+	now := clk.Now()
+	prefix := []byte(family + familyNameSep)
+	var expired [][]byte
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		data := &localTicketData{}
+		if err := json.Unmarshal(v, data); err != nil {
+			return err
+		}
+		if now.Sub(data.UpdatedAt) > autoReleaseAfter {
+			expired = append(expired, k)
+		}
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasTickets returns whether there are waiters in the queue of a family.
+func hasTickets(tx *bolt.Tx, family string) (bool, error) {
+	b := tx.Bucket(ticketsBucket)
+	if b == nil {
+		return false, nil
+	}
+	prefix := []byte(family + familyNameSep)
 	k, _ := b.Cursor().Seek(prefix)
-	if k == nil {
+	return k != nil && bytes.HasPrefix(k, prefix), nil
+}
+
+// ticketPosition returns the position of a ticket in the queue of a
+// family.
+func ticketPosition(tx *bolt.Tx, family, id string) (int, error) {
+	b := tx.Bucket(ticketsBucket)
+	if b == nil {
+		return 0, nil
+	}
+	position := 0
+	prefix := []byte(family + familyNameSep)
+	key := ticketKey(family, id)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, key) < 0; k, _ = c.Next() {
+		position++
+	}
+	return position, nil
+}
+
+// getTicketData returns the metadata for a given ticket, or `nil` if the
+// ticket could not be found.
+func getTicketData(tx *bolt.Tx, family, id string) (*localTicketData, error) {
+	b := tx.Bucket(ticketsBucket)
+	if b == nil {
 		return nil, nil
 	}
-	if !bytes.HasPrefix(k, prefix) {
+	jsonData := b.Get(ticketKey(family, id))
+	if jsonData == nil {
 		return nil, nil
 	}
-	return k[len(prefix):], nil
+	data := &localTicketData{}
+	if err := json.Unmarshal(jsonData, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// setTicketData creates or updates the metadata for a given ticket.
+func setTicketData(tx *bolt.Tx, family, id string, data *localTicketData) error {
+	dataJson, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	b, err := tx.CreateBucketIfNotExists(ticketsBucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(ticketKey(family, id), dataJson)
+}
+
+// ticketKey gets a key from a family and a ticket ID.  The ticket IDs
+// are zero-padded so that the lexicographic order of the keys is the
+// arrival order.
+func ticketKey(family, id string) []byte {
+	padding := ""
+	if len(id) < ticketIDLength {
+		padding = strings.Repeat("0", ticketIDLength-len(id))
+	}
+	return []byte(family + familyNameSep + padding + id)
+}
+
+// getAnyFreeName returns any free name for the given family that
+// matches the acquisition options, or `nil` if there is no such name,
+// in which case a new name must be generated.
+func getAnyFreeName(tx *bolt.Tx, family string, options *name_manager.AcquireOptions) ([]byte, error) {
+	b, err := tx.CreateBucketIfNotExists(freeNamesBucket)
+	if err != nil {
+		return nil, err
+	}
+	prefix := []byte(family + familyNameSep)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		name := k[len(prefix):]
+		data, err := getData(tx, family, string(name))
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			// The name has no attributes.
+			if len(options.Selector) == 0 {
+				return name, nil
+			}
+			continue
+		}
+		if data.Quarantine == "" && options.Matches(data.Attributes) {
+			return name, nil
+		}
+	}
+	return nil, nil
+}
+
+// hasMatchingName returns whether a name of the given family, free or
+// not, matches a selector.
+func hasMatchingName(tx *bolt.Tx, family string, selector name_manager.Selector) (bool, error) {
+	b := tx.Bucket(dataBucket)
+	if b == nil {
+		return false, nil
+	}
+	prefix := []byte(family + familyNameSep)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		data, err := getData(tx, family, string(k[len(prefix):]))
+		if err != nil {
+			return false, err
+		}
+		if data != nil && selector.Matches(data.Attributes) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 // isNameFree returns whether a name is free.
@@ -417,30 +1621,144 @@ func addFreeName(tx *bolt.Tx, family string, name string) error {
 	return b.Put(familyNameToKey(family, name), freeValue)
 }
 
-// getAndIncrementCounter gets the number of names registered for a
+// getCounter gets the number of names generated for a family.
+func getCounter(tx *bolt.Tx, family string) (int, error) {
+	b := tx.Bucket(countersBucket)
+	if b == nil {
+		return 0, nil
+	}
+	counterBytes := b.Get([]byte(family))
+	if counterBytes == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(counterBytes))
+}
+
+// getAndIncrementCounter gets the number of names generated for a
 // family and increments it.  The return value is therefore
 // `counters[family]++`.
 func getAndIncrementCounter(tx *bolt.Tx, family string) (int, error) {
+	counter, err := getCounter(tx, family)
+	if err != nil {
+		return 0, err
+	}
 	b, err := tx.CreateBucketIfNotExists(countersBucket)
 	if err != nil {
 		return 0, err
 	}
-	counterKey := []byte(family)
-	counterBytes := b.Get(counterKey)
-	var counter int
-	if counterBytes == nil {
-		counter = 0
-	} else {
-		i, err := strconv.Atoi(string(counterBytes))
+	if err = b.Put([]byte(family), []byte(strconv.Itoa(counter+1))); err != nil {
+		return 0, err
+	}
+	return counter, nil
+}
+
+// generateName generates a new name for a family with the name generator
+// of the family, skipping the names that are already registered.  The
+// recycled slots are used first.
+func generateName(tx *bolt.Tx, family string) (string, error) {
+	familyData, err := getFamilyData(tx, family)
+	if err != nil {
+		return "", err
+	}
+	generator, err := name_manager.ParseNameGenerator(familyData.Generator)
+	if err != nil {
+		return "", err
+	}
+	for len(familyData.Recycled) > 0 {
+		n := familyData.Recycled[0]
+		familyData.Recycled = familyData.Recycled[1:]
+		if err := setFamilyData(tx, family, familyData); err != nil {
+			return "", err
+		}
+		name, err := generator.Generate(n)
+		if err != nil {
+			return "", err
+		}
+		data, err := getData(tx, family, name)
 		if err != nil {
-			return 0, err
+			return "", err
+		}
+		if data == nil {
+			return name, nil
+		}
+	}
+	for attempt := 0; attempt < name_manager.NameGenerationAttempts; attempt++ {
+		counter, err := getAndIncrementCounter(tx, family)
+		if err != nil {
+			return "", err
+		}
+		name, err := generator.Generate(counter)
+		if err != nil {
+			return "", err
+		}
+		data, err := getData(tx, family, name)
+		if err != nil {
+			return "", err
+		}
+		if data == nil {
+			return name, nil
 		}
-		counter = i
 	}
-	if err = b.Put(counterKey, []byte(strconv.Itoa(counter+1))); err != nil {
+	return "", fmt.Errorf("could not generate a new name for family %s", family)
+}
+
+// countNames returns the number of names registered for a family.
+func countNames(tx *bolt.Tx, family string) (int, error) {
+	b := tx.Bucket(dataBucket)
+	if b == nil {
+		return 0, nil
+	}
+	count := 0
+	prefix := []byte(family + familyNameSep)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		count++
+	}
+	return count, nil
+}
+
+// getFamilyLimit returns the maximum number of names for a family, or
+// zero if there is no limit.
+func getFamilyLimit(tx *bolt.Tx, family string, defaultLimit int) (int, error) {
+	data, err := getFamilyData(tx, family)
+	if err != nil {
 		return 0, err
 	}
-	return counter, nil
+	if data.Limit > 0 {
+		return data.Limit, nil
+	}
+	return defaultLimit, nil
+}
+
+// getFamilyData returns the metadata for a given family.  If no metadata
+// was set for the family, an empty object is returned.
+func getFamilyData(tx *bolt.Tx, family string) (*localFamilyData, error) {
+	data := &localFamilyData{}
+	b := tx.Bucket(familiesBucket)
+	if b == nil {
+		return data, nil
+	}
+	jsonData := b.Get([]byte(family))
+	if jsonData == nil {
+		return data, nil
+	}
+	if err := json.Unmarshal(jsonData, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// setFamilyData creates or updates the metadata for a given family.
+func setFamilyData(tx *bolt.Tx, family string, data *localFamilyData) error {
+	dataJson, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	b, err := tx.CreateBucketIfNotExists(familiesBucket)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(family), dataJson)
 }
 
 // getData returns the metadata for a given name, or `nil` if the metadata
@@ -492,8 +1810,12 @@ func keyToFamilyName(key []byte) (family string, name string) {
 
 func (lbk *localBackend) hold() *hold.Hold {
 	return &hold.Hold{
-		Manager:           lbk,
-		Clock:             lbk.clock,
-		KeepAliveInterval: lbk.options.autoReleaseAfter / 3,
+		Manager: lbk,
+		Clock:   lbk.clock,
+		KeepAlivePolicy: lbk.options.keepAlive.Merge(
+			name_manager.DefaultKeepAlivePolicy(0)),
+		DefaultTTL:   lbk.options.autoReleaseAfter,
+		MaxTTL:       lbk.options.maxTTL,
+		PollInterval: lbk.options.pollInterval,
 	}
 }
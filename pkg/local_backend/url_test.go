@@ -17,6 +17,16 @@ func TestParseBackendURL(t *testing.T) {
 	assert.Equal(t, "./foo", path)
 	assert.Equal(t, 15*time.Second, options.autoReleaseAfter)
 
+	_, options, err = parseBackendURL("./foo;familyLimit=3;pollInterval=10ms")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, options.familyLimit)
+	assert.Equal(t, 10*time.Millisecond, options.pollInterval)
+
+	_, options, err = parseBackendURL("./foo;keepAliveRetryDelay=1s;keepAliveDeadline=20s")
+	assert.NoError(t, err)
+	assert.Equal(t, 1*time.Second, options.keepAlive.RetryDelay)
+	assert.Equal(t, 20*time.Second, options.keepAlive.Deadline)
+
 	_, _, err = parseBackendURL("./foo;__invalid__")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "options must have format")
@@ -28,4 +38,8 @@ func TestParseBackendURL(t *testing.T) {
 	_, _, err = parseBackendURL("./foo;autoReleaseAfter=__invalid__")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "cannot parse duration for autoReleaseAfter")
+
+	_, _, err = parseBackendURL("./foo;familyLimit=__invalid__")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot parse integer for familyLimit")
 }
@@ -2,6 +2,7 @@ package mongo_backend
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/benbjohnson/clock"
 	"github.com/hchauvin/name_manager/pkg/internal/hold"
@@ -10,7 +11,9 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	mongo_options "go.mongodb.org/mongo-driver/mongo/options"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -62,6 +65,16 @@ const (
 	// countersCollection is the name of the MongoDB collection that is used to
 	// keep track of the number of names for each family.
 	countersCollection = "counters"
+
+	// familiesCollection is the name of the MongoDB collection that holds
+	// the metadata associated to a family, such as its limit.
+	familiesCollection = "families"
+
+	// ticketsCollection is the name of the MongoDB collection that holds
+	// the queues of waiters.  There is one document per waiter, with a
+	// sequence number given by the "ticketCounter" field of the counters
+	// collection.
+	ticketsCollection = "tickets"
 )
 
 const lockDocumentPartition = "partition"
@@ -72,29 +85,200 @@ func (mbk *mongoBackend) Hold(family string) (string, <-chan error, name_manager
 	return mbk.hold().Hold(family)
 }
 
-func (mbk *mongoBackend) Acquire(family string) (string, error) {
-	ctx := context.Background()
+func (mbk *mongoBackend) HoldContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return mbk.hold().HoldContext(ctx, family, opts...)
+}
 
-	client, err := mbk.client()
+func (mbk *mongoBackend) Acquire(family string) (string, error) {
+	lease, err := mbk.AcquireContext(context.Background(), family)
 	if err != nil {
 		return "", err
 	}
-	defer client.Disconnect(ctx)
+	return lease.Name, nil
+}
+
+func (mbk *mongoBackend) AcquireContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	defer client.Disconnect(context.Background())
 
 	db := client.Database(mbk.options.database)
 
-	if err := mbk.releaseZombies(ctx, db, family); err != nil {
-		return "", err
+	if _, err := mbk.releaseZombies(ctx, db, family); err != nil {
+		return name_manager.Lease{}, err
+	}
+
+	return mbk.acquire(ctx, db, family, mbk.acquireOptions(opts))
+}
+
+// acquire acquires a name, unless the family is at capacity and has
+// waiters in its queue.  The free names of a family with waiters are
+// reserved for the waiters.
+func (mbk *mongoBackend) acquire(
+	ctx context.Context,
+	db *mongo.Database,
+	family string,
+	options *name_manager.AcquireOptions,
+) (name_manager.Lease, error) {
+	limit, err := mbk.familyLimit(ctx, db, family)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	// The free names are reserved for the waiters: a family at capacity
+	// is full, and only new names can be acquired in the other families.
+	waiting, err := mbk.collection(db, ticketsCollection).
+		CountDocuments(ctx, bson.M{"family": family})
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	if waiting > 0 && limit > 0 {
+		return name_manager.Lease{}, name_manager.ErrFamilyFull
+	}
+	return mbk.acquireName(ctx, db, family, limit, options, waiting > 0)
+}
+
+func (mbk *mongoBackend) AcquireMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) ([]name_manager.Lease, error) {
+	families, err := name_manager.SortedFamilies(counts)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	options := mbk.acquireOptions(opts)
+	var leases []name_manager.Lease
+	for _, family := range families {
+		if _, err := mbk.releaseZombies(ctx, db, family); err != nil {
+			return nil, err
+		}
+		for i := 0; i < counts[family]; i++ {
+			lease, err := mbk.acquire(ctx, db, family, options)
+			if err != nil {
+				// Transactions require a replica set: the names that
+				// were acquired are released instead.
+				for _, acquired := range leases {
+					_, _ = mbk.collection(db, leasedNamesCollection).
+						DeleteOne(context.Background(), mbk.leaseFilter(acquired))
+				}
+				return nil, err
+			}
+			leases = append(leases, lease)
+		}
+	}
+	return leases, nil
+}
+
+func (mbk *mongoBackend) HoldMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) (*name_manager.Holdings, error) {
+	return mbk.hold().HoldMany(ctx, counts, opts...)
+}
+
+// acquireName acquires a name, regardless of the waiters in the queue
+// of the family.  If newName is true, the free names are skipped, and a
+// new name is created.
+func (mbk *mongoBackend) acquireName(
+	ctx context.Context,
+	db *mongo.Database,
+	family string,
+	limit int,
+	options *name_manager.AcquireOptions,
+	newName bool,
+) (name_manager.Lease, error) {
+	if !newName {
+		lease, ok, err := mbk.acquireFreeName(ctx, db, family, options)
+		if err != nil || ok {
+			return lease, err
+		}
+	}
+	if !options.CanCreateName() {
+		// The acquisition can wait for the matching names that are in
+		// use to be released.
+		matching, err := mbk.collection(db, dataCollection).CountDocuments(
+			ctx,
+			bson.M{"family": family, "$and": selectorFilter(options.Selector)},
+			mongo_options.Count().SetLimit(1))
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+		if matching > 0 {
+			return name_manager.Lease{}, name_manager.ErrFamilyFull
+		}
+		return name_manager.Lease{}, name_manager.ErrNoMatchingName
 	}
 
+	// No free name could be acquired.  It means we need to create a new
+	// name.  To avoid having another
+	// process acquiring the name we just created, we need to lease
+	// the name *before* we actually create it.  We ensure the uniqueness
+	// of the new name by atomically updating the family entry in the
+	// counters collection.
+	generator, err := mbk.familyGenerator(ctx, db, family)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	for attempt := 0; attempt < name_manager.NameGenerationAttempts; attempt++ {
+		index, err := mbk.nextIndex(ctx, db, family, limit)
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+		newName, err := generator.Generate(index)
+		if err == name_manager.ErrPoolExhausted {
+			// The index is not consumed, for the names that are added to
+			// the pool to be generated.
+			if _, err := mbk.collection(db, countersCollection).UpdateOne(
+				ctx,
+				bson.M{"family": family},
+				bson.M{"$inc": bson.M{"counter": int32(-1)}}); err != nil {
+				return name_manager.Lease{}, err
+			}
+			return name_manager.Lease{}, name_manager.ErrPoolExhausted
+		} else if err != nil {
+			return name_manager.Lease{}, err
+		}
+		lease, err := mbk.createName(ctx, db, family, newName, options)
+		if err == errNameTaken {
+			// The name was not created after all.
+			if err := mbk.uncountName(ctx, db, family); err != nil {
+				return name_manager.Lease{}, err
+			}
+			continue
+		}
+		return lease, err
+	}
+	return name_manager.Lease{}, fmt.Errorf("could not generate a new name for family %s", family)
+}
+
+// acquireFreeName acquires a free name of a family that matches the
+// acquisition options.  It returns false if there is none.
+func (mbk *mongoBackend) acquireFreeName(
+	ctx context.Context,
+	db *mongo.Database,
+	family string,
+	options *name_manager.AcquireOptions,
+) (name_manager.Lease, bool, error) {
+	filter := bson.M{
+		"family": family,
+		// The quarantined names are out of rotation.
+		"quarantine": bson.M{"$exists": false},
+	}
+	if len(options.Selector) > 0 {
+		filter["$and"] = selectorFilter(options.Selector)
+	}
 	result, err := mbk.collection(db, dataCollection).
-		Find(context.Background(), bson.D{{"family", family}})
+		Find(ctx, filter)
 	if err != nil {
-		return "", err
+		return name_manager.Lease{}, false, err
 	}
 	for result.Next(ctx) {
 		if result.Err() != nil {
-			return "", result.Err()
+			return name_manager.Lease{}, false, result.Err()
 		}
 
 		curName := result.Current.Lookup("name").StringValue()
@@ -108,12 +292,21 @@ func (mbk *mongoBackend) Acquire(family string) (string, error) {
 			"createdAt":         now,
 			"lastHeartBeatDate": now,
 			"family":            family,
+			"name":              curName,
+			"labels":            options.Labels,
+			"ttl":               options.TTL.Milliseconds(),
 		}
 		_, err = mbk.collection(db, leasedNamesCollection).
 			InsertOne(ctx, document)
 		if err == nil {
 			// The lease was successfully acquired
-			return curName, nil
+			lease, err := mbk.fence(ctx, db, family, curName)
+			if err == name_manager.ErrLeaseLost {
+				// The lease was lost in the meantime, let's try another
+				// name.
+				continue
+			}
+			return lease, err == nil, err
 		}
 
 		// The lease could not be acquired.  There is either a problem with the MongoDB
@@ -126,38 +319,125 @@ func (mbk *mongoBackend) Acquire(family string) (string, error) {
 				}
 			}
 		}
-		return "", err
+		return name_manager.Lease{}, false, err
 
 	next:
 	}
+	return name_manager.Lease{}, false, nil
+}
 
-	// We looped through all the names, and we could not acquire any.
-	// It means we need to create a new name.  To avoid having another
-	// process acquiring the name we just created, we need to lease
-	// the name *before* we actually create it.  We ensure the uniqueness
-	// of the new name by atomically updating the family entry in the
-	// counters collection.
+// errNameTaken is returned by createName when the name is already
+// registered.
+var errNameTaken = errors.New("name taken")
+
+// nextIndex counts a new name for a family, and returns the index of the
+// new name in the name generator of the family: the lowest recycled
+// index if there is one (see name_manager.WithRecycle), the next index
+// otherwise.  If there is a limit, the name is only counted when the
+// family is below the limit, otherwise ErrFamilyFull is returned.
+func (mbk *mongoBackend) nextIndex(ctx context.Context, db *mongo.Database, family string, limit int) (int, error) {
+	// The recycled indexes are kept sorted, so the first one is the lowest.
+	recycledFilter := bson.M{"family": family, "recycled.0": bson.M{"$exists": true}}
+	if limit > 0 {
+		recycledFilter["counter"] = bson.M{"$lt": limit}
+	}
+	recycledResult := mbk.collection(db, countersCollection).
+		FindOneAndUpdate(
+			ctx,
+			recycledFilter,
+			bson.M{
+				"$pop": bson.M{"recycled": -1},
+				// The index is not consumed: the next index, given by
+				// "counter" + "skipped", does not change.
+				"$inc": bson.M{"counter": int32(1), "skipped": int32(-1)},
+			},
+			mongo_options.FindOneAndUpdate().SetReturnDocument(mongo_options.Before))
+	if err := recycledResult.Err(); err == nil {
+		counterDoc, err := recycledResult.DecodeBytes()
+		if err != nil {
+			return 0, err
+		}
+		recycled := counterDoc.Lookup("recycled", "0")
+		if index, ok := recycled.Int32OK(); ok {
+			return int(index), nil
+		}
+		return 0, fmt.Errorf("invalid recycled index for family %s", family)
+	} else if err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+
+	counter, skipped, err := mbk.incrementCounter(ctx, db, family, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(counter + skipped), nil
+}
+
+// uncountName reverts the counting of a new name (see nextIndex) when
+// the name could not be created.  The index of the name is consumed.
+func (mbk *mongoBackend) uncountName(ctx context.Context, db *mongo.Database, family string) error {
+	_, err := mbk.collection(db, countersCollection).UpdateOne(
+		ctx,
+		bson.M{"family": family},
+		bson.M{"$inc": bson.M{"counter": int32(-1), "skipped": int32(1)}})
+	return err
+}
+
+// incrementCounter gets the counter of a family and increments it.  If
+// there is a limit, the counter is only incremented when it is below the
+// limit, otherwise ErrFamilyFull is returned.  The counter is the number
+// of names of the family.  The number of names that were deleted or
+// could not be created, which is also returned, must be added to the
+// counter to get the next index in the name generator of the family.
+func (mbk *mongoBackend) incrementCounter(ctx context.Context, db *mongo.Database, family string, limit int) (int32, int32, error) {
+	// The counter must exist beforehand, for the conditional update below
+	// not to upsert a duplicate counter.  The counters of the families
+	// that were created by Enqueue before the counter was initialized
+	// there have no counter yet: $max initializes it without changing an
+	// existing counter.
+	_, err := mbk.collection(db, countersCollection).UpdateOne(
+		ctx,
+		bson.M{"family": family},
+		bson.M{"$max": bson.M{"counter": int32(0), "skipped": int32(0)}},
+		mongo_options.Update().SetUpsert(true))
+	if err != nil {
+		return 0, 0, err
+	}
+	counterFilter := bson.M{"family": family}
+	if limit > 0 {
+		// The counter is only incremented if the limit is not reached.
+		counterFilter["counter"] = bson.M{"$lt": limit}
+	}
 	counterResult := mbk.collection(db, countersCollection).
 		FindOneAndUpdate(
 			ctx,
-			bson.M{"family": family},
+			counterFilter,
 			bson.M{"$inc": bson.M{"counter": 1}},
-			mongo_options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(mongo_options.Before))
-	var counter int32
+			mongo_options.FindOneAndUpdate().SetReturnDocument(mongo_options.Before))
 	if counterResult.Err() == mongo.ErrNoDocuments {
-		counter = 0 // Redundant, but clearer
-	} else if counterResult.Err() != nil {
-		return "", err
-	} else {
-		counterDoc, err := counterResult.DecodeBytes()
-		if err != nil {
-			return "", err
+		if limit > 0 {
+			return 0, 0, name_manager.ErrFamilyFull
 		}
-		counter = counterDoc.Lookup("counter").Int32()
+		return 0, 0, nil
+	} else if counterResult.Err() != nil {
+		return 0, 0, counterResult.Err()
 	}
+	counterDoc, err := counterResult.DecodeBytes()
+	if err != nil {
+		return 0, 0, err
+	}
+	skipped, _ := counterDoc.Lookup("skipped").Int32OK()
+	return counterDoc.Lookup("counter").Int32(), skipped, nil
+}
 
-	newName := strconv.Itoa(int(counter))
-
+// createName leases and registers a new name.  It fails with
+// errNameTaken if the name is already registered.
+func (mbk *mongoBackend) createName(
+	ctx context.Context,
+	db *mongo.Database,
+	family, newName string,
+	options *name_manager.AcquireOptions,
+) (name_manager.Lease, error) {
 	now := mbk.clock.Now()
 	document := bson.M{
 		"_id":               mbk.leaseId(family, newName),
@@ -165,84 +445,244 @@ func (mbk *mongoBackend) Acquire(family string) (string, error) {
 		"createdAt":         now,
 		"lastHeartBeatDate": now,
 		"family":            family,
+		"name":              newName,
+		"labels":            options.Labels,
+		"ttl":               options.TTL.Milliseconds(),
 	}
-	_, err = mbk.collection(db, leasedNamesCollection).
+	_, err := mbk.collection(db, leasedNamesCollection).
 		InsertOne(ctx, document)
 	if err != nil {
-		return "", err
+		if werrs, ok := err.(mongo.WriteException); ok {
+			for _, werr := range werrs.WriteErrors {
+				if werr.Code == mongoDBDuplicateKeyErrorCode {
+					// The name is registered and in use.
+					return name_manager.Lease{}, errNameTaken
+				}
+			}
+		}
+		return name_manager.Lease{}, err
+	}
+
+	count, err := mbk.collection(db, dataCollection).
+		CountDocuments(ctx, bson.M{"family": family, "name": newName})
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	if count > 0 {
+		// The name is registered and free: we give it back.
+		_, err := mbk.collection(db, leasedNamesCollection).
+			DeleteOne(ctx, bson.M{"_id": mbk.leaseId(family, newName)})
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+		return name_manager.Lease{}, errNameTaken
 	}
 
+	token, err := mbk.tokenFloor(ctx, db, family)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
 	document = bson.M{
 		"family":    family,
 		"name":      newName,
 		"createdAt": now,
+		"token":     token,
+		"fresh":     true,
 	}
 	_, err = mbk.collection(db, dataCollection).
 		InsertOne(ctx, document)
 	if err != nil {
-		return "", err
+		return name_manager.Lease{}, err
 	}
 
-	return newName, nil
+	return mbk.fence(ctx, db, family, newName)
+}
+
+func (mbk *mongoBackend) AcquireWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	return mbk.hold().AcquireWait(ctx, family, opts...)
+}
+
+func (mbk *mongoBackend) HoldWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return mbk.hold().HoldWait(ctx, family, opts...)
 }
 
 func (mbk *mongoBackend) KeepAlive(family, name string) error {
-	ctx := context.Background()
+	return mbk.KeepAliveContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
 
-	client, err := mbk.client()
+func (mbk *mongoBackend) KeepAliveContext(ctx context.Context, lease name_manager.Lease) error {
+	client, err := mbk.client(ctx)
 	if err != nil {
 		return err
 	}
-	defer client.Disconnect(ctx)
+	defer client.Disconnect(context.Background())
 
 	db := client.Database(mbk.options.database)
 
-	_, err = mbk.collection(db, leasedNamesCollection).UpdateOne(
-		context.Background(),
-		bson.M{
-			"_id":       mbk.leaseId(family, name),
-			"partition": lockDocumentPartition,
-		},
+	updateResult, err := mbk.collection(db, leasedNamesCollection).UpdateOne(
+		ctx,
+		mbk.leaseFilter(lease),
 		bson.M{"$set": bson.M{"lastHeartBeatDate": mbk.clock.Now()}})
-	return err
+	if err != nil {
+		return err
+	}
+	if updateResult.MatchedCount > 0 {
+		return nil
+	}
+	return mbk.leaseError(ctx, db, lease)
+}
+
+// leaseError gives the error for a lease that does not match any lease
+// document: ErrLeaseLost if the name is held with another lease, and
+// ErrNotHeld otherwise.
+func (mbk *mongoBackend) leaseError(ctx context.Context, db *mongo.Database, lease name_manager.Lease) error {
+	if lease.Token != 0 {
+		held, err := mbk.collection(db, leasedNamesCollection).CountDocuments(
+			ctx,
+			mbk.leaseFilter(name_manager.Lease{Family: lease.Family, Name: lease.Name}))
+		if err != nil {
+			return err
+		}
+		if held > 0 {
+			return name_manager.ErrLeaseLost
+		}
+	}
+	return name_manager.ErrNotHeld
+}
+
+func (mbk *mongoBackend) Transfer(ctx context.Context, lease name_manager.Lease) (name_manager.ClaimTicket, error) {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	ticket, err := name_manager.NewClaimTicket(lease)
+	if err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	result := mbk.collection(db, leasedNamesCollection).FindOneAndUpdate(
+		ctx,
+		mbk.leaseFilter(lease),
+		bson.M{"$set": bson.M{
+			"lastHeartBeatDate": mbk.clock.Now(),
+			"claim":             ticket.Secret,
+		}},
+		mongo_options.FindOneAndUpdate().SetReturnDocument(mongo_options.After))
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return name_manager.ClaimTicket{}, mbk.leaseError(ctx, db, lease)
+		}
+		return name_manager.ClaimTicket{}, err
+	}
+	leaseDoc, err := result.DecodeBytes()
+	if err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	// The lease documents written before the tokens were introduced have
+	// no token.
+	ticket.Token, _ = leaseDoc.Lookup("token").Int64OK()
+	return ticket, nil
+}
+
+func (mbk *mongoBackend) Claim(ctx context.Context, ticket name_manager.ClaimTicket, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	options := mbk.acquireOptions(opts)
+	// The new token is reserved beforehand, so that the claim is redeemed
+	// and the lease of the previous holder is fenced in a single update.
+	// A token that is reserved for a claim that turns out to be invalid
+	// is simply never used.
+	token, _, err := mbk.nextToken(ctx, db, ticket.Family, ticket.Name)
+	if err == mongo.ErrNoDocuments {
+		return name_manager.Lease{}, name_manager.ErrInvalidClaim
+	} else if err != nil {
+		return name_manager.Lease{}, err
+	}
+	// Only one claimer can remove the claim.
+	filter := mbk.leaseFilter(ticket.Lease)
+	filter["claim"] = ticket.Secret
+	updateResult, err := mbk.collection(db, leasedNamesCollection).UpdateOne(
+		ctx,
+		filter,
+		bson.M{
+			"$set": bson.M{
+				"lastHeartBeatDate": mbk.clock.Now(),
+				"labels":            options.Labels,
+				"ttl":               options.TTL.Milliseconds(),
+				"token":             token,
+			},
+			"$unset": bson.M{"claim": ""},
+		})
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	if updateResult.MatchedCount != 1 {
+		return name_manager.Lease{}, name_manager.ErrInvalidClaim
+	}
+	return name_manager.Lease{Family: ticket.Family, Name: ticket.Name, Token: token}, nil
 }
 
 func (mbk *mongoBackend) Release(family, name string) error {
-	ctx := context.Background()
+	return mbk.ReleaseContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
 
-	client, err := mbk.client()
+func (mbk *mongoBackend) ReleaseContext(ctx context.Context, lease name_manager.Lease) error {
+	client, err := mbk.client(ctx)
 	if err != nil {
 		return err
 	}
-	defer client.Disconnect(ctx)
+	defer client.Disconnect(context.Background())
 
 	db := client.Database(mbk.options.database)
 
-	_, err = mbk.collection(db, leasedNamesCollection).
-		DeleteOne(ctx, bson.D{{"_id", mbk.leaseId(family, name)}})
-	return err
+	deleteResult, err := mbk.collection(db, leasedNamesCollection).
+		DeleteOne(ctx, mbk.leaseFilter(lease))
+	if err != nil {
+		return err
+	}
+	if lease.Token != 0 && deleteResult.DeletedCount == 0 {
+		return name_manager.ErrLeaseLost
+	}
+	return nil
 }
 
 func (mbk *mongoBackend) TryHold(family, name string) (<-chan error, name_manager.ReleaseFunc, error) {
 	return mbk.hold().TryHold(family, name)
 }
 
+func (mbk *mongoBackend) TryHoldContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return mbk.hold().TryHoldContext(ctx, family, name, opts...)
+}
+
 func (mbk *mongoBackend) TryAcquire(family, name string) error {
-	ctx := context.Background()
+	_, err := mbk.TryAcquireContext(context.Background(), family, name)
+	return err
+}
 
-	client, err := mbk.client()
+func (mbk *mongoBackend) TryAcquireContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	client, err := mbk.client(ctx)
 	if err != nil {
-		return err
+		return name_manager.Lease{}, err
 	}
-	defer client.Disconnect(ctx)
+	defer client.Disconnect(context.Background())
 
 	db := client.Database(mbk.options.database)
 
-	if err := mbk.releaseZombies(ctx, db, family); err != nil {
-		return err
+	if _, err := mbk.releaseZombies(ctx, db, family); err != nil {
+		return name_manager.Lease{}, err
 	}
 
 	// Let's try to get a lease on this name.
+	options := mbk.acquireOptions(opts)
 	now := mbk.clock.Now()
 	document := bson.M{
 		"_id": mbk.leaseId(family, name),
@@ -251,52 +691,61 @@ func (mbk *mongoBackend) TryAcquire(family, name string) error {
 		"createdAt":         now,
 		"lastHeartBeatDate": now,
 		"family":            family,
+		"name":              name,
+		"labels":            options.Labels,
+		"ttl":               options.TTL.Milliseconds(),
 	}
 	_, err = mbk.collection(db, leasedNamesCollection).
 		InsertOne(ctx, document)
 	if err != nil {
-		return name_manager.ErrInUse
+		return name_manager.Lease{}, name_manager.ErrInUse
 	}
 
 	// Now, let's see if the name actually exists.
-	res := mbk.collection(db, dataCollection).
-		FindOne(ctx, bson.D{{"family", family}, {"name", name}})
-	if res.Err() != nil {
+	lease, err := mbk.fence(ctx, db, family, name)
+	if err == name_manager.ErrLeaseLost {
+		// The lease was released or reaped in the meantime, and the name
+		// may have been acquired by someone else.
+		return name_manager.Lease{}, name_manager.ErrInUse
+	} else if err != nil {
 		// The name does not exist.  Release the lease immediately.
-		_, err = mbk.collection(db, leasedNamesCollection).
-			DeleteOne(ctx, bson.D{{"_id", mbk.leaseId(family, name)}})
-		if err != nil {
-			return err
+		_, delErr := mbk.collection(db, leasedNamesCollection).
+			DeleteOne(ctx, bson.M{"_id": mbk.leaseId(family, name)})
+		if delErr != nil {
+			return name_manager.Lease{}, delErr
 		}
 
-		if res.Err() == mongo.ErrNoDocuments {
-			return name_manager.ErrNotExist
+		if err == mongo.ErrNoDocuments {
+			return name_manager.Lease{}, name_manager.ErrNotExist
 		}
-		return res.Err()
+		return name_manager.Lease{}, err
 	}
 
 	// The lease was successfully acquired, and the name exists.
-	return nil
+	return lease, nil
 }
 
 func (mbk *mongoBackend) List() ([]name_manager.Name, error) {
-	ctx := context.Background()
+	return mbk.ListContext(context.Background())
+}
 
-	client, err := mbk.client()
+func (mbk *mongoBackend) ListContext(ctx context.Context) ([]name_manager.Name, error) {
+	client, err := mbk.client(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer client.Disconnect(ctx)
+	defer client.Disconnect(context.Background())
 
 	db := client.Database(mbk.options.database)
 
 	result, err := mbk.collection(db, dataCollection).
-		Find(context.Background(), bson.D{})
+		Find(ctx, bson.M{})
 	if err != nil {
 		return nil, err
 	}
 
 	var names []name_manager.Name
+	generators := make(map[string]name_manager.NameGenerator)
 	for result.Next(ctx) {
 		if result.Err() != nil {
 			return nil, result.Err()
@@ -306,12 +755,13 @@ func (mbk *mongoBackend) List() ([]name_manager.Name, error) {
 		family := result.Current.Lookup("family").StringValue()
 
 		leaseResult := mbk.collection(db, leasedNamesCollection).FindOne(
-			context.Background(),
+			ctx,
 			bson.M{
 				"_id":       mbk.leaseId(family, name),
 				"partition": lockDocumentPartition,
 			})
 		var updatedAt time.Time
+		var labels map[string]string
 		free := true
 		if err := leaseResult.Err(); err != nil {
 			if err != mongo.ErrNoDocuments {
@@ -324,14 +774,40 @@ func (mbk *mongoBackend) List() ([]name_manager.Name, error) {
 			}
 			updatedAt = leaseDocument.Lookup("createdAt").Time().UTC()
 			free = false
+			if labelsDocument, ok := leaseDocument.Lookup("labels").DocumentOK(); ok {
+				if err := bson.Unmarshal(labelsDocument, &labels); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		token, _ := result.Current.Lookup("token").Int64OK()
+		attributes, err := decodeAttributes(result.Current)
+		if err != nil {
+			return nil, err
+		}
+		reason, _ := result.Current.Lookup("quarantine").StringValueOK()
+		generator, ok := generators[family]
+		if !ok {
+			generator, err = mbk.familyGenerator(ctx, db, family)
+			if err != nil {
+				return nil, err
+			}
+			generators[family] = generator
 		}
+		pool, isPool := generator.(*name_manager.PoolGenerator)
 
 		names = append(names, name_manager.Name{
-			Name:      name,
-			Family:    family,
-			CreatedAt: result.Current.Lookup("createdAt").Time().UTC(),
-			UpdatedAt: updatedAt,
-			Free:      free,
+			Name:       name,
+			Family:     family,
+			CreatedAt:  result.Current.Lookup("createdAt").Time().UTC(),
+			UpdatedAt:  updatedAt,
+			Free:       free,
+			Quarantine: reason,
+			Token:      token,
+			Labels:     labels,
+			Attributes: attributes,
+			Pool:       isPool && pool.Contains(name),
 		})
 	}
 
@@ -339,17 +815,19 @@ func (mbk *mongoBackend) List() ([]name_manager.Name, error) {
 }
 
 func (mbk *mongoBackend) Reset() error {
-	ctx := context.Background()
+	return mbk.ResetContext(context.Background())
+}
 
-	client, err := mbk.client()
+func (mbk *mongoBackend) ResetContext(ctx context.Context) error {
+	client, err := mbk.client(ctx)
 	if err != nil {
 		return err
 	}
-	defer client.Disconnect(ctx)
+	defer client.Disconnect(context.Background())
 
 	db := client.Database(mbk.options.database)
 
-	collections := []string{dataCollection, leasedNamesCollection, countersCollection}
+	collections := []string{dataCollection, leasedNamesCollection, countersCollection, familiesCollection, ticketsCollection}
 	for _, collection := range collections {
 		if err := mbk.collection(db, collection).Drop(ctx); err != nil {
 			return err
@@ -358,42 +836,878 @@ func (mbk *mongoBackend) Reset() error {
 	return nil
 }
 
-func (mbk *mongoBackend) client() (*mongo.Client, error) {
-	mongoConnectCtx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	return mongo.Connect(mongoConnectCtx, mongo_options.Client().ApplyURI(mbk.options.uri))
-}
+func (mbk *mongoBackend) Reap(ctx context.Context, families ...string) ([]name_manager.Lease, error) {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(context.Background())
 
-func (mbk *mongoBackend) collection(db *mongo.Database, name string) *mongo.Collection {
-	return db.Collection(mbk.options.collectionPrefix + name)
-}
+	db := client.Database(mbk.options.database)
 
-func (mbk *mongoBackend) leaseId(family, name string) string {
-	return "_" + mbk.options.collectionPrefix + "lock_" + family + name
+	reaped := append([]string(nil), families...)
+	if len(reaped) == 0 {
+		// The families with leases or waiters.
+		seen := make(map[string]bool)
+		for _, collection := range []string{leasedNamesCollection, ticketsCollection} {
+			values, err := mbk.collection(db, collection).Distinct(ctx, "family", bson.M{})
+			if err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				if family, ok := value.(string); ok && !seen[family] {
+					seen[family] = true
+					reaped = append(reaped, family)
+				}
+			}
+		}
+	}
+	sort.Strings(reaped)
+
+	var released []name_manager.Lease
+	for _, family := range reaped {
+		leases, err := mbk.releaseZombies(ctx, db, family)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, leases...)
+	}
+	return released, nil
 }
 
-func (mbk *mongoBackend) releaseZombies(ctx context.Context, db *mongo.Database, family string) error {
-	if mbk.options.autoReleaseAfter == 0 {
-		return nil
+func (mbk *mongoBackend) Delete(ctx context.Context, family, name string, opts ...name_manager.DeleteOption) error {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return err
 	}
-	deadline := mbk.clock.Now().Add(-mbk.options.autoReleaseAfter)
-	deleteResult, err := mbk.collection(db, leasedNamesCollection).
-		DeleteMany(ctx, bson.M{
-			"lastHeartBeatDate": bson.M{"$lt": deadline},
-			"family":            family,
-		})
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+	options := name_manager.NewDeleteOptions(opts...)
+
+	count, err := mbk.collection(db, dataCollection).
+		CountDocuments(ctx, bson.M{"family": family, "name": name})
 	if err != nil {
 		return err
 	}
-	if n := deleteResult.DeletedCount; n > 0 {
-		fmt.Fprintf(os.Stderr, "Released %d zombies\n", n)
+	if count == 0 {
+		return name_manager.ErrNotExist
 	}
-	return nil
+
+	// The name is leased while it is deleted, so that it cannot be
+	// acquired in the meantime.
+	if err := mbk.lockName(ctx, db, family, name, options.Force); err != nil {
+		return err
+	}
+	defer mbk.collection(db, leasedNamesCollection).
+		DeleteOne(context.Background(), bson.M{"_id": mbk.leaseId(family, name)})
+
+	result := mbk.collection(db, dataCollection).
+		FindOneAndDelete(ctx, bson.M{"family": family, "name": name})
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return name_manager.ErrNotExist
+		}
+		return err
+	}
+	dataDoc, err := result.DecodeBytes()
+	if err != nil {
+		return err
+	}
+	token, _ := dataDoc.Lookup("token").Int64OK()
+
+	// The name does not count toward the limit anymore, and the next
+	// index is unchanged (see incrementCounter).  The names registered
+	// afterwards start from the token of the name (see tokenFloor).
+	update := bson.M{
+		"$inc": bson.M{"counter": int32(-1), "skipped": int32(1)},
+		"$max": bson.M{"token": token},
+	}
+	if options.Recycle {
+		index, err := mbk.nameIndex(ctx, db, family, name)
+		if err != nil {
+			return err
+		}
+		if index >= 0 {
+			update["$push"] = bson.M{"recycled": bson.M{
+				"$each": bson.A{int32(index)},
+				"$sort": 1,
+			}}
+		}
+	}
+	_, err = mbk.collection(db, countersCollection).
+		UpdateOne(ctx, bson.M{"family": family}, update)
+	return err
+}
+
+// lockName leases a name without a token, so that it cannot be acquired
+// while it is deleted.  It fails with ErrInUse if the name is held,
+// unless force is true, in which case the lease of the holder is
+// replaced by the lock in a single update.
+func (mbk *mongoBackend) lockName(ctx context.Context, db *mongo.Database, family, name string, force bool) error {
+	now := mbk.clock.Now()
+	lock := bson.M{
+		"partition":         lockDocumentPartition,
+		"createdAt":         now,
+		"lastHeartBeatDate": now,
+		"family":            family,
+		"name":              name,
+	}
+	if force {
+		_, err := mbk.collection(db, leasedNamesCollection).ReplaceOne(
+			ctx,
+			bson.M{"_id": mbk.leaseId(family, name)},
+			lock,
+			mongo_options.Replace().SetUpsert(true))
+		return err
+	}
+	lock["_id"] = mbk.leaseId(family, name)
+	_, err := mbk.collection(db, leasedNamesCollection).InsertOne(ctx, lock)
+	if err != nil {
+		if werrs, ok := err.(mongo.WriteException); ok {
+			for _, werr := range werrs.WriteErrors {
+				if werr.Code == mongoDBDuplicateKeyErrorCode {
+					return name_manager.ErrInUse
+				}
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// tokenFloor returns the highest token of the deleted names of a family.
+// The names that are registered start from this token, so that the
+// tokens of a name that is deleted then registered again keep
+// increasing.
+func (mbk *mongoBackend) tokenFloor(ctx context.Context, db *mongo.Database, family string) (int64, error) {
+	result := mbk.collection(db, countersCollection).FindOne(ctx, bson.M{"family": family})
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, err
+	}
+	counterDoc, err := result.DecodeBytes()
+	if err != nil {
+		return 0, err
+	}
+	token, _ := counterDoc.Lookup("token").Int64OK()
+	return token, nil
+}
+
+// nameIndex returns the index of a name in the name generator of its
+// family, or -1 if the name was not generated.
+func (mbk *mongoBackend) nameIndex(ctx context.Context, db *mongo.Database, family, name string) (int, error) {
+	generator, err := mbk.familyGenerator(ctx, db, family)
+	if err != nil {
+		return 0, err
+	}
+	result := mbk.collection(db, countersCollection).FindOne(ctx, bson.M{"family": family})
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return -1, nil
+		}
+		return 0, err
+	}
+	counterDoc, err := result.DecodeBytes()
+	if err != nil {
+		return 0, err
+	}
+	counter, _ := counterDoc.Lookup("counter").Int32OK()
+	skipped, _ := counterDoc.Lookup("skipped").Int32OK()
+	return name_manager.NameIndex(generator, name, int(counter+skipped)), nil
+}
+
+func (mbk *mongoBackend) DeleteFamily(ctx context.Context, family string, opts ...name_manager.DeleteOption) error {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+	options := name_manager.NewDeleteOptions(opts...)
+
+	if !options.Force {
+		// The names are locked one by one, so that a name cannot be
+		// acquired between the check that it is free and the deletion.
+		// The locks are deleted with the family.  Transactions require a
+		// replica set: a name that starts being created after the check
+		// is deleted even though it is held.
+		var locked []string
+		unlock := func() {
+			for _, name := range locked {
+				_, _ = mbk.collection(db, leasedNamesCollection).
+					DeleteOne(context.Background(), bson.M{"_id": mbk.leaseId(family, name)})
+			}
+		}
+		result, err := mbk.collection(db, dataCollection).
+			Find(ctx, bson.M{"family": family})
+		if err != nil {
+			return err
+		}
+		for result.Next(ctx) {
+			name := result.Current.Lookup("name").StringValue()
+			if err := mbk.lockName(ctx, db, family, name, false); err != nil {
+				unlock()
+				return err
+			}
+			locked = append(locked, name)
+		}
+		if err := result.Err(); err != nil {
+			unlock()
+			return err
+		}
+		// The names that are being created are leased beforehand.
+		held, err := mbk.collection(db, leasedNamesCollection).
+			CountDocuments(ctx, bson.M{"family": family})
+		if err != nil {
+			unlock()
+			return err
+		}
+		if int(held) > len(locked) {
+			unlock()
+			return name_manager.ErrInUse
+		}
+	}
+
+	collections := []string{dataCollection, leasedNamesCollection, countersCollection, familiesCollection, ticketsCollection}
+	for _, collection := range collections {
+		_, err := mbk.collection(db, collection).DeleteMany(ctx, bson.M{"family": family})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mbk *mongoBackend) Enqueue(ctx context.Context, family string) (name_manager.Ticket, error) {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return name_manager.Ticket{}, err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	if _, err := mbk.releaseZombies(ctx, db, family); err != nil {
+		return name_manager.Ticket{}, err
+	}
+
+	// The sequence number of the ticket gives the arrival order.
+	counterResult := mbk.collection(db, countersCollection).
+		FindOneAndUpdate(
+			ctx,
+			bson.M{"family": family},
+			bson.M{
+				"$inc": bson.M{"ticketCounter": 1},
+				// The counter of the names is initialized along with the
+				// counter of the tickets (see incrementCounter).
+				"$setOnInsert": bson.M{"counter": int32(0), "skipped": int32(0)},
+			},
+			mongo_options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(mongo_options.After))
+	if err := counterResult.Err(); err != nil {
+		return name_manager.Ticket{}, err
+	}
+	counterDoc, err := counterResult.DecodeBytes()
+	if err != nil {
+		return name_manager.Ticket{}, err
+	}
+	seq := counterDoc.Lookup("ticketCounter").Int32()
+	id := strconv.Itoa(int(seq))
+
+	now := mbk.clock.Now()
+	_, err = mbk.collection(db, ticketsCollection).InsertOne(ctx, bson.M{
+		"_id":               mbk.ticketId(family, id),
+		"family":            family,
+		"seq":               seq,
+		"createdAt":         now,
+		"lastHeartBeatDate": now,
+	})
+	if err != nil {
+		return name_manager.Ticket{}, err
+	}
+
+	position, err := mbk.collection(db, ticketsCollection).
+		CountDocuments(ctx, bson.M{"family": family, "seq": bson.M{"$lt": seq}})
+	if err != nil {
+		return name_manager.Ticket{}, err
+	}
+
+	return name_manager.Ticket{
+		ID:        id,
+		Family:    family,
+		Position:  int(position),
+		CreatedAt: now.UTC(),
+		UpdatedAt: now.UTC(),
+	}, nil
+}
+
+func (mbk *mongoBackend) PollTicket(ctx context.Context, family, ticketID string, opts ...name_manager.AcquireOption) (name_manager.Lease, int, error) {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	if _, err := mbk.releaseZombies(ctx, db, family); err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+
+	ticketResult := mbk.collection(db, ticketsCollection).
+		FindOne(ctx, bson.M{"_id": mbk.ticketId(family, ticketID)})
+	if err := ticketResult.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return name_manager.Lease{}, 0, name_manager.ErrTicketExpired
+		}
+		return name_manager.Lease{}, 0, err
+	}
+	ticketDoc, err := ticketResult.DecodeBytes()
+	if err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	seq := ticketDoc.Lookup("seq").Int32()
+
+	position, err := mbk.collection(db, ticketsCollection).
+		CountDocuments(ctx, bson.M{"family": family, "seq": bson.M{"$lt": seq}})
+	if err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+
+	if position == 0 {
+		limit, err := mbk.familyLimit(ctx, db, family)
+		if err != nil {
+			return name_manager.Lease{}, 0, err
+		}
+		lease, err := mbk.acquireName(ctx, db, family, limit, mbk.acquireOptions(opts), false)
+		if err == nil {
+			_, err = mbk.collection(db, ticketsCollection).
+				DeleteOne(ctx, bson.M{"_id": mbk.ticketId(family, ticketID)})
+			return lease, 0, err
+		}
+		if err != name_manager.ErrFamilyFull && err != name_manager.ErrPoolExhausted {
+			return name_manager.Lease{}, 0, err
+		}
+	}
+
+	updateResult, err := mbk.collection(db, ticketsCollection).UpdateOne(
+		ctx,
+		bson.M{"_id": mbk.ticketId(family, ticketID)},
+		bson.M{"$set": bson.M{"lastHeartBeatDate": mbk.clock.Now()}})
+	if err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	if updateResult.MatchedCount == 0 {
+		return name_manager.Lease{}, 0, name_manager.ErrTicketExpired
+	}
+	return name_manager.Lease{}, int(position), nil
+}
+
+func (mbk *mongoBackend) CancelTicket(ctx context.Context, family, ticketID string) error {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	_, err = mbk.collection(db, ticketsCollection).
+		DeleteOne(ctx, bson.M{"_id": mbk.ticketId(family, ticketID)})
+	return err
+}
+
+func (mbk *mongoBackend) Queue(ctx context.Context, family string) ([]name_manager.Ticket, error) {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	if _, err := mbk.releaseZombies(ctx, db, family); err != nil {
+		return nil, err
+	}
+
+	result, err := mbk.collection(db, ticketsCollection).Find(
+		ctx,
+		bson.M{"family": family},
+		mongo_options.Find().SetSort(bson.M{"seq": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var tickets []name_manager.Ticket
+	for result.Next(ctx) {
+		if result.Err() != nil {
+			return nil, result.Err()
+		}
+
+		tickets = append(tickets, name_manager.Ticket{
+			ID:        strconv.Itoa(int(result.Current.Lookup("seq").Int32())),
+			Family:    family,
+			Position:  len(tickets),
+			CreatedAt: result.Current.Lookup("createdAt").Time().UTC(),
+			UpdatedAt: result.Current.Lookup("lastHeartBeatDate").Time().UTC(),
+		})
+	}
+	return tickets, nil
+}
+
+func (mbk *mongoBackend) SetFamilyLimit(ctx context.Context, family string, limit int) error {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	_, err = mbk.collection(db, familiesCollection).UpdateOne(
+		ctx,
+		bson.M{"family": family},
+		bson.M{"$set": bson.M{"limit": int32(limit)}},
+		mongo_options.Update().SetUpsert(true))
+	return err
+}
+
+func (mbk *mongoBackend) GetAttributes(ctx context.Context, family, name string) (map[string]string, error) {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	dataResult := mbk.collection(db, dataCollection).FindOne(
+		ctx,
+		bson.M{"family": family, "name": name})
+	if err := dataResult.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, name_manager.ErrNotExist
+		}
+		return nil, err
+	}
+	dataDoc, err := dataResult.DecodeBytes()
+	if err != nil {
+		return nil, err
+	}
+	return decodeAttributes(dataDoc)
+}
+
+func (mbk *mongoBackend) SetAttributes(ctx context.Context, family, name string, attributes map[string]string) error {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	set := bson.M{}
+	unset := bson.M{}
+	for key, value := range attributes {
+		if value == "" {
+			unset["attributes."+key] = ""
+		} else {
+			set["attributes."+key] = value
+		}
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		// Nothing to update, but the name must still exist.
+		_, err := mbk.GetAttributes(ctx, family, name)
+		return err
+	}
+	result, err := mbk.collection(db, dataCollection).UpdateOne(
+		ctx,
+		bson.M{"family": family, "name": name},
+		update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return name_manager.ErrNotExist
+	}
+	return nil
+}
+
+func (mbk *mongoBackend) Quarantine(ctx context.Context, family, name, reason string) error {
+	return mbk.quarantine(ctx, family, name, bson.M{
+		"$set": bson.M{"quarantine": name_manager.QuarantineReason(reason)},
+	})
+}
+
+func (mbk *mongoBackend) Unquarantine(ctx context.Context, family, name string) error {
+	return mbk.quarantine(ctx, family, name, bson.M{
+		"$unset": bson.M{"quarantine": ""},
+	})
+}
+
+// quarantine applies an update of the quarantine of a name to its data
+// document.
+func (mbk *mongoBackend) quarantine(ctx context.Context, family, name string, update bson.M) error {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	result, err := mbk.collection(db, dataCollection).UpdateOne(
+		ctx,
+		bson.M{"family": family, "name": name},
+		update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return name_manager.ErrNotExist
+	}
+	return nil
+}
+
+// selectorFilter returns the conditions on the data documents that
+// implement a selector.  As with Selector.Matches, "$ne" matches the
+// documents where the attribute is missing.
+func selectorFilter(selector name_manager.Selector) bson.A {
+	conditions := bson.A{}
+	for _, requirement := range selector {
+		field := "attributes." + requirement.Key
+		switch requirement.Operator {
+		case name_manager.Equals:
+			conditions = append(conditions, bson.M{field: requirement.Value})
+		case name_manager.NotEquals:
+			conditions = append(conditions, bson.M{field: bson.M{"$ne": requirement.Value}})
+		default:
+			panic(fmt.Sprintf("unexpected operator %s", requirement.Operator))
+		}
+	}
+	return conditions
+}
+
+// decodeAttributes decodes the attributes of a data document.
+func decodeAttributes(dataDoc bson.Raw) (map[string]string, error) {
+	attributesDocument, ok := dataDoc.Lookup("attributes").DocumentOK()
+	if !ok {
+		return nil, nil
+	}
+	var attributes map[string]string
+	if err := bson.Unmarshal(attributesDocument, &attributes); err != nil {
+		return nil, err
+	}
+	if len(attributes) == 0 {
+		return nil, nil
+	}
+	return attributes, nil
+}
+
+func (mbk *mongoBackend) SetNameGenerator(ctx context.Context, family string, generator name_manager.NameGenerator) error {
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	_, err = mbk.collection(db, familiesCollection).UpdateOne(
+		ctx,
+		bson.M{"family": family},
+		bson.M{"$set": bson.M{"generator": generator.Spec()}},
+		mongo_options.Update().SetUpsert(true))
+	return err
+}
+
+func (mbk *mongoBackend) DefinePool(ctx context.Context, family string, names []string) error {
+	pool, err := name_manager.NewPoolGenerator(names)
+	if err != nil {
+		return err
+	}
+
+	client, err := mbk.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(mbk.options.database)
+
+	result, err := mbk.collection(db, dataCollection).
+		Find(ctx, bson.M{"family": family})
+	if err != nil {
+		return err
+	}
+	for result.Next(ctx) {
+		if name := result.Current.Lookup("name").StringValue(); !pool.Contains(name) {
+			return fmt.Errorf("name '%s' of family '%s' is not in the pool", name, family)
+		}
+	}
+	if err := result.Err(); err != nil {
+		return err
+	}
+
+	token, err := mbk.tokenFloor(ctx, db, family)
+	if err != nil {
+		return err
+	}
+	now := mbk.clock.Now()
+	for _, name := range pool.Names {
+		_, err := mbk.collection(db, dataCollection).UpdateOne(
+			ctx,
+			bson.M{"family": family, "name": name},
+			bson.M{"$setOnInsert": bson.M{"createdAt": now, "token": token, "fresh": true}},
+			mongo_options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+
+	// All the names of the pool are registered: the generator must not
+	// generate any new name.
+	_, err = mbk.collection(db, countersCollection).UpdateOne(
+		ctx,
+		bson.M{"family": family},
+		bson.M{"$max": bson.M{"counter": int32(len(pool.Names))}},
+		mongo_options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	_, err = mbk.collection(db, familiesCollection).UpdateOne(
+		ctx,
+		bson.M{"family": family},
+		bson.M{"$set": bson.M{"generator": pool.Spec()}},
+		mongo_options.Update().SetUpsert(true))
+	return err
+}
+
+func (mbk *mongoBackend) client(ctx context.Context) (*mongo.Client, error) {
+	mongoConnectCtx, cancelConnect := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelConnect()
+	return mongo.Connect(mongoConnectCtx, mongo_options.Client().ApplyURI(mbk.options.uri))
+}
+
+func (mbk *mongoBackend) collection(db *mongo.Database, name string) *mongo.Collection {
+	return db.Collection(mbk.options.collectionPrefix + name)
+}
+
+func (mbk *mongoBackend) leaseId(family, name string) string {
+	return "_" + mbk.options.collectionPrefix + "lock_" + family + name
+}
+
+// leaseFilter returns the filter for the lease document of a lease.
+// If the lease has a token, the filter only matches the current lease
+// on the name.
+func (mbk *mongoBackend) leaseFilter(lease name_manager.Lease) bson.M {
+	filter := bson.M{
+		"_id":       mbk.leaseId(lease.Family, lease.Name),
+		"partition": lockDocumentPartition,
+	}
+	if lease.Token != 0 {
+		filter["token"] = lease.Token
+	}
+	return filter
+}
+
+// fence gives a new token to a name that was just leased, by atomically
+// incrementing the token counter in the data document of the name, and
+// records the token in the lease document.  The lease is created if the
+// name was never acquired before (see nextToken).  It fails with
+// mongo.ErrNoDocuments if the name does not exist, and with ErrLeaseLost
+// if the lease document is gone or was replaced by a more recent lease
+// in the meantime.
+func (mbk *mongoBackend) fence(ctx context.Context, db *mongo.Database, family, name string) (name_manager.Lease, error) {
+	token, fresh, err := mbk.nextToken(ctx, db, family, name)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+
+	// The token of a lease document is only raised: a more recent lease
+	// keeps its token.
+	updateResult, err := mbk.collection(db, leasedNamesCollection).UpdateOne(
+		ctx,
+		bson.M{
+			"_id":   mbk.leaseId(family, name),
+			"token": bson.M{"$not": bson.M{"$gte": token}},
+		},
+		bson.M{"$set": bson.M{"token": token}})
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	if updateResult.MatchedCount != 1 {
+		return name_manager.Lease{}, name_manager.ErrLeaseLost
+	}
+	return name_manager.Lease{Family: family, Name: name, Token: token, Created: fresh}, nil
+}
+
+// nextToken reserves a new token for a name, by atomically incrementing
+// the token counter in the data document of the name.  It also returns
+// whether the name was fresh, i.e., registered but never acquired
+// before, and clears this flag.  It fails with mongo.ErrNoDocuments if
+// the name does not exist.
+func (mbk *mongoBackend) nextToken(ctx context.Context, db *mongo.Database, family, name string) (int64, bool, error) {
+	dataResult := mbk.collection(db, dataCollection).FindOneAndUpdate(
+		ctx,
+		bson.M{"family": family, "name": name},
+		bson.M{
+			"$inc":   bson.M{"token": int64(1)},
+			"$unset": bson.M{"fresh": ""},
+		},
+		mongo_options.FindOneAndUpdate().SetReturnDocument(mongo_options.Before))
+	if err := dataResult.Err(); err != nil {
+		return 0, false, err
+	}
+	dataDoc, err := dataResult.DecodeBytes()
+	if err != nil {
+		return 0, false, err
+	}
+	token, _ := dataDoc.Lookup("token").Int64OK()
+	fresh, _ := dataDoc.Lookup("fresh").BooleanOK()
+	return token + 1, fresh, nil
+}
+
+func (mbk *mongoBackend) ticketId(family, ticketID string) string {
+	return "_" + mbk.options.collectionPrefix + "ticket_" + family + ":" + ticketID
+}
+
+// familyLimit returns the maximum number of names for a family, or
+// zero if there is no limit.
+func (mbk *mongoBackend) familyLimit(ctx context.Context, db *mongo.Database, family string) (int, error) {
+	result := mbk.collection(db, familiesCollection).FindOne(ctx, bson.M{"family": family})
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return mbk.options.familyLimit, nil
+		}
+		return 0, err
+	}
+	familyDoc, err := result.DecodeBytes()
+	if err != nil {
+		return 0, err
+	}
+	if limit, ok := familyDoc.Lookup("limit").Int32OK(); ok && limit > 0 {
+		return int(limit), nil
+	}
+	return mbk.options.familyLimit, nil
+}
+
+// familyGenerator returns the name generator of a family.
+func (mbk *mongoBackend) familyGenerator(ctx context.Context, db *mongo.Database, family string) (name_manager.NameGenerator, error) {
+	result := mbk.collection(db, familiesCollection).FindOne(ctx, bson.M{"family": family})
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return name_manager.ParseNameGenerator("")
+		}
+		return nil, err
+	}
+	familyDoc, err := result.DecodeBytes()
+	if err != nil {
+		return nil, err
+	}
+	spec, _ := familyDoc.Lookup("generator").StringValueOK()
+	return name_manager.ParseNameGenerator(spec)
+}
+
+// releaseZombies releases the names of a family that were not kept alive
+// during their TTL, and expires the tickets of the family that were not
+// polled.  It returns the leases that were released.
+func (mbk *mongoBackend) releaseZombies(ctx context.Context, db *mongo.Database, family string) ([]name_manager.Lease, error) {
+	now := mbk.clock.Now()
+
+	// The TTL of the leases is compared client-side, as the documents
+	// cannot be filtered on a field computed from other fields without
+	// aggregation expressions.
+	result, err := mbk.collection(db, leasedNamesCollection).
+		Find(ctx, bson.M{
+			"family": family,
+			// The names that are being transferred wait for their claim.
+			"claim": bson.M{"$exists": false},
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close(ctx)
+	var released []name_manager.Lease
+	for result.Next(ctx) {
+		// The leases acquired without a TTL get the default one.
+		ttl := mbk.options.autoReleaseAfter
+		if ttlMillis, ok := result.Current.Lookup("ttl").Int64OK(); ok {
+			ttl = time.Duration(ttlMillis) * time.Millisecond
+		}
+		lastHeartBeatDate := result.Current.Lookup("lastHeartBeatDate").Time()
+		if ttl <= 0 || now.Sub(lastHeartBeatDate) <= ttl {
+			continue
+		}
+		id := result.Current.Lookup("_id").StringValue()
+		// The name is not released if it was kept alive in the meantime.
+		deleteResult, err := mbk.collection(db, leasedNamesCollection).
+			DeleteOne(ctx, bson.M{
+				"_id":               id,
+				"lastHeartBeatDate": lastHeartBeatDate,
+				"claim":             bson.M{"$exists": false},
+			})
+		if err != nil {
+			return nil, err
+		}
+		if deleteResult.DeletedCount == 0 {
+			continue
+		}
+		name, ok := result.Current.Lookup("name").StringValueOK()
+		if !ok {
+			// The leases acquired by older versions have no name field.
+			name = strings.TrimPrefix(id, mbk.leaseId(family, ""))
+		}
+		token, _ := result.Current.Lookup("token").Int64OK()
+		released = append(released, name_manager.Lease{Family: family, Name: name, Token: token})
+	}
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	if n := len(released); n > 0 {
+		fmt.Fprintf(os.Stderr, "Released %d zombies\n", n)
+	}
+
+	if mbk.options.autoReleaseAfter > 0 {
+		_, err = mbk.collection(db, ticketsCollection).
+			DeleteMany(ctx, bson.M{
+				"lastHeartBeatDate": bson.M{"$lt": now.Add(-mbk.options.autoReleaseAfter)},
+				"family":            family,
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return released, nil
+}
+
+// acquireOptions applies acquisition options, and resolves the TTL of
+// the lease.
+func (mbk *mongoBackend) acquireOptions(opts []name_manager.AcquireOption) *name_manager.AcquireOptions {
+	options := name_manager.NewAcquireOptions(opts...)
+	options.TTL = options.LeaseTTL(mbk.options.autoReleaseAfter, mbk.options.maxTTL)
+	return options
 }
 
 func (mbk *mongoBackend) hold() *hold.Hold {
 	return &hold.Hold{
-		Manager:           mbk,
-		Clock:             mbk.clock,
-		KeepAliveInterval: mbk.options.autoReleaseAfter / 3,
+		Manager: mbk,
+		Clock:   mbk.clock,
+		KeepAlivePolicy: mbk.options.keepAlive.Merge(
+			name_manager.DefaultKeepAlivePolicy(0)),
+		DefaultTTL:   mbk.options.autoReleaseAfter,
+		MaxTTL:       mbk.options.maxTTL,
+		PollInterval: mbk.options.pollInterval,
 	}
 }
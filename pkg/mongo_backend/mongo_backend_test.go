@@ -72,6 +72,76 @@ func TestTryHold(t *testing.T) {
 	testutil.TestTryHold(t, mng, mockClock)
 }
 
+func TestContextCancellation(t *testing.T) {
+	testutil.TestContextCancellation(t, createTestNameManager(t))
+}
+
+func TestFamilyLimit(t *testing.T) {
+	testutil.TestFamilyLimit(t, createTestNameManager(t))
+}
+
+func TestAcquireWait(t *testing.T) {
+	testutil.TestAcquireWait(t, createTestNameManager(t, "pollInterval=10ms"))
+}
+
+func TestQueue(t *testing.T) {
+	testutil.TestQueue(t, createTestNameManager(t))
+}
+
+func TestLease(t *testing.T) {
+	testutil.TestLease(t, createTestNameManager(t))
+}
+
+func TestLabels(t *testing.T) {
+	testutil.TestLabels(t, createTestNameManager(t))
+}
+
+func TestAttributes(t *testing.T) {
+	testutil.TestAttributes(t, createTestNameManager(t))
+}
+
+func TestSelector(t *testing.T) {
+	testutil.TestSelector(t, createTestNameManager(t))
+}
+
+func TestNameGenerator(t *testing.T) {
+	testutil.TestNameGenerator(t, createTestNameManager(t))
+}
+
+func TestPool(t *testing.T) {
+	testutil.TestPool(t, createTestNameManager(t))
+}
+
+func TestAcquireMany(t *testing.T) {
+	testutil.TestAcquireMany(t, createTestNameManager(t))
+}
+
+func TestTransfer(t *testing.T) {
+	testutil.TestTransfer(t, createTestNameManager(t))
+}
+
+func TestQuarantine(t *testing.T) {
+	testutil.TestQuarantine(t, createTestNameManager(t))
+}
+
+func TestDelete(t *testing.T) {
+	testutil.TestDelete(t, createTestNameManager(t))
+}
+
+func TestTTL(t *testing.T) {
+	mng := createTestNameManager(t, "autoReleaseAfter=5s", "maxTTL=20s")
+	mockClock := clock.NewMock()
+	mng.(*mongoBackend).clock = mockClock
+	testutil.TestTTL(t, mng, mockClock)
+}
+
+func TestReap(t *testing.T) {
+	mng := createTestNameManager(t, "autoReleaseAfter=5s")
+	mockClock := clock.NewMock()
+	mng.(*mongoBackend).clock = mockClock
+	testutil.TestReap(t, mng, mockClock)
+}
+
 func createTestNameManager(t *testing.T, options ...string) name_manager.NameManager {
 	uri := os.Getenv("MONGODB_URI")
 	//uri := "mongodb://127.0.0.1:27017"
@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// ClaimTicket is a one-time ticket to take over a lease from another
+// process (see NameManager.Transfer).
+type ClaimTicket struct {
+	// Lease is the lease that is transferred.
+	Lease
+
+	// Secret authenticates the ticket.
+	Secret string
+}
+
+// NewClaimTicket creates a ticket with a random secret.  It is used by
+// the backends to implement Transfer.
+func NewClaimTicket(lease Lease) (ClaimTicket, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ClaimTicket{}, err
+	}
+	return ClaimTicket{Lease: lease, Secret: hex.EncodeToString(b)}, nil
+}
+
+// claimTicketJSON is the JSON serialization of a claim ticket.
+type claimTicketJSON struct {
+	Family string `json:"f"`
+	Name   string `json:"n"`
+	Token  int64  `json:"t"`
+	Secret string `json:"s"`
+}
+
+// String serializes the ticket into an opaque string that can be passed
+// around, e.g., between CI jobs, and parsed with ParseClaimTicket.
+func (t ClaimTicket) String() string {
+	b, err := json.Marshal(claimTicketJSON{
+		Family: t.Family,
+		Name:   t.Name,
+		Token:  t.Token,
+		Secret: t.Secret,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseClaimTicket parses a ticket serialized with ClaimTicket.String.
+func ParseClaimTicket(s string) (ClaimTicket, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ClaimTicket{}, fmt.Errorf("malformed claim ticket: %v", err)
+	}
+	var t claimTicketJSON
+	if err := json.Unmarshal(b, &t); err != nil {
+		return ClaimTicket{}, fmt.Errorf("malformed claim ticket: %v", err)
+	}
+	if t.Family == "" || t.Name == "" || t.Token <= 0 || t.Secret == "" {
+		return ClaimTicket{}, fmt.Errorf("malformed claim ticket: missing fields")
+	}
+	return ClaimTicket{
+		Lease:  Lease{Family: t.Family, Name: t.Name, Token: t.Token},
+		Secret: t.Secret,
+	}, nil
+}
@@ -0,0 +1,31 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimTicket(t *testing.T) {
+	ticket, err := NewClaimTicket(Lease{Family: "stack", Name: "0", Token: 3})
+	assert.NoError(t, err)
+	assert.Len(t, ticket.Secret, 32)
+
+	parsed, err := ParseClaimTicket(ticket.String())
+	assert.NoError(t, err)
+	assert.Equal(t, ticket, parsed)
+
+	other, err := NewClaimTicket(ticket.Lease)
+	assert.NoError(t, err)
+	assert.NotEqual(t, ticket.Secret, other.Secret)
+
+	_, err = ParseClaimTicket("__invalid__")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "malformed claim ticket")
+
+	_, err = ParseClaimTicket(ClaimTicket{Lease: ticket.Lease}.String())
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"context"
+	"sync"
+)
+
+// CancelCauseFunc cancels a context created by WithCancelCause, and
+// records the cause of the cancellation.  Only the first call records a
+// cause.  A nil cause is recorded as context.Canceled.
+type CancelCauseFunc func(cause error)
+
+// WithCancelCause is like context.WithCancel, except that the cancel
+// function records the cause of the cancellation, as returned by Cause.
+func WithCancelCause(parent context.Context) (context.Context, CancelCauseFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	c := &cancelCauseCtx{Context: ctx}
+	return c, func(cause error) {
+		if cause == nil {
+			cause = context.Canceled
+		}
+		c.mu.Lock()
+		if c.cause == nil && ctx.Err() == nil {
+			c.cause = cause
+		}
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// Cause returns why a context is done.  For the contexts created by
+// WithCancelCause, and the contexts derived from them, this is the cause
+// given to the cancel function, e.g., an error wrapping ErrLeaseLost for
+// the context of a holding.  Otherwise, this is the error of the context.
+// Cause returns nil if the context is not done.
+func Cause(ctx context.Context) error {
+	c, ok := ctx.Value(causeKey{}).(*cancelCauseCtx)
+	if !ok || c.Context.Err() == nil {
+		// ctx is done for another reason, or not done at all.
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	cause := c.cause
+	c.mu.Unlock()
+	if cause == nil {
+		// The parent context of c is done.
+		return Cause(c.Context)
+	}
+	return cause
+}
+
+// causeKey is the context key under which a cancelCauseCtx can find
+// itself.
+type causeKey struct{}
+
+// cancelCauseCtx is a context created by WithCancelCause.
+type cancelCauseCtx struct {
+	context.Context
+	mu    sync.Mutex
+	cause error
+}
+
+func (c *cancelCauseCtx) Value(key interface{}) interface{} {
+	if key == (causeKey{}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCause(t *testing.T) {
+	ctx, cancel := WithCancelCause(context.Background())
+	assert.NoError(t, Cause(ctx))
+
+	cause := errors.New("cause")
+	cancel(cause)
+	cancel(errors.New("ignored"))
+	assert.Equal(t, context.Canceled, ctx.Err())
+	assert.Equal(t, cause, Cause(ctx))
+
+	// The cause is inherited...
+	derived, derivedCancel := context.WithCancel(ctx)
+	defer derivedCancel()
+	assert.Equal(t, cause, Cause(derived))
+
+	// ... unless the derived context is done for another reason.
+	ctx, cancel = WithCancelCause(context.Background())
+	defer cancel(nil)
+	derived, derivedCancel = context.WithTimeout(ctx, time.Nanosecond)
+	defer derivedCancel()
+	<-derived.Done()
+	assert.Equal(t, context.DeadlineExceeded, Cause(derived))
+
+	// When the parent is done, the cause is the one of the parent.
+	parent, parentCancel := WithCancelCause(context.Background())
+	ctx, cancel = WithCancelCause(parent)
+	defer cancel(nil)
+	parentCancel(cause)
+	<-ctx.Done()
+	assert.Equal(t, cause, Cause(ctx))
+
+	ctx, cancel = WithCancelCause(context.Background())
+	cancel(nil)
+	assert.Equal(t, context.Canceled, Cause(ctx))
+}
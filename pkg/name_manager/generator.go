@@ -0,0 +1,345 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// NameGenerator generates the names of a family.  The generator of a
+// family is set with NameManager.SetNameGenerator and persisted by the
+// backend, as a specification, so that all the clients agree on the
+// names.
+type NameGenerator interface {
+	// Generate generates the n-th name of a family, starting at zero.
+	// Random generators may ignore n.  The backends skip the names
+	// that are already registered.
+	Generate(n int) (string, error)
+
+	// Spec returns the specification of the generator, as parsed by
+	// ParseNameGenerator.
+	Spec() string
+}
+
+// NameGeneratorKind describes a kind of name generators.
+type NameGeneratorKind struct {
+	// Kind is the kind of the generators.  If the kind is "foo",
+	// specifications starting with "foo", such as "foo" or "foo:bar",
+	// give generators created with CreateNameGenerator.
+	Kind string
+
+	// Description holds a human-readable description of the kind.
+	// This description should specify, among other things, the format
+	// for the argument.
+	Description string
+
+	// CreateNameGenerator creates a generator from the argument of a
+	// specification.  For instance, if `ParseNameGenerator("foo:bar")`
+	// is called, the argument passed to this function is "bar".
+	CreateNameGenerator func(arg string) (NameGenerator, error)
+}
+
+// DefaultNameGenerator is the specification of the name generator of
+// the families for which no generator was set: names are "0", "1", ...
+const DefaultNameGenerator = "counter"
+
+// NameGenerationAttempts is the number of names the backends generate
+// before giving up when the generated names are already registered.
+const NameGenerationAttempts = 16
+
+// NameIndex returns the index n, lower than count, for which a generator
+// generates a name, or -1 if there is no such index, e.g., for random
+// generators.  It is used by the backends to recycle the names that are
+// deleted (see WithRecycle).
+func NameIndex(generator NameGenerator, name string, count int) int {
+	for n := 0; n < count; n++ {
+		generated, err := generator.Generate(n)
+		if err != nil {
+			return -1
+		}
+		if generated == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// InsertIndex inserts an index in a sorted list of indexes, if it is not
+// already there.
+func InsertIndex(indexes []int, n int) []int {
+	i := sort.SearchInts(indexes, n)
+	if i < len(indexes) && indexes[i] == n {
+		return indexes
+	}
+	indexes = append(indexes, 0)
+	copy(indexes[i+1:], indexes[i:])
+	indexes[i] = n
+	return indexes
+}
+
+// nameGeneratorKinds holds the kinds of name generators registered with
+// `RegisterNameGeneratorKind`.
+var nameGeneratorKinds = make(map[string]NameGeneratorKind)
+
+// RegisterNameGeneratorKind registers a kind of name generators.  Name
+// generators cannot be parsed with ParseNameGenerator unless their kind
+// is registered with this function.  As name generators are parsed by
+// all the clients of a backend, custom kinds must be registered by all
+// of them.
+func RegisterNameGeneratorKind(kind NameGeneratorKind) {
+	if _, ok := nameGeneratorKinds[kind.Kind]; ok {
+		panic(fmt.Sprintf("name generator kind '%s' is already registered", kind.Kind))
+	}
+	nameGeneratorKinds[kind.Kind] = kind
+}
+
+// ParseNameGenerator parses the specification of a name generator, in
+// the "<kind>" or "<kind>:<arg>" format.  The empty specification gives
+// the default generator (see DefaultNameGenerator).
+func ParseNameGenerator(spec string) (NameGenerator, error) {
+	if spec == "" {
+		spec = DefaultNameGenerator
+	}
+	kindName := spec
+	arg := ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kindName = spec[:i]
+		arg = spec[i+1:]
+	}
+	kind, ok := nameGeneratorKinds[kindName]
+	if !ok {
+		return nil, fmt.Errorf("name generator kind '%s' has not been registered", kindName)
+	}
+	generator, err := kind.CreateNameGenerator(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name generator '%s': %v", spec, err)
+	}
+	return generator, nil
+}
+
+// ValidateName checks that a name can be stored by all the backends.
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if strings.ContainsAny(name, ":/ \t\n") {
+		return fmt.Errorf("invalid name '%s': names cannot contain ':', '/' or whitespace", name)
+	}
+	return nil
+}
+
+func init() {
+	RegisterNameGeneratorKind(NameGeneratorKind{
+		Kind: "counter",
+		Description: `Generates names from a counter.
+
+The argument is an optional printf-like template with one integer verb,
+e.g., "ci-stack-%03d" gives "ci-stack-000", "ci-stack-001", ...  Without
+a template, the names are "0", "1", ...`,
+		CreateNameGenerator: newCounterGenerator,
+	})
+	RegisterNameGeneratorKind(NameGeneratorKind{
+		Kind: "pool",
+		Description: `Generates names from a fixed list.
+
+The argument is the comma-separated list of names, e.g., "host-a,host-b".
+Once all the names of the list are registered and in use, the pool is
+exhausted.`,
+		CreateNameGenerator: func(arg string) (NameGenerator, error) {
+			pool, err := NewPoolGenerator(strings.Split(arg, ","))
+			if err != nil {
+				return nil, err
+			}
+			return pool, nil
+		},
+	})
+	RegisterNameGeneratorKind(NameGeneratorKind{
+		Kind: "pronounceable",
+		Description: `Generates random pronounceable names, e.g., "bakolu-tefari".
+
+The argument is an optional prefix.`,
+		CreateNameGenerator: newPronounceableGenerator,
+	})
+	RegisterNameGeneratorKind(NameGeneratorKind{
+		Kind: "uuid",
+		Description: `Generates random (version 4) UUIDs.
+
+The argument is an optional prefix.`,
+		CreateNameGenerator: newUUIDGenerator,
+	})
+}
+
+// counterGenerator generates names from a counter and a template.
+type counterGenerator struct {
+	template string
+}
+
+func newCounterGenerator(template string) (NameGenerator, error) {
+	if template == "" {
+		return &counterGenerator{}, nil
+	}
+	if strings.Count(template, "%")-2*strings.Count(template, "%%") != 1 {
+		return nil, fmt.Errorf("expected exactly one integer verb in the template")
+	}
+	generator := &counterGenerator{template: template}
+	name, err := generator.Generate(0)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(name, "%!") {
+		return nil, fmt.Errorf("expected exactly one integer verb in the template")
+	}
+	return generator, nil
+}
+
+func (g *counterGenerator) Generate(n int) (string, error) {
+	if g.template == "" {
+		return fmt.Sprintf("%d", n), nil
+	}
+	name := fmt.Sprintf(g.template, n)
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (g *counterGenerator) Spec() string {
+	if g.template == "" {
+		return "counter"
+	}
+	return "counter:" + g.template
+}
+
+// PoolGenerator generates names from a fixed list.
+type PoolGenerator struct {
+	// Names are the names of the pool, in generation order.
+	Names []string
+}
+
+// NewPoolGenerator creates a generator for a pool of names.
+func NewPoolGenerator(names []string) (*PoolGenerator, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("empty pool")
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if err := ValidateName(name); err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate name '%s'", name)
+		}
+		seen[name] = true
+	}
+	return &PoolGenerator{Names: names}, nil
+}
+
+func (g *PoolGenerator) Generate(n int) (string, error) {
+	if n >= len(g.Names) {
+		return "", ErrPoolExhausted
+	}
+	return g.Names[n], nil
+}
+
+func (g *PoolGenerator) Spec() string {
+	return "pool:" + strings.Join(g.Names, ",")
+}
+
+// Contains returns whether a name is a member of the pool.
+func (g *PoolGenerator) Contains(name string) bool {
+	for _, member := range g.Names {
+		if member == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPoolMember returns whether a name is a member of the pool of its
+// family, given the specification of the name generator of the family.
+func IsPoolMember(generatorSpec, name string) bool {
+	generator, err := ParseNameGenerator(generatorSpec)
+	if err != nil {
+		return false
+	}
+	pool, ok := generator.(*PoolGenerator)
+	return ok && pool.Contains(name)
+}
+
+// pronounceableGenerator generates random pronounceable names.
+type pronounceableGenerator struct {
+	prefix string
+}
+
+func newPronounceableGenerator(prefix string) (NameGenerator, error) {
+	if prefix != "" {
+		if err := ValidateName(prefix); err != nil {
+			return nil, err
+		}
+	}
+	return &pronounceableGenerator{prefix: prefix}, nil
+}
+
+const (
+	consonants = "bdfghklmnprstvz"
+	vowels     = "aeiou"
+)
+
+func (g *pronounceableGenerator) Generate(n int) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var name strings.Builder
+	name.WriteString(g.prefix)
+	for i := 0; i < len(b); i += 2 {
+		if i == len(b)/2 {
+			name.WriteByte('-')
+		}
+		name.WriteByte(consonants[int(b[i])%len(consonants)])
+		name.WriteByte(vowels[int(b[i+1])%len(vowels)])
+	}
+	return name.String(), nil
+}
+
+func (g *pronounceableGenerator) Spec() string {
+	if g.prefix == "" {
+		return "pronounceable"
+	}
+	return "pronounceable:" + g.prefix
+}
+
+// uuidGenerator generates random UUIDs.
+type uuidGenerator struct {
+	prefix string
+}
+
+func newUUIDGenerator(prefix string) (NameGenerator, error) {
+	if prefix != "" {
+		if err := ValidateName(prefix); err != nil {
+			return nil, err
+		}
+	}
+	return &uuidGenerator{prefix: prefix}, nil
+}
+
+func (g *uuidGenerator) Generate(n int) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // Variant 10
+	return fmt.Sprintf("%s%x-%x-%x-%x-%x", g.prefix, b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func (g *uuidGenerator) Spec() string {
+	if g.prefix == "" {
+		return "uuid"
+	}
+	return "uuid:" + g.prefix
+}
@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterGenerator(t *testing.T) {
+	generator, err := ParseNameGenerator("")
+	assert.NoError(t, err)
+	assert.Equal(t, "counter", generator.Spec())
+	name, err := generator.Generate(12)
+	assert.NoError(t, err)
+	assert.Equal(t, "12", name)
+
+	generator, err = ParseNameGenerator("counter:ci-stack-%03d")
+	assert.NoError(t, err)
+	assert.Equal(t, "counter:ci-stack-%03d", generator.Spec())
+	name, err = generator.Generate(3)
+	assert.NoError(t, err)
+	assert.Equal(t, "ci-stack-003", name)
+
+	for _, spec := range []string{"counter:ci-stack", "counter:%d-%d", "counter:%s", "counter:a/%d"} {
+		_, err = ParseNameGenerator(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestPoolGenerator(t *testing.T) {
+	generator, err := ParseNameGenerator("pool:host-a,host-b")
+	assert.NoError(t, err)
+	assert.Equal(t, "pool:host-a,host-b", generator.Spec())
+	name, err := generator.Generate(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "host-b", name)
+	_, err = generator.Generate(2)
+	assert.Equal(t, ErrPoolExhausted, err)
+
+	assert.True(t, IsPoolMember("pool:host-a,host-b", "host-b"))
+	assert.False(t, IsPoolMember("pool:host-a,host-b", "host-c"))
+	assert.False(t, IsPoolMember("counter", "0"))
+
+	_, err = ParseNameGenerator("pool:host-a,host-a")
+	assert.Error(t, err)
+	_, err = ParseNameGenerator("pool:")
+	assert.Error(t, err)
+}
+
+func TestRandomGenerators(t *testing.T) {
+	generator, err := ParseNameGenerator("pronounceable:ci-")
+	assert.NoError(t, err)
+	assert.Equal(t, "pronounceable:ci-", generator.Spec())
+	name, err := generator.Generate(0)
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^ci-[a-z]{6}-[a-z]{6}$`), name)
+
+	generator, err = ParseNameGenerator("uuid")
+	assert.NoError(t, err)
+	assert.Equal(t, "uuid", generator.Spec())
+	name, err = generator.Generate(0)
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), name)
+	other, err := generator.Generate(0)
+	assert.NoError(t, err)
+	assert.NotEqual(t, name, other)
+}
+
+func TestUnknownGenerator(t *testing.T) {
+	_, err := ParseNameGenerator("foo:bar")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "has not been registered")
+}
+
+func TestNameIndex(t *testing.T) {
+	generator, err := ParseNameGenerator("counter:ci-stack-%03d")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, NameIndex(generator, "ci-stack-003", 5))
+	assert.Equal(t, -1, NameIndex(generator, "ci-stack-003", 3))
+	assert.Equal(t, -1, NameIndex(generator, "foo", 5))
+
+	generator, err = ParseNameGenerator("pool:host-a,host-b")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, NameIndex(generator, "host-b", 2))
+	assert.Equal(t, -1, NameIndex(generator, "host-c", 5))
+
+	assert.Equal(t, []int{1}, InsertIndex(nil, 1))
+	assert.Equal(t, []int{0, 1, 3}, InsertIndex([]int{0, 3}, 1))
+	assert.Equal(t, []int{0, 3, 4}, InsertIndex([]int{0, 3}, 4))
+	assert.Equal(t, []int{0, 3}, InsertIndex([]int{0, 3}, 3))
+}
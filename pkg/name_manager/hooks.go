@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// HookFunc is a lifecycle hook, run on the lease of a name.
+type HookFunc func(ctx context.Context, lease Lease) error
+
+// Hooks are the lifecycle hooks of the names of a family, run by Hold
+// and its variants (see WithHooks), e.g., to provision a resource when
+// a name is created, and to clean it after use.  The hooks that are nil
+// are skipped.
+type Hooks struct {
+	// OnCreate is run before handing out a brand-new name, i.e., a name
+	// that is acquired for the first time (see Lease.Created).
+	OnCreate HookFunc
+
+	// OnAcquire is run before handing out a name that was used before,
+	// e.g., to truncate the tables of a database.
+	OnAcquire HookFunc
+
+	// OnRelease is run after use, before the name is released.  It is
+	// not run when the lease on the name was lost.
+	OnRelease HookFunc
+
+	// OnDestroy is run when the resource of a name must be torn down,
+	// e.g., when the name is garbage-collected.
+	OnDestroy HookFunc
+}
+
+// HookError is the error returned when a lifecycle hook fails.
+type HookError struct {
+	// Hook is the name of the hook, e.g., "onAcquire".
+	Hook string
+	// Lease is the lease the hook was run on.
+	Lease Lease
+	// Err is the error returned by the hook.
+	Err error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook failed for %s:%s: %v", e.Hook, e.Lease.Family, e.Lease.Name, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// RunHook runs a lifecycle hook, named hook, on a lease.  When the hook
+// fails, the name is quarantined, so that it is not handed out again,
+// and a *HookError is returned.  A nil hook is skipped.
+func RunHook(ctx context.Context, mng NameManager, hook string, fn HookFunc, lease Lease) error {
+	if fn == nil {
+		return nil
+	}
+	err := fn(ctx, lease)
+	if err == nil {
+		return nil
+	}
+	hookErr := &HookError{Hook: hook, Lease: lease, Err: err}
+	if qErr := mng.Quarantine(ctx, lease.Family, lease.Name, hookErr.Error()); qErr != nil {
+		return fmt.Errorf("%v (cannot quarantine name: %v)", hookErr, qErr)
+	}
+	return hookErr
+}
+
+// CommandHook gives a hook that runs a shell command.  The family, the
+// name and the lease token are given to the command in the
+// NAME_MANAGER_FAMILY, NAME_MANAGER_NAME and NAME_MANAGER_TOKEN
+// environment variables.  The output of the command goes to stderr, so
+// that it does not mix with the output of name_manager.
+func CommandHook(command string) HookFunc {
+	return func(ctx context.Context, lease Lease) error {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"NAME_MANAGER_FAMILY="+lease.Family,
+			"NAME_MANAGER_NAME="+lease.Name,
+			"NAME_MANAGER_TOKEN="+strconv.FormatInt(lease.Token, 10))
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+}
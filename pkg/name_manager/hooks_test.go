@@ -0,0 +1,40 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunHook(t *testing.T) {
+	mng := &testNameManager{}
+	lease := Lease{Family: "foo", Name: "bar", Token: 1}
+
+	assert.NoError(t, RunHook(context.Background(), mng, "onCreate", nil, lease))
+	assert.NoError(t, RunHook(context.Background(), mng, "onCreate", func(ctx context.Context, lease Lease) error {
+		return nil
+	}, lease))
+	assert.Equal(t, "", mng.quarantine)
+
+	err := RunHook(context.Background(), mng, "onAcquire", func(ctx context.Context, lease Lease) error {
+		return errors.New("cannot clean")
+	}, lease)
+	var hookErr *HookError
+	assert.True(t, errors.As(err, &hookErr))
+	assert.Equal(t, "onAcquire", hookErr.Hook)
+	assert.Equal(t, lease, hookErr.Lease)
+	assert.Equal(t, "onAcquire hook failed for foo:bar: cannot clean", mng.quarantine)
+}
+
+func TestCommandHook(t *testing.T) {
+	lease := Lease{Family: "foo", Name: "bar", Token: 3}
+	assert.NoError(t, CommandHook(
+		`test "$NAME_MANAGER_FAMILY:$NAME_MANAGER_NAME:$NAME_MANAGER_TOKEN" = foo:bar:3`,
+	)(context.Background(), lease))
+	assert.Error(t, CommandHook("exit 1")(context.Background(), lease))
+}
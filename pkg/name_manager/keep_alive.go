@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeepAlivePolicy configures how held names are kept alive.  The zero
+// value of a field means that the value is inherited (see Merge).
+type KeepAlivePolicy struct {
+	// Interval is the interval between two keep-alives.  A zero interval
+	// disables the keep-alive.
+	Interval time.Duration
+
+	// Jitter is the fraction of the interval by which the interval is
+	// randomly shortened or lengthened, between 0 and 1.  It spreads the
+	// keep-alives of concurrent holders.
+	Jitter float64
+
+	// RetryDelay is the delay before retrying a failed keep-alive.  The
+	// delay doubles after each consecutive failure.
+	RetryDelay time.Duration
+
+	// MaxRetryDelay caps the delay between two retries.  Zero means no
+	// cap.
+	MaxRetryDelay time.Duration
+
+	// MaxFailures is the number of consecutive failed keep-alives after
+	// which the keep-alive gives up.
+	MaxFailures int
+
+	// Deadline is the time after which a name that was not kept alive
+	// can be released on behalf of its holder, typically the
+	// autoReleaseAfter option of the backend.  The keep-alive gives up,
+	// with an error wrapping ErrLeaseLost, rather than retrying past the
+	// deadline.  Zero means no deadline.
+	Deadline time.Duration
+}
+
+// DefaultKeepAlivePolicy gives the keep-alive policy for names that are
+// automatically released after autoReleaseAfter: three keep-alives per
+// period, with three attempts each.
+func DefaultKeepAlivePolicy(autoReleaseAfter time.Duration) KeepAlivePolicy {
+	return KeepAlivePolicy{
+		Interval:    autoReleaseAfter / 3,
+		RetryDelay:  200 * time.Millisecond,
+		MaxFailures: 3,
+		Deadline:    autoReleaseAfter,
+	}
+}
+
+// Merge returns the policy with its zero fields set to the ones of
+// defaults.
+func (p KeepAlivePolicy) Merge(defaults KeepAlivePolicy) KeepAlivePolicy {
+	if p.Interval == 0 {
+		p.Interval = defaults.Interval
+	}
+	if p.Jitter == 0 {
+		p.Jitter = defaults.Jitter
+	}
+	if p.RetryDelay == 0 {
+		p.RetryDelay = defaults.RetryDelay
+	}
+	if p.MaxRetryDelay == 0 {
+		p.MaxRetryDelay = defaults.MaxRetryDelay
+	}
+	if p.MaxFailures == 0 {
+		p.MaxFailures = defaults.MaxFailures
+	}
+	if p.Deadline == 0 {
+		p.Deadline = defaults.Deadline
+	}
+	return p
+}
+
+// NextInterval gives the time to wait before the next keep-alive, with
+// jitter.
+func (p KeepAlivePolicy) NextInterval() time.Duration {
+	if p.Jitter <= 0 {
+		return p.Interval
+	}
+	return time.Duration(float64(p.Interval) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// NextRetryDelay gives the time to wait before retrying a keep-alive
+// after the given number of consecutive failures.
+func (p KeepAlivePolicy) NextRetryDelay(failures int) time.Duration {
+	delay := p.RetryDelay
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if p.MaxRetryDelay > 0 && delay >= p.MaxRetryDelay {
+			break
+		}
+	}
+	if p.MaxRetryDelay > 0 && delay > p.MaxRetryDelay {
+		delay = p.MaxRetryDelay
+	}
+	return delay
+}
+
+// SetOption sets a field of the policy from a backend URL option.  The
+// options are keepAliveInterval, keepAliveJitter, keepAliveRetryDelay,
+// keepAliveMaxRetryDelay, keepAliveMaxFailures and keepAliveDeadline.
+// It returns false if the option is not a keep-alive option.
+func (p *KeepAlivePolicy) SetOption(key, value string) (bool, error) {
+	var duration *time.Duration
+	switch key {
+	case "keepAliveInterval":
+		duration = &p.Interval
+	case "keepAliveRetryDelay":
+		duration = &p.RetryDelay
+	case "keepAliveMaxRetryDelay":
+		duration = &p.MaxRetryDelay
+	case "keepAliveDeadline":
+		duration = &p.Deadline
+
+	case "keepAliveJitter":
+		jitter, err := strconv.ParseFloat(value, 64)
+		if err != nil || jitter < 0 || jitter > 1 {
+			return true, fmt.Errorf("cannot parse number between 0 and 1 for keepAliveJitter: %s", value)
+		}
+		p.Jitter = jitter
+		return true, nil
+
+	case "keepAliveMaxFailures":
+		maxFailures, err := strconv.Atoi(value)
+		if err != nil {
+			return true, fmt.Errorf("cannot parse integer for keepAliveMaxFailures: %v", err)
+		}
+		p.MaxFailures = maxFailures
+		return true, nil
+
+	default:
+		return false, nil
+	}
+	var err error
+	*duration, err = time.ParseDuration(value)
+	if err != nil {
+		return true, fmt.Errorf("cannot parse duration for %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// LogLevel is the level of a log entry.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// Logger receives the structured log entries of the activities that
+// happen in the background, such as the keep-alive of held names.  The
+// fields give the context, e.g., "family" and "name".  Loggers must be
+// safe for concurrent use.
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// LoggerFunc adapts a function to the Logger interface.
+type LoggerFunc func(level LogLevel, msg string, fields map[string]interface{})
+
+func (f LoggerFunc) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	f(level, msg, fields)
+}
+
+// NewWriterLogger creates a logger that writes the entries at or above
+// a minimum level to a writer, one per line, in the "level: msg key=value"
+// format.
+func NewWriterLogger(w io.Writer, minLevel LogLevel) Logger {
+	return LoggerFunc(func(level LogLevel, msg string, fields map[string]interface{}) {
+		if level < minLevel {
+			return
+		}
+		var line strings.Builder
+		fmt.Fprintf(&line, "%s: %s", level, msg)
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&line, " %s=%v", key, fields[key])
+		}
+		line.WriteString("\n")
+		io.WriteString(w, line.String())
+	})
+}
+
+// DefaultLogger is the logger used when none is given: warnings and
+// errors are written to stderr.
+var DefaultLogger = NewWriterLogger(os.Stderr, LogLevelWarn)
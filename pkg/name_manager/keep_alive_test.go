@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepAlivePolicy(t *testing.T) {
+	policy := KeepAlivePolicy{Jitter: 0.5, MaxRetryDelay: 1 * time.Second}.
+		Merge(DefaultKeepAlivePolicy(30 * time.Second))
+	assert.Equal(t, KeepAlivePolicy{
+		Interval:      10 * time.Second,
+		Jitter:        0.5,
+		RetryDelay:    200 * time.Millisecond,
+		MaxRetryDelay: 1 * time.Second,
+		MaxFailures:   3,
+		Deadline:      30 * time.Second,
+	}, policy)
+
+	for i := 0; i < 100; i++ {
+		interval := policy.NextInterval()
+		assert.True(t, interval >= 5*time.Second && interval <= 15*time.Second, "%v", interval)
+	}
+
+	assert.Equal(t, 200*time.Millisecond, policy.NextRetryDelay(1))
+	assert.Equal(t, 400*time.Millisecond, policy.NextRetryDelay(2))
+	assert.Equal(t, 800*time.Millisecond, policy.NextRetryDelay(3))
+	assert.Equal(t, 1*time.Second, policy.NextRetryDelay(4))
+	assert.Equal(t, 1*time.Second, policy.NextRetryDelay(100))
+}
+
+func TestKeepAlivePolicySetOption(t *testing.T) {
+	var policy KeepAlivePolicy
+	for key, value := range map[string]string{
+		"keepAliveInterval":      "10s",
+		"keepAliveJitter":        "0.2",
+		"keepAliveRetryDelay":    "1s",
+		"keepAliveMaxRetryDelay": "5s",
+		"keepAliveMaxFailures":   "4",
+		"keepAliveDeadline":      "30s",
+	} {
+		ok, err := policy.SetOption(key, value)
+		assert.True(t, ok, key)
+		assert.NoError(t, err, key)
+	}
+	assert.Equal(t, KeepAlivePolicy{
+		Interval:      10 * time.Second,
+		Jitter:        0.2,
+		RetryDelay:    1 * time.Second,
+		MaxRetryDelay: 5 * time.Second,
+		MaxFailures:   4,
+		Deadline:      30 * time.Second,
+	}, policy)
+
+	ok, err := policy.SetOption("familyLimit", "2")
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	_, err = policy.SetOption("keepAliveJitter", "2")
+	assert.Error(t, err)
+
+	_, err = policy.SetOption("keepAliveDeadline", "__invalid__")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot parse duration for keepAliveDeadline")
+}
+
+func TestWriterLogger(t *testing.T) {
+	var out strings.Builder
+	logger := NewWriterLogger(&out, LogLevelInfo)
+	logger.Log(LogLevelDebug, "ignored", nil)
+	logger.Log(LogLevelWarn, "keep-alive failed", map[string]interface{}{"name": "0", "family": "foo"})
+	assert.Equal(t, "warn: keep-alive failed family=foo name=0\n", out.String())
+}
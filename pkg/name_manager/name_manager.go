@@ -4,13 +4,29 @@
 package name_manager
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // NameManager objects are responsible for the acquisition and release
 // of names with a global lock.
+//
+// Every method comes in two flavors: a context-first variant (e.g.,
+// AcquireContext), whose context bounds the time spent in the backend
+// and can be used to cancel in-flight calls, and a variant without a
+// context (e.g., Acquire), which is a thin wrapper that uses
+// `context.Background()`.
+//
+// The context-first variants work with leases (see Lease): every
+// acquisition gives a new lease on a name, and the lease must be
+// presented to keep the name alive and to release it.  The variants
+// without a context do not check the leases, and are kept for
+// backward compatibility.
 type NameManager interface {
 	// Hold acquires a name for the given family, returns it, and keep
 	// it alive until the release function is called (this call also
@@ -22,6 +38,17 @@ type NameManager interface {
 	// an error channel.
 	Hold(family string) (string, <-chan error, ReleaseFunc, error)
 
+	// HoldContext is like Hold, but returns the lease on the held name.
+	// The context bounds the acquisition and the keep-alive: when it is
+	// done, the keep-alive stops and the context error is sent to the error
+	// channel.  The release function is not bound by the context, so that
+	// a name can always be released.  When the lease is lost, an error
+	// wrapping ErrLeaseLost or ErrNotHeld is sent to the error channel,
+	// without retrying the keep-alive, and the context of the holding is
+	// cancelled with this error as cause.  The options
+	// are the same as for AcquireContext.
+	HoldContext(ctx context.Context, family string, opts ...AcquireOption) (*Holding, error)
+
 	// Acquire acquires a name for the given family, and returns it.
 	// Thanks to a global lock, a given name cannot be acquired twice for
 	// the same family without having been released first.  After being
@@ -30,24 +57,86 @@ type NameManager interface {
 	// backend-specific.
 	Acquire(family string) (string, error)
 
+	// AcquireContext is like Acquire, with a context.  It returns the
+	// lease on the acquired name.  Options, such as WithLabels, can be
+	// given to configure the acquisition.
+	AcquireContext(ctx context.Context, family string, opts ...AcquireOption) (Lease, error)
+
+	// AcquireWait is like AcquireContext, except that, when the family
+	// is at capacity (see SetFamilyLimit), its pool is exhausted (see
+	// DefinePool), or the names matching the selector are in use (see
+	// WithSelector), it blocks until a name is released or the context
+	// is done, instead of failing with ErrFamilyFull or ErrPoolExhausted.
+	// The waiters are served in arrival order: AcquireWait is
+	// implemented with Enqueue, PollTicket and CancelTicket.
+	AcquireWait(ctx context.Context, family string, opts ...AcquireOption) (Lease, error)
+
+	// HoldWait is like HoldContext, except that the name is acquired
+	// with AcquireWait.
+	HoldWait(ctx context.Context, family string, opts ...AcquireOption) (*Holding, error)
+
+	// AcquireMany acquires several names at once: counts gives, for each
+	// family, the number of names to acquire.  Either all the names are
+	// acquired, or none of them is, so that concurrent callers needing
+	// names in several families cannot deadlock.  The leases are sorted
+	// by family.  The options apply to all the families.
+	AcquireMany(ctx context.Context, counts map[string]int, opts ...AcquireOption) ([]Lease, error)
+
+	// HoldMany is like AcquireMany, except that the names are kept
+	// alive until they are released.
+	HoldMany(ctx context.Context, counts map[string]int, opts ...AcquireOption) (*Holdings, error)
+
+	// Transfer prepares the hand-off of a held name to another process,
+	// without releasing it: it returns a one-time ticket to give to Claim.
+	// Until the ticket is claimed, the name remains held with the lease,
+	// and is not released automatically.  Transferring a name again
+	// invalidates the previous ticket.  Transfer fails with ErrNotHeld or
+	// ErrLeaseLost in the same way as KeepAliveContext.
+	Transfer(ctx context.Context, lease Lease) (ClaimTicket, error)
+
+	// Claim redeems a ticket given by Transfer: the name is atomically
+	// acquired with a new lease, and the lease that was transferred is
+	// lost.  Claim fails with ErrInvalidClaim if the ticket was already
+	// claimed or invalidated, e.g., because the name was released.  The
+	// labels given as options replace the labels of the name.
+	Claim(ctx context.Context, ticket ClaimTicket, opts ...AcquireOption) (Lease, error)
+
 	// KeepAlive produces a heart beat to avoid a name being automatically
 	// released after a certain time.  KeepAlive helps to avoid zombies.
 	// Note that automatic release does NOT have to be implemented by a
-	// backend.
+	// backend.  KeepAlive does not check the lease on the name, but fails
+	// with ErrNotHeld if the name is not held anymore, e.g., because it
+	// was automatically released.
 	KeepAlive(family, name string) error
 
+	// KeepAliveContext is like KeepAlive, with a context.  It fails with
+	// ErrNotHeld if the name is not held anymore, and with ErrLeaseLost
+	// if the name is held with another lease, e.g., because the name was
+	// automatically released then acquired again.
+	KeepAliveContext(ctx context.Context, lease Lease) error
+
 	// Release releases a name previously registered for a family.
 	// It is not an error to release a name that has already been released,
 	// or that was never acquired in the first place.  A name that has
-	// be released can be acquired again.
+	// be released can be acquired again.  Release does not check the
+	// lease on the name.
 	Release(family, name string) error
 
+	// ReleaseContext is like Release, with a context.  It fails with
+	// ErrLeaseLost if the lease is not the current lease on the name
+	// anymore: a name cannot be released on behalf of another holder.
+	ReleaseContext(ctx context.Context, lease Lease) error
+
 	// TryAcquire tries to hold a specific name.  It fails with ErrInUse
 	// if the name has already been acquired and not yet released.
 	// Errors occurring during the keep-alive are sent to
 	// an error channel.
 	TryHold(family, name string) (<-chan error, ReleaseFunc, error)
 
+	// TryHoldContext is like TryHold, with a context.  The context is
+	// used in the same way as in HoldContext.
+	TryHoldContext(ctx context.Context, family, name string, opts ...AcquireOption) (*Holding, error)
+
 	// TryAcquire tries to acquire a specific name.  It fails with
 	// ErrInUse if the name has already been acquired and not yet released.
 	// It fails with ErrNotExist if the name has not already been acquired
@@ -61,17 +150,131 @@ type NameManager interface {
 	// (Just combine List with TryAcquire).
 	TryAcquire(family, name string) error
 
+	// TryAcquireContext is like TryAcquire, with a context.  It returns
+	// the lease on the acquired name.  The options are the same as for
+	// AcquireContext.
+	TryAcquireContext(ctx context.Context, family, name string, opts ...AcquireOption) (Lease, error)
+
 	// List lists the names that are currently registered, either marked as
 	// `free` or not.
 	List() ([]Name, error)
 
+	// ListContext is like List, with a context.
+	ListContext(ctx context.Context) ([]Name, error)
+
 	// Reset deregister all the names.  After this call, `List` returns
 	// `nil`.
 	Reset() error
+
+	// ResetContext is like Reset, with a context.
+	ResetContext(ctx context.Context) error
+
+	// Reap releases the names that were not kept alive during their TTL
+	// (see WithTTL), and expires the tickets that were not polled, for
+	// the given families, or for all the families if none is given.
+	// Otherwise, zombies are only collected when names of their family
+	// are acquired.  Reap returns the leases that were released, sorted
+	// by family.
+	Reap(ctx context.Context, families ...string) ([]Lease, error)
+
+	// Delete deregisters a name, e.g., when its resource is
+	// decommissioned.  It fails with ErrNotExist if the name is not
+	// registered, and with ErrInUse if the name is held, unless the
+	// deletion is forced (see WithForce), in which case the lease on the
+	// name is lost.  The deleted name does not count toward the limit of
+	// its family anymore.  It is not generated again, unless it is
+	// recycled (see WithRecycle), in which case the tokens of its new
+	// leases are greater than the tokens of its old leases.
+	Delete(ctx context.Context, family, name string, opts ...DeleteOption) error
+
+	// DeleteFamily deregisters all the names of a family, along with its
+	// waiters, its limit and its name generator: the next name acquired
+	// for the family is generated from scratch.  It fails with ErrInUse
+	// if names of the family are held, unless the deletion is forced
+	// (see WithForce).  It is not an error to delete a family that does
+	// not exist.
+	DeleteFamily(ctx context.Context, family string, opts ...DeleteOption) error
+
+	// Enqueue registers a waiter in the queue of a family, and returns
+	// the ticket of the waiter.  The free names of a family with waiters
+	// are reserved for the waiters, which are served in arrival order:
+	// Acquire fails with ErrFamilyFull when the family has a limit, and
+	// otherwise only acquires new names.
+	Enqueue(ctx context.Context, family string) (Ticket, error)
+
+	// PollTicket tries to acquire a name for a waiter.  If the waiter
+	// is at the head of the queue and a name is available, the name is
+	// acquired, the ticket is removed from the queue, and the lease on the
+	// name is returned.  Otherwise, a lease with an empty name is returned,
+	// along with the position of the waiter in the queue (zero for the
+	// head of the queue).
+	// PollTicket must be called regularly: tickets that are not polled
+	// are automatically expired in the same way names that are not kept
+	// alive are automatically released.  PollTicket fails with
+	// ErrTicketExpired if the ticket is not in the queue anymore.  The
+	// options, the same as for AcquireContext, apply when a name is acquired.
+	PollTicket(ctx context.Context, family, ticketID string, opts ...AcquireOption) (Lease, int, error)
+
+	// CancelTicket removes a waiter from the queue of a family.  It is not
+	// an error to cancel a ticket that is not in the queue anymore.
+	CancelTicket(ctx context.Context, family, ticketID string) error
+
+	// Queue lists the waiters of a family, in arrival order.
+	Queue(ctx context.Context, family string) ([]Ticket, error)
+
+	// GetAttributes returns the attributes of a name.  Attributes are
+	// durable properties of the names: contrary to labels, they survive
+	// release and acquisition.  GetAttributes fails with ErrNotExist if
+	// the name was never acquired.
+	GetAttributes(ctx context.Context, family, name string) (map[string]string, error)
+
+	// SetAttributes sets attributes on a name, leaving the other
+	// attributes of the name untouched.  An attribute with an empty
+	// value is removed.  SetAttributes fails with ErrNotExist if the
+	// name was never acquired.
+	SetAttributes(ctx context.Context, family, name string, attributes map[string]string) error
+
+	// Quarantine takes a name out of rotation, e.g., because the cleanup
+	// of its resource failed.  A quarantined name is skipped by the
+	// acquisitions until it is unquarantined, but can still be acquired
+	// explicitly with TryAcquire, e.g., to repair its resource.  The
+	// quarantine does not change whether the name is free: a name that
+	// is held when it is quarantined stays held until it is released.
+	// An empty reason is recorded as "unknown".  Quarantine fails with
+	// ErrNotExist if the name was never acquired.
+	Quarantine(ctx context.Context, family, name, reason string) error
+
+	// Unquarantine puts a quarantined name back in rotation.  It does
+	// nothing if the name is not quarantined, and fails with ErrNotExist
+	// if the name was never acquired.
+	Unquarantine(ctx context.Context, family, name string) error
+
+	// SetFamilyLimit sets the maximum number of names that can be
+	// registered for a family.  When this maximum is reached and
+	// all the names are in use, Acquire fails with ErrFamilyFull and
+	// AcquireWait blocks.  A limit of zero removes the family-specific
+	// limit, in which case the backend-wide limit applies, if any.
+	SetFamilyLimit(ctx context.Context, family string, limit int) error
+
+	// SetNameGenerator sets the generator of the new names of a family
+	// (see ParseNameGenerator).  The names that are already registered
+	// are kept.
+	SetNameGenerator(ctx context.Context, family string, generator NameGenerator) error
+
+	// DefinePool declares a fixed pool of names for a family, e.g., for
+	// pre-provisioned resources.  The names of the pool are registered
+	// right away, and Acquire only hands out members of the pool,
+	// failing with ErrPoolExhausted when they are all in use.  A pool
+	// can be extended by defining it again, but DefinePool fails if
+	// names outside of the pool are already registered for the family.
+	// The pool is stored as a "pool" name generator (see
+	// SetNameGenerator).
+	DefinePool(ctx context.Context, family string, names []string) error
 }
 
 // ErrInUse is returned by TryAcquire and TryHold when trying to acquire
-// or hold a name already in use.
+// or hold a name already in use, and by Delete and DeleteFamily when
+// trying to delete names in use.
 var ErrInUse = errors.New("name in use")
 
 // ErrNotExist is returned by TryAcquire and TryHold when trying to
@@ -79,28 +282,234 @@ var ErrInUse = errors.New("name in use")
 // not known by the system.
 var ErrNotExist = errors.New("name does not exist")
 
+// ErrFamilyFull is returned by Acquire and Hold when all the names of
+// a family are in use and no new name can be registered because the
+// family limit is reached.
+var ErrFamilyFull = errors.New("family at capacity")
+
+// ErrPoolExhausted is returned by Acquire and Hold when all the names of
+// the pool of a family are in use (see DefinePool).
+var ErrPoolExhausted = errors.New("pool exhausted")
+
+// ErrTicketExpired is returned by PollTicket when the ticket is not in the
+// queue anymore, e.g., because it was not polled often enough.
+var ErrTicketExpired = errors.New("ticket expired")
+
+// ErrNoMatchingName is returned by Acquire and Hold when no name of the
+// family matches the selector given with WithSelector or
+// WithRequiredAttributes, and no new name matching the selector can be
+// registered.  When the matching names are all in use, ErrFamilyFull is
+// returned instead.
+var ErrNoMatchingName = errors.New("no matching name")
+
+// ErrLeaseLost is returned by KeepAliveContext and ReleaseContext when
+// the lease is not the current lease on the name anymore.
+var ErrLeaseLost = errors.New("lease lost")
+
+// ErrInvalidClaim is returned by Claim when the claim ticket cannot be
+// redeemed.
+var ErrInvalidClaim = errors.New("invalid claim ticket")
+
+// ErrNotHeld is returned by KeepAlive and KeepAliveContext when the name
+// is not held at all, e.g., because it was released on behalf of its
+// holder, or because it does not exist.
+var ErrNotHeld = errors.New("name not held")
+
 // ReleaseFunc is called to release a name that was acquired and kept
 // alive through `NameManager.Hold`.
 type ReleaseFunc func() error
 
-// Name describes a name as registered with a `NameManager`.
+// Name describes a name as registered with a `NameManager`.  Its JSON
+// encoding, with RFC 3339 timestamps, is described by the JSON schema in
+// docs/name.schema.json.
 type Name struct {
 	// Name is the name.
-	Name string
+	Name string `json:"name" yaml:"name"`
 
 	// Family is the name family the name belongs to.  Names are unique
 	// within the same family.
-	Family string
+	Family string `json:"family" yaml:"family"`
 
 	// CreatedAt is the timestamp at which the name was first registered.
-	CreatedAt time.Time
+	CreatedAt time.Time `json:"createdAt" yaml:"createdAt"`
 
 	// UpdatedAt is the timestamp at which the name was last acquired.
-	UpdatedAt time.Time
+	UpdatedAt time.Time `json:"updatedAt" yaml:"updatedAt"`
 
 	// Free is whether the name is free, or it was acquired but not
-	// yet released.
-	Free bool
+	// yet released.  A quarantined name that is free is not acquired
+	// until it is unquarantined.
+	Free bool `json:"free" yaml:"free"`
+
+	// Quarantine is the reason why the name is quarantined (see
+	// NameManager.Quarantine), or "" if the name is not quarantined.
+	Quarantine string `json:"quarantine,omitempty" yaml:"quarantine,omitempty"`
+
+	// Token is the token of the last lease on the name.
+	Token int64 `json:"token" yaml:"token"`
+
+	// Labels are the labels attached to the name by its holder (see
+	// WithLabels).  Free names have no labels.
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+
+	// Attributes are the durable attributes of the name (see
+	// NameManager.SetAttributes).
+	Attributes map[string]string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+
+	// Pool is whether the name is a member of the pool of its family
+	// (see NameManager.DefinePool).
+	Pool bool `json:"pool" yaml:"pool"`
+}
+
+// Lease describes the acquisition of a name.  Every acquisition of a
+// name gives a lease with a token greater than the tokens of all the
+// previous leases on the same name.  The token can therefore be passed
+// to the shared resource as a fencing token, so that the resource can
+// reject the requests of holders whose lease was lost.
+type Lease struct {
+	// Family is the name family the name belongs to.
+	Family string `json:"family" yaml:"family"`
+
+	// Name is the leased name.
+	Name string `json:"name" yaml:"name"`
+
+	// Token is the token of the lease.  Tokens start at one.  A zero
+	// token is never given by the backends: it matches any lease, and
+	// is used by the variants of KeepAlive and Release without a context.
+	Token int64 `json:"token" yaml:"token"`
+
+	// Created is true if the name is acquired for the first time since
+	// it was registered, e.g., because it was just created.  The
+	// OnCreate hook is run on such names instead of OnAcquire (see
+	// Hooks).
+	Created bool `json:"created,omitempty" yaml:"created,omitempty"`
+}
+
+// Holding describes a name that is held, that is, kept alive in the
+// background until it is released.
+type Holding struct {
+	// Lease is the lease on the held name.
+	Lease
+
+	// Errors receives the errors occurring during the keep-alive.
+	Errors <-chan error
+
+	// Context is done when the name is not held anymore: when the
+	// keep-alive fails, e.g., because the lease was lost, when the
+	// context given to hold the name is done, or when the name is
+	// released.  Cause gives the reason, e.g., an error wrapping
+	// ErrLeaseLost.  Work that requires the name should be bound to
+	// this context.
+	Context context.Context
+
+	// Release stops the keep-alive and releases the name.
+	Release ReleaseFunc
+}
+
+// Reclaim describes the re-acquisition of a held name after its
+// keep-alive gave up (see WithReclaim).
+type Reclaim struct {
+	// Lost is the lease whose keep-alive gave up.
+	Lost Lease
+
+	// Lease is the lease on the reclaimed name.  The name is kept alive
+	// and released with this lease.
+	Lease Lease
+
+	// Cause is the error with which the keep-alive gave up.
+	Cause error
+
+	// Continuous is true when the name was not acquired by anyone else
+	// between the two leases, so that the resources associated with the
+	// name could not have been tampered with.
+	Continuous bool
+}
+
+// Holdings describes names that are held together (see
+// NameManager.HoldMany).
+type Holdings struct {
+	// Leases are the leases on the held names, sorted by family.
+	Leases []Lease
+
+	// Errors receives the errors occurring during the keep-alive of
+	// any of the names.
+	Errors <-chan error
+
+	// Context is done as soon as any of the names is not held anymore
+	// (see Holding.Context).
+	Context context.Context
+
+	// Release stops the keep-alive and releases all the names.
+	Release ReleaseFunc
+}
+
+// SortedFamilies checks the counts given to AcquireMany and returns the
+// families in the order in which their names must be acquired.
+func SortedFamilies(counts map[string]int) ([]string, error) {
+	families := make([]string, 0, len(counts))
+	for family, count := range counts {
+		if count <= 0 {
+			return nil, fmt.Errorf("invalid count %d for family '%s'", count, family)
+		}
+		families = append(families, family)
+	}
+	sort.Strings(families)
+	return families, nil
+}
+
+// ParseFamilyCounts parses the counts given to AcquireMany in the
+// "family[:count]" format.  The count defaults to one.  A family that
+// is given several times gets the sum of its counts.
+func ParseFamilyCounts(familyCounts []string) (map[string]int, error) {
+	counts := make(map[string]int, len(familyCounts))
+	for _, familyCount := range familyCounts {
+		family := familyCount
+		count := 1
+		if i := strings.LastIndex(familyCount, ":"); i >= 0 {
+			family = familyCount[:i]
+			var err error
+			count, err = strconv.Atoi(familyCount[i+1:])
+			if err != nil || count <= 0 {
+				return nil, fmt.Errorf("invalid '%s': expected format family[:count], with a positive count", familyCount)
+			}
+		}
+		if family == "" {
+			return nil, fmt.Errorf("invalid '%s': expected format family[:count], with a positive count", familyCount)
+		}
+		counts[family] += count
+	}
+	return counts, nil
+}
+
+// FormatFamilyCounts formats the counts given to AcquireMany in the
+// "family:count" format, sorted by family.  It is the inverse of
+// ParseFamilyCounts.
+func FormatFamilyCounts(counts map[string]int) []string {
+	formatted := make([]string, 0, len(counts))
+	for family, count := range counts {
+		formatted = append(formatted, fmt.Sprintf("%s:%d", family, count))
+	}
+	sort.Strings(formatted)
+	return formatted
+}
+
+// Ticket describes a waiter in the queue of a family.
+type Ticket struct {
+	// ID identifies the ticket within the family.
+	ID string
+
+	// Family is the name family the waiter waits for.
+	Family string
+
+	// Position is the position of the waiter in the queue, zero being the
+	// head of the queue.
+	Position int
+
+	// CreatedAt is the timestamp at which the waiter was enqueued.
+	CreatedAt time.Time
+
+	// UpdatedAt is the timestamp at which the ticket was last polled.
+	UpdatedAt time.Time
 }
 
 // Backend describes a backend for creating name managers.
@@ -4,6 +4,7 @@
 package name_manager
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,6 +12,8 @@ import (
 
 type testNameManager struct {
 	backendURL string
+	attributes map[string]string
+	quarantine string
 }
 
 func TestCreateFromURL(t *testing.T) {
@@ -34,34 +37,169 @@ func TestCreateFromURL(t *testing.T) {
 	assert.Equal(t, "foo", name)
 }
 
+func TestParseFamilyCounts(t *testing.T) {
+	counts, err := ParseFamilyCounts([]string{"db", "broker:2", "db:3"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"db": 4, "broker": 2}, counts)
+
+	assert.Equal(t, []string{"broker:2", "db:4"}, FormatFamilyCounts(counts))
+
+	families, err := SortedFamilies(counts)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"broker", "db"}, families)
+
+	for _, invalid := range []string{"", ":2", "db:0", "db:-1", "db:foo"} {
+		_, err = ParseFamilyCounts([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+
+	_, err = SortedFamilies(map[string]int{"db": 0})
+	assert.Error(t, err)
+}
+
 func (tnm *testNameManager) Hold(family string) (string, <-chan error, ReleaseFunc, error) {
 	return "foo", nil, nil, nil
 }
 
+func (tnm *testNameManager) HoldContext(ctx context.Context, family string, opts ...AcquireOption) (*Holding, error) {
+	return nil, nil
+}
+
 func (tnm *testNameManager) Acquire(family string) (string, error) {
 	return "foo", nil
 }
 
+func (tnm *testNameManager) AcquireContext(ctx context.Context, family string, opts ...AcquireOption) (Lease, error) {
+	return Lease{Family: family, Name: "foo", Token: 1}, nil
+}
+
+func (tnm *testNameManager) AcquireWait(ctx context.Context, family string, opts ...AcquireOption) (Lease, error) {
+	return tnm.AcquireContext(ctx, family)
+}
+
+func (tnm *testNameManager) HoldWait(ctx context.Context, family string, opts ...AcquireOption) (*Holding, error) {
+	return nil, nil
+}
+
 func (tnm *testNameManager) KeepAlive(family, name string) error {
 	return nil
 }
 
+func (tnm *testNameManager) KeepAliveContext(ctx context.Context, lease Lease) error {
+	return nil
+}
+
 func (tnm *testNameManager) Release(family, name string) error {
 	return nil
 }
 
+func (tnm *testNameManager) ReleaseContext(ctx context.Context, lease Lease) error {
+	return nil
+}
+
 func (tnm *testNameManager) TryAcquire(family, name string) error {
 	return nil
 }
 
+func (tnm *testNameManager) TryAcquireContext(ctx context.Context, family, name string, opts ...AcquireOption) (Lease, error) {
+	return Lease{Family: family, Name: name, Token: 1}, nil
+}
+
 func (tnm *testNameManager) TryHold(family, name string) (<-chan error, ReleaseFunc, error) {
 	return nil, nil, nil
 }
 
+func (tnm *testNameManager) TryHoldContext(ctx context.Context, family, name string, opts ...AcquireOption) (*Holding, error) {
+	return nil, nil
+}
+
 func (tnm *testNameManager) List() ([]Name, error) {
 	return nil, nil
 }
 
+func (tnm *testNameManager) ListContext(ctx context.Context) ([]Name, error) {
+	return tnm.List()
+}
+
 func (tnm *testNameManager) Reset() error {
 	return nil
 }
+
+func (tnm *testNameManager) ResetContext(ctx context.Context) error {
+	return tnm.Reset()
+}
+
+func (tnm *testNameManager) Reap(ctx context.Context, families ...string) ([]Lease, error) {
+	return nil, nil
+}
+
+func (tnm *testNameManager) Delete(ctx context.Context, family, name string, opts ...DeleteOption) error {
+	return nil
+}
+
+func (tnm *testNameManager) DeleteFamily(ctx context.Context, family string, opts ...DeleteOption) error {
+	return nil
+}
+
+func (tnm *testNameManager) Enqueue(ctx context.Context, family string) (Ticket, error) {
+	return Ticket{}, nil
+}
+
+func (tnm *testNameManager) PollTicket(ctx context.Context, family, ticketID string, opts ...AcquireOption) (Lease, int, error) {
+	return Lease{}, 0, nil
+}
+
+func (tnm *testNameManager) CancelTicket(ctx context.Context, family, ticketID string) error {
+	return nil
+}
+
+func (tnm *testNameManager) Queue(ctx context.Context, family string) ([]Ticket, error) {
+	return nil, nil
+}
+
+func (tnm *testNameManager) SetFamilyLimit(ctx context.Context, family string, limit int) error {
+	return nil
+}
+
+func (tnm *testNameManager) GetAttributes(ctx context.Context, family, name string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (tnm *testNameManager) SetAttributes(ctx context.Context, family, name string, attributes map[string]string) error {
+	tnm.attributes = attributes
+	return nil
+}
+
+func (tnm *testNameManager) Quarantine(ctx context.Context, family, name, reason string) error {
+	tnm.quarantine = reason
+	return nil
+}
+
+func (tnm *testNameManager) Unquarantine(ctx context.Context, family, name string) error {
+	tnm.quarantine = ""
+	return nil
+}
+
+func (tnm *testNameManager) SetNameGenerator(ctx context.Context, family string, generator NameGenerator) error {
+	return nil
+}
+
+func (tnm *testNameManager) DefinePool(ctx context.Context, family string, names []string) error {
+	return nil
+}
+
+func (tnm *testNameManager) AcquireMany(ctx context.Context, counts map[string]int, opts ...AcquireOption) ([]Lease, error) {
+	return nil, nil
+}
+
+func (tnm *testNameManager) HoldMany(ctx context.Context, counts map[string]int, opts ...AcquireOption) (*Holdings, error) {
+	return nil, nil
+}
+
+func (tnm *testNameManager) Transfer(ctx context.Context, lease Lease) (ClaimTicket, error) {
+	return ClaimTicket{}, nil
+}
+
+func (tnm *testNameManager) Claim(ctx context.Context, ticket ClaimTicket, opts ...AcquireOption) (Lease, error) {
+	return Lease{}, nil
+}
@@ -0,0 +1,245 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AcquireOption configures the acquisition of a name.
+type AcquireOption func(*AcquireOptions)
+
+// AcquireOptions holds the configuration for the acquisition of a name.
+// It is built by backends from AcquireOption values with
+// NewAcquireOptions.
+type AcquireOptions struct {
+	// Labels are attached to the acquired name until it is acquired
+	// again.  They typically record who holds the name (CI job URL,
+	// hostname, PID, ...).
+	Labels map[string]string
+
+	// Selector restricts the acquisition to the names whose attributes
+	// (see NameManager.SetAttributes) match it.
+	Selector Selector
+
+	// KeepAlivePolicy, if not nil, overrides the keep-alive policy of
+	// the backend for the names that are held.  It is merged with the
+	// policy of the backend (see KeepAlivePolicy.Merge).
+	KeepAlivePolicy *KeepAlivePolicy
+
+	// Logger, if not nil, receives the log entries of the keep-alive of
+	// the names that are held, instead of DefaultLogger.
+	Logger Logger
+
+	// Reclaim is true if the names that are held are re-acquired when
+	// their keep-alive gives up (see WithReclaim).
+	Reclaim bool
+
+	// OnReclaim, if not nil, is called when a name is reclaimed.
+	OnReclaim func(Reclaim)
+
+	// TTL is the time after which the acquired name is automatically
+	// released if it is not kept alive.  Zero means that the default of
+	// the backend applies (see WithTTL).
+	TTL time.Duration
+
+	// Hooks, if not nil, are the lifecycle hooks run on the names that
+	// are held (see WithHooks).
+	Hooks *Hooks
+}
+
+// NewAcquireOptions applies acquisition options.
+func NewAcquireOptions(opts ...AcquireOption) *AcquireOptions {
+	options := &AcquireOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithLabels attaches labels to the acquired name.  The labels replace
+// the labels of the previous holder.
+func WithLabels(labels map[string]string) AcquireOption {
+	return func(options *AcquireOptions) {
+		options.Labels = labels
+	}
+}
+
+// WithSelector restricts the acquisition to the free names whose
+// attributes match the selector.  As new names have no attributes, a new
+// name is only registered if the selector matches a name without
+// attributes (e.g., "region!=eu") and the family is not at capacity:
+// otherwise, when no free name matches, the acquisition fails with
+// ErrFamilyFull if matching names are in use, so that AcquireWait waits
+// for one of them to be released, and with ErrNoMatchingName if no name
+// of the family matches.  WithSelector can be given multiple times, in
+// which case the names must match all the selectors.
+func WithSelector(selector Selector) AcquireOption {
+	return func(options *AcquireOptions) {
+		options.Selector = append(options.Selector, selector...)
+	}
+}
+
+// WithRequiredAttributes restricts the acquisition to the names whose
+// attributes have the given values.  It is a shortcut for WithSelector.
+func WithRequiredAttributes(attributes map[string]string) AcquireOption {
+	return WithSelector(SelectorFromAttributes(attributes))
+}
+
+// WithKeepAlivePolicy configures the keep-alive of the names that are
+// held.  It has no effect on the names that are only acquired.
+func WithKeepAlivePolicy(policy KeepAlivePolicy) AcquireOption {
+	return func(options *AcquireOptions) {
+		options.KeepAlivePolicy = &policy
+	}
+}
+
+// WithLogger sets the logger for the keep-alive of the names that are
+// held.  It has no effect on the names that are only acquired.
+func WithLogger(logger Logger) AcquireOption {
+	return func(options *AcquireOptions) {
+		options.Logger = logger
+	}
+}
+
+// WithReclaim makes the names that are held more resilient: when the
+// keep-alive of a name gives up, e.g., because of a network outage longer
+// than the automatic release delay of the backend, the name is acquired
+// again with TryAcquire, if it is still free, instead of failing.  The
+// attempts follow the keep-alive policy.  onReclaim, if not nil, is
+// called after a name is reclaimed, from the goroutine of the keep-alive,
+// and can tell whether the continuity of the holding was preserved.  It
+// has no effect on the names that are only acquired.
+func WithReclaim(onReclaim func(Reclaim)) AcquireOption {
+	return func(options *AcquireOptions) {
+		options.Reclaim = true
+		options.OnReclaim = onReclaim
+	}
+}
+
+// WithTTL sets the time after which the acquired name is automatically
+// released if it is not kept alive, instead of the default of the
+// backend (the autoReleaseAfter option), e.g., to hold a name for
+// hours while debugging.  The TTL is capped by the maximum of the
+// backend (the maxTTL option).  The names that are held are kept alive
+// according to their TTL.
+func WithTTL(ttl time.Duration) AcquireOption {
+	return func(options *AcquireOptions) {
+		options.TTL = ttl
+	}
+}
+
+// WithHooks sets the lifecycle hooks run on the names that are held:
+// OnCreate or OnAcquire before the name is handed out, and OnRelease
+// when it is released.  When a hook fails, the name is quarantined (see
+// RunHook), the acquisition or the release fails with a *HookError, and
+// the name is released nonetheless.  It has no effect on the names that
+// are only acquired.
+func WithHooks(hooks Hooks) AcquireOption {
+	return func(options *AcquireOptions) {
+		options.Hooks = &hooks
+	}
+}
+
+// DeleteOption configures the deletion of names.
+type DeleteOption func(*DeleteOptions)
+
+// DeleteOptions holds the configuration for the deletion of names.  It
+// is built by backends from DeleteOption values with NewDeleteOptions.
+type DeleteOptions struct {
+	// Force is true if the names are deleted even if they are held.
+	Force bool
+
+	// Recycle is true if the deleted name is generated again (see
+	// WithRecycle).
+	Recycle bool
+}
+
+// NewDeleteOptions applies deletion options.
+func NewDeleteOptions(opts ...DeleteOption) *DeleteOptions {
+	options := &DeleteOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithForce deletes the names even if they are held.  The holders lose
+// their leases.
+func WithForce() DeleteOption {
+	return func(options *DeleteOptions) {
+		options.Force = true
+	}
+}
+
+// WithRecycle recycles the slot of the deleted name in the name generator
+// of its family: the next names generated for the family reuse the
+// recycled slots first, lowest first, before the counter of the family
+// is incremented.  For instance, with the default generator, deleting
+// "1" out of "0", "1", "2" gives "1" as the next new name, instead of
+// "3".  The names of random generators (see NameGenerator) cannot be
+// recycled.  It has no effect on DeleteFamily.
+func WithRecycle() DeleteOption {
+	return func(options *DeleteOptions) {
+		options.Recycle = true
+	}
+}
+
+// LeaseTTL gives the TTL of a lease acquired with these options, given
+// the default and the maximum TTL of the backend.  Zero means that the
+// name is never released automatically.  A zero maximum means no
+// maximum.
+func (options *AcquireOptions) LeaseTTL(defaultTTL, maxTTL time.Duration) time.Duration {
+	ttl := options.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	if maxTTL > 0 && (ttl <= 0 || ttl > maxTTL) {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// Matches returns whether a name with the given attributes can be
+// acquired with these options, provided that it is not quarantined (see
+// NameManager.Quarantine).
+func (options *AcquireOptions) Matches(attributes map[string]string) bool {
+	return options.Selector.Matches(attributes)
+}
+
+// CanCreateName returns whether a new name, which has no attributes,
+// can be registered to satisfy an acquisition with these options.
+func (options *AcquireOptions) CanCreateName() bool {
+	return options.Matches(nil)
+}
+
+// ParseKeyValues parses labels or attributes in the "key=value" format.
+func ParseKeyValues(keyValues []string) (map[string]string, error) {
+	if len(keyValues) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]string, len(keyValues))
+	for _, keyValue := range keyValues {
+		i := strings.Index(keyValue, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid '%s': expected format key=value", keyValue)
+		}
+		parsed[keyValue[:i]] = keyValue[i+1:]
+	}
+	return parsed, nil
+}
+
+// FormatKeyValues formats labels or attributes in the "key=value" format,
+// sorted by key.  It is the inverse of ParseKeyValues.
+func FormatKeyValues(keyValues map[string]string) []string {
+	formatted := make([]string, 0, len(keyValues))
+	for key, value := range keyValues {
+		formatted = append(formatted, key+"="+value)
+	}
+	sort.Strings(formatted)
+	return formatted
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	labels, err := ParseKeyValues([]string{"host=ci-3", "job=https://ci/1?a=b", "empty="})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"host":  "ci-3",
+		"job":   "https://ci/1?a=b",
+		"empty": "",
+	}, labels)
+
+	assert.Equal(t, []string{"empty=", "host=ci-3", "job=https://ci/1?a=b"}, FormatKeyValues(labels))
+
+	_, err = ParseKeyValues([]string{"=value"})
+	assert.Error(t, err)
+
+	_, err = ParseKeyValues([]string{"novalue"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expected format key=value")
+}
+
+func TestAcquireOptions(t *testing.T) {
+	options := NewAcquireOptions()
+	assert.Nil(t, options.Labels)
+
+	assert.True(t, options.Matches(nil))
+
+	options = NewAcquireOptions(WithLabels(map[string]string{"foo": "bar"}))
+	assert.Equal(t, map[string]string{"foo": "bar"}, options.Labels)
+
+	options = NewAcquireOptions(WithRequiredAttributes(map[string]string{"profile": "large"}))
+	assert.True(t, options.Matches(map[string]string{"profile": "large", "region": "eu"}))
+	assert.False(t, options.Matches(map[string]string{"profile": "small"}))
+	assert.False(t, options.Matches(nil))
+	assert.False(t, options.CanCreateName())
+
+	options = NewAcquireOptions(
+		WithRequiredAttributes(map[string]string{"profile": "large"}),
+		WithSelector(MustParseSelector("region!=eu")))
+	assert.True(t, options.Matches(map[string]string{"profile": "large", "region": "us"}))
+	assert.False(t, options.Matches(map[string]string{"profile": "large", "region": "eu"}))
+
+	options = NewAcquireOptions(WithSelector(MustParseSelector("region!=eu")))
+	assert.True(t, options.CanCreateName())
+}
+
+func TestLeaseTTL(t *testing.T) {
+	options := NewAcquireOptions()
+	assert.Equal(t, time.Duration(0), options.LeaseTTL(0, 0))
+	assert.Equal(t, 5*time.Second, options.LeaseTTL(5*time.Second, 0))
+	assert.Equal(t, 1*time.Hour, options.LeaseTTL(0, 1*time.Hour))
+
+	options = NewAcquireOptions(WithTTL(2 * time.Hour))
+	assert.Equal(t, 2*time.Hour, options.LeaseTTL(5*time.Second, 0))
+	assert.Equal(t, 1*time.Hour, options.LeaseTTL(5*time.Second, 1*time.Hour))
+
+	options = NewAcquireOptions(WithTTL(30 * time.Second))
+	assert.Equal(t, 30*time.Second, options.LeaseTTL(5*time.Second, 1*time.Hour))
+}
@@ -0,0 +1,20 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+// QuarantineReason gives the reason recorded for the quarantine of a
+// name (see NameManager.Quarantine): an empty reason is recorded as
+// "unknown".
+func QuarantineReason(reason string) string {
+	if reason == "" {
+		return "unknown"
+	}
+	return reason
+}
+
+// Quarantined returns whether the name is quarantined, and the reason
+// for the quarantine.
+func (name Name) Quarantined() (reason string, ok bool) {
+	return name.Quarantine, name.Quarantine != ""
+}
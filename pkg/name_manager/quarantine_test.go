@@ -0,0 +1,18 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantined(t *testing.T) {
+	reason, ok := Name{Quarantine: "cleanup failed"}.Quarantined()
+	assert.True(t, ok)
+	assert.Equal(t, "cleanup failed", reason)
+	_, ok = Name{}.Quarantined()
+	assert.False(t, ok)
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Operator is the operator of a selector requirement.
+type Operator string
+
+const (
+	// Equals requires an attribute to have a given value.
+	Equals Operator = "="
+	// NotEquals requires an attribute to be absent or to have a value
+	// different from a given value.
+	NotEquals Operator = "!="
+)
+
+// Requirement is a constraint on one attribute of a name.
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Value    string
+}
+
+// Matches returns whether attributes satisfy the requirement.
+func (requirement Requirement) Matches(attributes map[string]string) bool {
+	value, ok := attributes[requirement.Key]
+	switch requirement.Operator {
+	case Equals:
+		return ok && value == requirement.Value
+	case NotEquals:
+		return !ok || value != requirement.Value
+	default:
+		return false
+	}
+}
+
+// String formats the requirement in the "key=value" or "key!=value"
+// format.
+func (requirement Requirement) String() string {
+	return requirement.Key + string(requirement.Operator) + requirement.Value
+}
+
+// Selector selects names by their attributes (see
+// NameManager.SetAttributes).  A name is selected when it satisfies all
+// the requirements.  The empty selector selects all the names.
+type Selector []Requirement
+
+// ParseSelector parses a selector given as comma-separated requirements
+// in the "key=value" or "key!=value" format, e.g.
+// "profile=large,region!=eu".  Values cannot contain commas.
+func ParseSelector(selector string) (Selector, error) {
+	if strings.TrimSpace(selector) == "" {
+		return nil, nil
+	}
+	var parsed Selector
+	for _, part := range strings.Split(selector, ",") {
+		requirement := Requirement{Operator: Equals}
+		i := strings.Index(part, string(NotEquals))
+		if i >= 0 {
+			requirement.Operator = NotEquals
+		} else {
+			i = strings.Index(part, string(Equals))
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("invalid selector '%s': expected format key=value or key!=value", selector)
+		}
+		requirement.Key = strings.TrimSpace(part[:i])
+		requirement.Value = strings.TrimSpace(part[i+len(requirement.Operator):])
+		if requirement.Key == "" {
+			return nil, fmt.Errorf("invalid selector '%s': missing key", selector)
+		}
+		parsed = append(parsed, requirement)
+	}
+	return parsed, nil
+}
+
+// MustParseSelector is like ParseSelector but panics if the selector
+// cannot be parsed.  It is meant for selectors known at compile time.
+func MustParseSelector(selector string) Selector {
+	parsed, err := ParseSelector(selector)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// SelectorFromAttributes returns the selector that requires attributes
+// to have the given values.
+func SelectorFromAttributes(attributes map[string]string) Selector {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	selector := make(Selector, 0, len(keys))
+	for _, key := range keys {
+		selector = append(selector, Requirement{Key: key, Operator: Equals, Value: attributes[key]})
+	}
+	return selector
+}
+
+// Matches returns whether attributes satisfy all the requirements of the
+// selector.
+func (selector Selector) Matches(attributes map[string]string) bool {
+	for _, requirement := range selector {
+		if !requirement.Matches(attributes) {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the selector in the format accepted by ParseSelector.
+func (selector Selector) String() string {
+	requirements := make([]string, len(selector))
+	for i, requirement := range selector {
+		requirements[i] = requirement.String()
+	}
+	return strings.Join(requirements, ",")
+}
@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Hadrien Chauvin
+
+package name_manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector("profile=large, region!=eu")
+	assert.NoError(t, err)
+	assert.Equal(t, Selector{
+		{Key: "profile", Operator: Equals, Value: "large"},
+		{Key: "region", Operator: NotEquals, Value: "eu"},
+	}, selector)
+	assert.Equal(t, "profile=large,region!=eu", selector.String())
+
+	selector, err = ParseSelector("")
+	assert.NoError(t, err)
+	assert.Nil(t, selector)
+
+	_, err = ParseSelector("profile")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expected format key=value or key!=value")
+
+	_, err = ParseSelector("profile=large,=eu")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing key")
+
+	assert.Panics(t, func() { MustParseSelector("profile") })
+}
+
+func TestSelectorMatches(t *testing.T) {
+	selector := MustParseSelector("profile=large,region!=eu")
+	assert.True(t, selector.Matches(map[string]string{"profile": "large"}))
+	assert.True(t, selector.Matches(map[string]string{"profile": "large", "region": "us"}))
+	assert.False(t, selector.Matches(map[string]string{"profile": "large", "region": "eu"}))
+	assert.False(t, selector.Matches(map[string]string{"region": "us"}))
+	assert.False(t, selector.Matches(nil))
+
+	assert.True(t, MustParseSelector("region!=eu").Matches(nil))
+	assert.True(t, Selector(nil).Matches(nil))
+
+	assert.Equal(t, MustParseSelector("a=1,b=2"), SelectorFromAttributes(map[string]string{"b": "2", "a": "1"}))
+}
@@ -4,6 +4,7 @@
 package rest_backend
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/avast/retry-go"
@@ -12,6 +13,8 @@ import (
 	"github.com/hchauvin/name_manager/pkg/name_manager"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -41,6 +44,29 @@ func createNameManager(backendURL string) (name_manager.NameManager, error) {
 	}, nil
 }
 
+// errorsByCode associates the codes sent by the server in the body of
+// 409 responses with the errors that are part of the contract of
+// `name_manager.NameManager`.
+var errorsByCode = map[string]error{
+	"ERR_FAMILY_FULL":      name_manager.ErrFamilyFull,
+	"ERR_TICKET_EXPIRED":   name_manager.ErrTicketExpired,
+	"ERR_LEASE_LOST":       name_manager.ErrLeaseLost,
+	"ERR_NOT_EXIST":        name_manager.ErrNotExist,
+	"ERR_NO_MATCHING_NAME": name_manager.ErrNoMatchingName,
+	"ERR_POOL_EXHAUSTED":   name_manager.ErrPoolExhausted,
+	"ERR_NOT_HELD":         name_manager.ErrNotHeld,
+	"ERR_INVALID_CLAIM":    name_manager.ErrInvalidClaim,
+	"ERR_IN_USE":           name_manager.ErrInUse,
+}
+
+// leaseTokenHeader is the header in which the server sends the token
+// of the lease on an acquired name.
+const leaseTokenHeader = "X-Lease-Token"
+
+// leaseCreatedHeader is the header that the server sets to "true" when
+// the lease on an acquired name is the first lease on the name.
+const leaseCreatedHeader = "X-Lease-Created"
+
 type restBackend struct {
 	// url is the base URL for the REST server.
 	url string
@@ -59,17 +85,79 @@ func (rbk *restBackend) Hold(family string) (string, <-chan error, name_manager.
 	return rbk.hold().Hold(family)
 }
 
+func (rbk *restBackend) HoldContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return rbk.hold().HoldContext(ctx, family, opts...)
+}
+
 func (rbk *restBackend) Acquire(family string) (string, error) {
-	return rbk.get(fmt.Sprintf("/family/%s/$acquire", family))
+	lease, err := rbk.AcquireContext(context.Background(), family)
+	if err != nil {
+		return "", err
+	}
+	return lease.Name, nil
+}
+
+func (rbk *restBackend) AcquireContext(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	return rbk.getLease(ctx, family, fmt.Sprintf("/family/%s/$acquire%s", family, acquireQuery(url.Values{}, opts)))
+}
+
+func (rbk *restBackend) AcquireWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	query := url.Values{"wait": {"true"}}
+	return rbk.getLease(ctx, family, fmt.Sprintf("/family/%s/$acquire%s", family, acquireQuery(query, opts)))
+}
+
+func (rbk *restBackend) HoldWait(ctx context.Context, family string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return rbk.hold().HoldWait(ctx, family, opts...)
+}
+
+func (rbk *restBackend) AcquireMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) ([]name_manager.Lease, error) {
+	if _, err := name_manager.SortedFamilies(counts); err != nil {
+		return nil, err
+	}
+	query := url.Values{"family": name_manager.FormatFamilyCounts(counts)}
+	body, err := rbk.get(ctx, "/$acquire_many"+acquireQuery(query, opts))
+	if err != nil {
+		return nil, err
+	}
+	var leases []name_manager.Lease
+	if err := json.Unmarshal([]byte(body), &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+func (rbk *restBackend) HoldMany(ctx context.Context, counts map[string]int, opts ...name_manager.AcquireOption) (*name_manager.Holdings, error) {
+	return rbk.hold().HoldMany(ctx, counts, opts...)
+}
+
+func (rbk *restBackend) Transfer(ctx context.Context, lease name_manager.Lease) (name_manager.ClaimTicket, error) {
+	body, err := rbk.get(ctx, fmt.Sprintf("/family/%s/name/%s/$transfer?token=%d", lease.Family, lease.Name, lease.Token))
+	if err != nil {
+		return name_manager.ClaimTicket{}, err
+	}
+	return name_manager.ParseClaimTicket(body)
+}
+
+func (rbk *restBackend) Claim(ctx context.Context, ticket name_manager.ClaimTicket, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	query := url.Values{"ticket": {ticket.String()}}
+	return rbk.getLease(ctx, ticket.Family, "/$claim"+acquireQuery(query, opts))
 }
 
 func (rbk *restBackend) KeepAlive(family, name string) error {
-	_, err := rbk.get(fmt.Sprintf("/family/%s/name/%s/$keep_alive", family, name))
+	return rbk.KeepAliveContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
+
+func (rbk *restBackend) KeepAliveContext(ctx context.Context, lease name_manager.Lease) error {
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/name/%s/$keep_alive?token=%d", lease.Family, lease.Name, lease.Token))
 	return err
 }
 
 func (rbk *restBackend) Release(family, name string) error {
-	_, err := rbk.get(fmt.Sprintf("/family/%s/name/%s/$release", family, name))
+	return rbk.ReleaseContext(context.Background(), name_manager.Lease{Family: family, Name: name})
+}
+
+func (rbk *restBackend) ReleaseContext(ctx context.Context, lease name_manager.Lease) error {
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/name/%s/$release?token=%d", lease.Family, lease.Name, lease.Token))
 	return err
 }
 
@@ -77,22 +165,36 @@ func (rbk *restBackend) TryHold(family, name string) (<-chan error, name_manager
 	return rbk.hold().TryHold(family, name)
 }
 
+func (rbk *restBackend) TryHoldContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (*name_manager.Holding, error) {
+	return rbk.hold().TryHoldContext(ctx, family, name, opts...)
+}
+
 func (rbk *restBackend) TryAcquire(family, name string) error {
-	body, err := rbk.get(fmt.Sprintf("/family/%s/name/%s/$try_acquire", family, name))
+	_, err := rbk.TryAcquireContext(context.Background(), family, name)
+	return err
+}
+
+func (rbk *restBackend) TryAcquireContext(ctx context.Context, family, name string, opts ...name_manager.AcquireOption) (name_manager.Lease, error) {
+	body, header, err := rbk.request(ctx, fmt.Sprintf(
+		"/family/%s/name/%s/$try_acquire%s", family, name, acquireQuery(url.Values{}, opts)))
 	if err != nil {
-		return err
+		return name_manager.Lease{}, err
 	}
 	if body == "ERR_NOT_EXIST" {
-		return name_manager.ErrNotExist
+		return name_manager.Lease{}, name_manager.ErrNotExist
 	}
 	if body == "ERR_IN_USE" {
-		return name_manager.ErrInUse
+		return name_manager.Lease{}, name_manager.ErrInUse
 	}
-	return nil
+	return parseLease(header, family, name)
 }
 
 func (rbk *restBackend) List() ([]name_manager.Name, error) {
-	body, err := rbk.get("/")
+	return rbk.ListContext(context.Background())
+}
+
+func (rbk *restBackend) ListContext(ctx context.Context) ([]name_manager.Name, error) {
+	body, err := rbk.get(ctx, "/")
 	if err != nil {
 		return nil, err
 	}
@@ -104,23 +206,239 @@ func (rbk *restBackend) List() ([]name_manager.Name, error) {
 }
 
 func (rbk *restBackend) Reset() error {
+	return rbk.ResetContext(context.Background())
+}
+
+func (rbk *restBackend) ResetContext(ctx context.Context) error {
 	if rbk.resetHook != nil {
 		rbk.resetHook()
 	}
-	_, err := rbk.get("/$reset")
+	_, err := rbk.get(ctx, "/$reset")
+	return err
+}
+
+func (rbk *restBackend) Reap(ctx context.Context, families ...string) ([]name_manager.Lease, error) {
+	path := "/$reap"
+	if len(families) > 0 {
+		path += "?" + url.Values{"family": families}.Encode()
+	}
+	body, err := rbk.get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var leases []name_manager.Lease
+	if err := json.Unmarshal([]byte(body), &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+func (rbk *restBackend) Delete(ctx context.Context, family, name string, opts ...name_manager.DeleteOption) error {
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/name/%s/$delete%s", family, name, deleteQuery(opts)))
 	return err
 }
 
-func (rbk *restBackend) get(endpoint string) (string, error) {
+func (rbk *restBackend) DeleteFamily(ctx context.Context, family string, opts ...name_manager.DeleteOption) error {
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/$delete%s", family, deleteQuery(opts)))
+	return err
+}
+
+func (rbk *restBackend) Enqueue(ctx context.Context, family string) (name_manager.Ticket, error) {
+	body, err := rbk.get(ctx, fmt.Sprintf("/family/%s/$enqueue", family))
+	if err != nil {
+		return name_manager.Ticket{}, err
+	}
+	var ticket name_manager.Ticket
+	if err := json.Unmarshal([]byte(body), &ticket); err != nil {
+		return name_manager.Ticket{}, err
+	}
+	return ticket, nil
+}
+
+// pollResult is the body of the response of the server to ticket polls.
+type pollResult struct {
+	// Name is the acquired name, or an empty string if the ticket
+	// is still waiting.
+	Name string `json:"name"`
+	// Token is the token of the lease on the acquired name.
+	Token int64 `json:"token"`
+	// Position is the position of the ticket in the queue.
+	Position int `json:"position"`
+}
+
+func (rbk *restBackend) PollTicket(ctx context.Context, family, ticketID string, opts ...name_manager.AcquireOption) (name_manager.Lease, int, error) {
+	body, err := rbk.get(ctx, fmt.Sprintf(
+		"/family/%s/ticket/%s/$poll%s", family, ticketID, acquireQuery(url.Values{}, opts)))
+	if err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	var result pollResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		return name_manager.Lease{}, 0, err
+	}
+	if result.Name == "" {
+		return name_manager.Lease{}, result.Position, nil
+	}
+	return name_manager.Lease{Family: family, Name: result.Name, Token: result.Token}, result.Position, nil
+}
+
+func (rbk *restBackend) CancelTicket(ctx context.Context, family, ticketID string) error {
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/ticket/%s/$cancel", family, ticketID))
+	return err
+}
+
+func (rbk *restBackend) Queue(ctx context.Context, family string) ([]name_manager.Ticket, error) {
+	body, err := rbk.get(ctx, fmt.Sprintf("/family/%s/$queue", family))
+	if err != nil {
+		return nil, err
+	}
+	var tickets []name_manager.Ticket
+	if err := json.Unmarshal([]byte(body), &tickets); err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+func (rbk *restBackend) SetFamilyLimit(ctx context.Context, family string, limit int) error {
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/$set_limit?limit=%d", family, limit))
+	return err
+}
+
+func (rbk *restBackend) GetAttributes(ctx context.Context, family, name string) (map[string]string, error) {
+	body, err := rbk.get(ctx, fmt.Sprintf("/family/%s/name/%s/$get_attributes", family, name))
+	if err != nil {
+		return nil, err
+	}
+	var attributes map[string]string
+	if err := json.Unmarshal([]byte(body), &attributes); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+func (rbk *restBackend) SetAttributes(ctx context.Context, family, name string, attributes map[string]string) error {
+	query := url.Values{}
+	for _, attribute := range name_manager.FormatKeyValues(attributes) {
+		query.Add("attribute", attribute)
+	}
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/name/%s/$set_attributes?%s", family, name, query.Encode()))
+	return err
+}
+
+func (rbk *restBackend) Quarantine(ctx context.Context, family, name, reason string) error {
+	query := url.Values{}
+	query.Set("reason", reason)
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/name/%s/$quarantine?%s", family, name, query.Encode()))
+	return err
+}
+
+func (rbk *restBackend) Unquarantine(ctx context.Context, family, name string) error {
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/name/%s/$unquarantine", family, name))
+	return err
+}
+
+func (rbk *restBackend) SetNameGenerator(ctx context.Context, family string, generator name_manager.NameGenerator) error {
+	query := url.Values{}
+	query.Set("generator", generator.Spec())
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/$set_generator?%s", family, query.Encode()))
+	return err
+}
+
+func (rbk *restBackend) DefinePool(ctx context.Context, family string, names []string) error {
+	query := url.Values{}
+	for _, name := range names {
+		query.Add("name", name)
+	}
+	_, err := rbk.get(ctx, fmt.Sprintf("/family/%s/$define_pool?%s", family, query.Encode()))
+	return err
+}
+
+// getLease sends a request to an endpoint that acquires a name.  The name
+// is in the body of the response, and the lease is in the headers (see
+// parseLease).
+func (rbk *restBackend) getLease(ctx context.Context, family, endpoint string) (name_manager.Lease, error) {
+	name, header, err := rbk.request(ctx, endpoint)
+	if err != nil {
+		return name_manager.Lease{}, err
+	}
+	return parseLease(header, family, name)
+}
+
+// acquireQuery adds the acquisition options to query parameters, and
+// returns the query string, including the leading "?", or an empty string
+// if there are no query parameters.
+func acquireQuery(query url.Values, opts []name_manager.AcquireOption) string {
+	options := name_manager.NewAcquireOptions(opts...)
+	for _, label := range name_manager.FormatKeyValues(options.Labels) {
+		query.Add("label", label)
+	}
+	if len(options.Selector) > 0 {
+		query.Set("selector", options.Selector.String())
+	}
+	if options.TTL > 0 {
+		query.Set("ttl", options.TTL.String())
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// deleteQuery gives the query string for deletion options.
+func deleteQuery(opts []name_manager.DeleteOption) string {
+	options := name_manager.NewDeleteOptions(opts...)
+	query := url.Values{}
+	if options.Force {
+		query.Set("force", "true")
+	}
+	if options.Recycle {
+		query.Set("recycle", "true")
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// parseLease parses the lease on an acquired name from the headers of a
+// response: the token is in the leaseTokenHeader header, and whether the
+// lease is the first lease on the name is in the leaseCreatedHeader
+// header.
+func parseLease(header http.Header, family, name string) (name_manager.Lease, error) {
+	token, err := strconv.ParseInt(header.Get(leaseTokenHeader), 10, 64)
+	if err != nil {
+		return name_manager.Lease{}, fmt.Errorf("invalid %s header: %v", leaseTokenHeader, err)
+	}
+	return name_manager.Lease{
+		Family:  family,
+		Name:    name,
+		Token:   token,
+		Created: header.Get(leaseCreatedHeader) == "true",
+	}, nil
+}
+
+func (rbk *restBackend) get(ctx context.Context, endpoint string) (string, error) {
+	body, _, err := rbk.request(ctx, endpoint)
+	return body, err
+}
+
+// request sends a GET request to an endpoint of the server, and returns
+// the body and the headers of the response.
+func (rbk *restBackend) request(ctx context.Context, endpoint string) (string, http.Header, error) {
 	var body string
+	var header http.Header
 	err := func() error {
-		resp, err := rbk.client.Get(rbk.url + endpoint)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rbk.url+endpoint, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := rbk.client.Do(req)
 		if err != nil {
 			return err
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode != 200 {
+		if resp.StatusCode != 200 && resp.StatusCode != 409 {
 			return fmt.Errorf("%s: non-200 status code: %s", endpoint, resp.Status)
 		}
 
@@ -129,18 +447,26 @@ func (rbk *restBackend) get(endpoint string) (string, error) {
 			return retry.Unrecoverable(err)
 		}
 		body = strings.TrimSpace(string(b))
+		header = resp.Header
+
+		if resp.StatusCode == 409 {
+			if err, ok := errorsByCode[body]; ok {
+				return err
+			}
+			return fmt.Errorf("%s: unknown error code: '%s'", endpoint, body)
+		}
 		return nil
 	}()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	return body, nil
+	return body, header, nil
 }
 
 func (rbk *restBackend) hold() *hold.Hold {
 	return &hold.Hold{
-		Manager:           rbk,
-		Clock:             rbk.clock,
-		KeepAliveInterval: rbk.options.keepAliveInterval,
+		Manager:         rbk,
+		Clock:           rbk.clock,
+		KeepAlivePolicy: rbk.options.keepAlive.Merge(name_manager.DefaultKeepAlivePolicy(0)),
 	}
 }
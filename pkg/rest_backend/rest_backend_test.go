@@ -85,11 +85,98 @@ func TestTryHold(t *testing.T) {
 	testutil.TestTryHold(t, mng, mockClock)
 }
 
+func TestContextCancellation(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestContextCancellation(t, mng)
+}
+
+func TestFamilyLimit(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestFamilyLimit(t, mng)
+}
+
+func TestAcquireWait(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestAcquireWait(t, mng)
+}
+
+func TestQueue(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestQueue(t, mng)
+}
+
+func TestLease(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestLease(t, mng)
+}
+
+func TestLabels(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestLabels(t, mng)
+}
+
+func TestAttributes(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestAttributes(t, mng)
+}
+
+func TestSelector(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestSelector(t, mng)
+}
+
+func TestNameGenerator(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestNameGenerator(t, mng)
+}
+
+func TestPool(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestPool(t, mng)
+}
+
+func TestAcquireMany(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestAcquireMany(t, mng)
+}
+
+func TestTransfer(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestTransfer(t, mng)
+}
+
+func TestQuarantine(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestQuarantine(t, mng)
+}
+
+func TestDelete(t *testing.T) {
+	mng, _ := createTestNameManager(t, 0)
+	testutil.TestDelete(t, mng)
+}
+
+func TestTTL(t *testing.T) {
+	mng, ts := createTestNameManager(t, 5, "maxTTL=20s")
+	mockClock := clock.NewMock()
+	mng.(*restBackend).clock = mockClock
+	ts.MockClock(mockClock)
+	testutil.TestTTL(t, mng, mockClock)
+}
+
+func TestReap(t *testing.T) {
+	mng, ts := createTestNameManager(t, 5)
+	mockClock := clock.NewMock()
+	mng.(*restBackend).clock = mockClock
+	ts.MockClock(mockClock)
+	testutil.TestReap(t, mng, mockClock)
+}
+
 func createTestNameManager(
 	t *testing.T,
 	autoReleaseAfter int,
+	options ...string,
 ) (name_manager.NameManager, *testserver.TestServer) {
-	ts, err := testserver.New(autoReleaseAfter)
+	ts, err := testserver.New(autoReleaseAfter, options...)
 	assert.Nil(t, err)
 
 	url := "localhost:%d"
@@ -6,12 +6,16 @@ package rest_backend
 import (
 	"errors"
 	"fmt"
+	"github.com/hchauvin/name_manager/pkg/name_manager"
 	"strings"
-	"time"
 )
 
 type options struct {
-	keepAliveInterval time.Duration
+	// keepAlive is the keep-alive policy.  By default, names are only
+	// kept alive when they are acquired with a TTL (see
+	// name_manager.WithTTL), which must not exceed the maximum TTL of
+	// the server.
+	keepAlive name_manager.KeepAlivePolicy
 }
 
 func parseBackendURL(backendURL string) (string, *options, error) {
@@ -34,15 +38,11 @@ func parseOptions(str []string) (*options, error) {
 		}
 		key := components[0]
 		value := components[1]
-		switch key {
-		case "keepAliveInterval":
-			var err error
-			opts.keepAliveInterval, err = time.ParseDuration(value)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse duration for keepAliveInterval: %v", err)
-			}
-
-		default:
+		ok, err := opts.keepAlive.SetOption(key, value)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
 			return nil, fmt.Errorf("unrecognized option \"%s\"", key)
 		}
 	}
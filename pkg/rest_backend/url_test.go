@@ -10,12 +10,14 @@ func TestParseBackendURL(t *testing.T) {
 	path, options, err := parseBackendURL("domain.test")
 	assert.NoError(t, err)
 	assert.Equal(t, "http://domain.test", path)
-	assert.Equal(t, 0*time.Second, options.keepAliveInterval)
+	assert.Equal(t, 0*time.Second, options.keepAlive.Interval)
 
-	path, options, err = parseBackendURL("domain.test;keepAliveInterval=15s")
+	path, options, err = parseBackendURL("domain.test;keepAliveInterval=15s;keepAliveJitter=0.1;keepAliveMaxFailures=5")
 	assert.NoError(t, err)
 	assert.Equal(t, "http://domain.test", path)
-	assert.Equal(t, 15*time.Second, options.keepAliveInterval)
+	assert.Equal(t, 15*time.Second, options.keepAlive.Interval)
+	assert.Equal(t, 0.1, options.keepAlive.Jitter)
+	assert.Equal(t, 5, options.keepAlive.MaxFailures)
 
 	_, _, err = parseBackendURL("domain.test;__invalid__")
 	assert.Error(t, err)
@@ -4,6 +4,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/hchauvin/name_manager/pkg/name_manager"
@@ -11,25 +12,210 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// pollResult is the body of the response to ticket polls.
+type pollResult struct {
+	// Name is the acquired name, or an empty string if the ticket
+	// is still waiting.
+	Name string `json:"name"`
+	// Token is the token of the lease on the acquired name.
+	Token int64 `json:"token"`
+	// Position is the position of the ticket in the queue.
+	Position int `json:"position"`
+}
+
+// errorCodes associates the errors that are part of the contract of
+// `name_manager.NameManager` with the codes that are sent to the clients,
+// in the body of 409 responses.
+var errorCodes = map[error]string{
+	name_manager.ErrFamilyFull:     "ERR_FAMILY_FULL",
+	name_manager.ErrTicketExpired:  "ERR_TICKET_EXPIRED",
+	name_manager.ErrLeaseLost:      "ERR_LEASE_LOST",
+	name_manager.ErrNotExist:       "ERR_NOT_EXIST",
+	name_manager.ErrNoMatchingName: "ERR_NO_MATCHING_NAME",
+	name_manager.ErrPoolExhausted:  "ERR_POOL_EXHAUSTED",
+	name_manager.ErrNotHeld:        "ERR_NOT_HELD",
+	name_manager.ErrInvalidClaim:   "ERR_INVALID_CLAIM",
+	name_manager.ErrInUse:          "ERR_IN_USE",
+}
+
+// leaseTokenHeader is the header in which the token of the lease on an
+// acquired name is sent to the clients.
+const leaseTokenHeader = "X-Lease-Token"
+
+// leaseCreatedHeader is the header that is set to "true" when the lease
+// on an acquired name is the first lease on the name (see Lease.Created).
+const leaseCreatedHeader = "X-Lease-Created"
+
 func Serve(listener net.Listener, nm name_manager.NameManager) error {
 	router := httprouter.New()
 	router.GET(
 		"/family/:family/$acquire",
 		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			family := p.ByName("family")
-			name, err := nm.Acquire(family)
+			opts, err := parseAcquireOptions(r)
 			if err != nil {
-				log.WithField("family", family).WithError(err).Error("could not acquire")
-				w.WriteHeader(500)
+				log.WithField("family", family).WithError(err).Error("invalid options")
+				w.WriteHeader(400)
+				return
+			}
+			var lease name_manager.Lease
+			if r.URL.Query().Get("wait") == "true" {
+				lease, err = nm.AcquireWait(r.Context(), family, opts...)
+			} else {
+				lease, err = nm.AcquireContext(r.Context(), family, opts...)
+			}
+			if err != nil {
+				writeError(w, log.WithField("family", family), err, "could not acquire")
 			} else {
 				log.WithFields(log.Fields{
 					"family": family,
-					"name":   name,
+					"name":   lease.Name,
+					"token":  lease.Token,
 				}).Info("name acquired")
+				writeLeaseToken(w, lease)
+				w.WriteHeader(200)
+				w.Write([]byte(lease.Name))
+			}
+		})
+	router.GET(
+		"/family/:family/$set_limit",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil {
+				log.WithField("family", family).WithError(err).Error("invalid limit")
+				w.WriteHeader(400)
+				return
+			}
+			err = nm.SetFamilyLimit(r.Context(), family, limit)
+			if err != nil {
+				log.WithField("family", family).WithError(err).Error("could not set limit")
+				w.WriteHeader(500)
+			} else {
+				log.WithFields(log.Fields{
+					"family": family,
+					"limit":  limit,
+				}).Info("limit set")
+				w.WriteHeader(200)
+			}
+		})
+	router.GET(
+		"/family/:family/$set_generator",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			generator, err := name_manager.ParseNameGenerator(r.URL.Query().Get("generator"))
+			if err != nil {
+				log.WithField("family", family).WithError(err).Error("invalid generator")
+				w.WriteHeader(400)
+				return
+			}
+			err = nm.SetNameGenerator(r.Context(), family, generator)
+			if err != nil {
+				log.WithField("family", family).WithError(err).Error("could not set generator")
+				w.WriteHeader(500)
+			} else {
+				log.WithFields(log.Fields{
+					"family":    family,
+					"generator": generator.Spec(),
+				}).Info("generator set")
+				w.WriteHeader(200)
+			}
+		})
+	router.GET(
+		"/family/:family/$define_pool",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			names := r.URL.Query()["name"]
+			if _, err := name_manager.NewPoolGenerator(names); err != nil {
+				log.WithField("family", family).WithError(err).Error("invalid pool")
+				w.WriteHeader(400)
+				return
+			}
+			err := nm.DefinePool(r.Context(), family, names)
+			if err != nil {
+				writeError(w, log.WithField("family", family), err, "could not define pool")
+			} else {
+				log.WithFields(log.Fields{
+					"family": family,
+					"names":  names,
+				}).Info("pool defined")
+				w.WriteHeader(200)
+			}
+		})
+	router.GET(
+		"/family/:family/$enqueue",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			ticket, err := nm.Enqueue(r.Context(), family)
+			if err != nil {
+				writeError(w, log.WithField("family", family), err, "could not enqueue")
+			} else {
+				log.WithFields(log.Fields{
+					"family":   family,
+					"ticket":   ticket.ID,
+					"position": ticket.Position,
+				}).Info("enqueued")
+				writeJSON(w, ticket)
+			}
+		})
+	router.GET(
+		"/family/:family/ticket/:ticket/$poll",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			ticketID := p.ByName("ticket")
+			opts, err := parseAcquireOptions(r)
+			if err != nil {
+				log.WithField("family", family).WithError(err).Error("invalid options")
+				w.WriteHeader(400)
+				return
+			}
+			lease, position, err := nm.PollTicket(r.Context(), family, ticketID, opts...)
+			logEntry := log.WithFields(log.Fields{
+				"family": family,
+				"ticket": ticketID,
+			})
+			if err != nil {
+				writeError(w, logEntry, err, "could not poll ticket")
+			} else {
+				logEntry.WithFields(log.Fields{
+					"name":     lease.Name,
+					"token":    lease.Token,
+					"position": position,
+				}).Debug("ticket polled")
+				writeJSON(w, pollResult{Name: lease.Name, Token: lease.Token, Position: position})
+			}
+		})
+	router.GET(
+		"/family/:family/ticket/:ticket/$cancel",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			ticketID := p.ByName("ticket")
+			err := nm.CancelTicket(r.Context(), family, ticketID)
+			logEntry := log.WithFields(log.Fields{
+				"family": family,
+				"ticket": ticketID,
+			})
+			if err != nil {
+				writeError(w, logEntry, err, "could not cancel ticket")
+			} else {
+				logEntry.Info("ticket cancelled")
 				w.WriteHeader(200)
-				w.Write([]byte(name))
+			}
+		})
+	router.GET(
+		"/family/:family/$queue",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			tickets, err := nm.Queue(r.Context(), family)
+			if err != nil {
+				writeError(w, log.WithField("family", family), err, "could not list queue")
+			} else {
+				log.WithField("family", family).Debug("queue")
+				writeJSON(w, tickets)
 			}
 		})
 	router.GET(
@@ -37,13 +223,18 @@ func Serve(listener net.Listener, nm name_manager.NameManager) error {
 		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			family := p.ByName("family")
 			name := p.ByName("name")
-			err := nm.KeepAlive(family, name)
+			lease, err := parseLease(r, family, name)
 			if err != nil {
-				log.WithFields(log.Fields{
+				log.WithField("family", family).WithError(err).Error("invalid token")
+				w.WriteHeader(400)
+				return
+			}
+			err = nm.KeepAliveContext(r.Context(), lease)
+			if err != nil {
+				writeError(w, log.WithFields(log.Fields{
 					"family": family,
 					"name":   name,
-				}).WithError(err).Error("keep alive errored")
-				w.WriteHeader(500)
+				}), err, "keep alive errored")
 			} else {
 				log.WithFields(log.Fields{
 					"family": family,
@@ -57,13 +248,18 @@ func Serve(listener net.Listener, nm name_manager.NameManager) error {
 		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			family := p.ByName("family")
 			name := p.ByName("name")
-			err := nm.Release(family, name)
+			lease, err := parseLease(r, family, name)
 			if err != nil {
-				log.WithFields(log.Fields{
+				log.WithField("family", family).WithError(err).Error("invalid token")
+				w.WriteHeader(400)
+				return
+			}
+			err = nm.ReleaseContext(r.Context(), lease)
+			if err != nil {
+				writeError(w, log.WithFields(log.Fields{
 					"family": family,
 					"name":   name,
-				}).WithError(err).Error("could not release")
-				w.WriteHeader(500)
+				}), err, "could not release")
 			} else {
 				log.WithFields(log.Fields{
 					"family": family,
@@ -77,7 +273,13 @@ func Serve(listener net.Listener, nm name_manager.NameManager) error {
 		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			family := p.ByName("family")
 			name := p.ByName("name")
-			err := nm.TryAcquire(family, name)
+			opts, err := parseAcquireOptions(r)
+			if err != nil {
+				log.WithField("family", family).WithError(err).Error("invalid options")
+				w.WriteHeader(400)
+				return
+			}
+			lease, err := nm.TryAcquireContext(r.Context(), family, name, opts...)
 			if err == name_manager.ErrNotExist {
 				log.WithFields(log.Fields{
 					"family":   family,
@@ -105,32 +307,224 @@ func Serve(listener net.Listener, nm name_manager.NameManager) error {
 					"family":   family,
 					"name":     name,
 					"response": "OK",
+					"token":    lease.Token,
 				}).Info("try acquire")
+				writeLeaseToken(w, lease)
 				w.WriteHeader(200)
 				w.Write([]byte("OK"))
 			}
 		})
+	router.GET(
+		"/family/:family/name/:name/$get_attributes",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			name := p.ByName("name")
+			attributes, err := nm.GetAttributes(r.Context(), family, name)
+			logEntry := log.WithFields(log.Fields{
+				"family": family,
+				"name":   name,
+			})
+			if err != nil {
+				writeError(w, logEntry, err, "could not get attributes")
+			} else {
+				logEntry.Debug("get attributes")
+				writeJSON(w, attributes)
+			}
+		})
+	router.GET(
+		"/family/:family/name/:name/$set_attributes",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			name := p.ByName("name")
+			logEntry := log.WithFields(log.Fields{
+				"family": family,
+				"name":   name,
+			})
+			attributes, err := name_manager.ParseKeyValues(r.URL.Query()["attribute"])
+			if err != nil {
+				logEntry.WithError(err).Error("invalid attributes")
+				w.WriteHeader(400)
+				return
+			}
+			err = nm.SetAttributes(r.Context(), family, name, attributes)
+			if err != nil {
+				writeError(w, logEntry, err, "could not set attributes")
+			} else {
+				logEntry.WithField("attributes", attributes).Info("attributes set")
+				w.WriteHeader(200)
+			}
+		})
+	router.GET(
+		"/family/:family/name/:name/$quarantine",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			name := p.ByName("name")
+			reason := r.URL.Query().Get("reason")
+			logEntry := log.WithFields(log.Fields{
+				"family": family,
+				"name":   name,
+			})
+			err := nm.Quarantine(r.Context(), family, name, reason)
+			if err != nil {
+				writeError(w, logEntry, err, "could not quarantine")
+			} else {
+				logEntry.WithField("reason", reason).Info("quarantined")
+				w.WriteHeader(200)
+			}
+		})
+	router.GET(
+		"/family/:family/name/:name/$unquarantine",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			name := p.ByName("name")
+			logEntry := log.WithFields(log.Fields{
+				"family": family,
+				"name":   name,
+			})
+			err := nm.Unquarantine(r.Context(), family, name)
+			if err != nil {
+				writeError(w, logEntry, err, "could not unquarantine")
+			} else {
+				logEntry.Info("unquarantined")
+				w.WriteHeader(200)
+			}
+		})
 	router.GET(
 		"/",
 		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-			names, err := nm.List()
+			names, err := nm.ListContext(r.Context())
 			if err != nil {
 				log.WithError(err).Error("list errored")
 				w.WriteHeader(500)
 			} else {
 				log.Debug("list")
+				writeJSON(w, names)
+			}
+		})
+	router.GET(
+		"/family/:family/name/:name/$transfer",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			name := p.ByName("name")
+			lease, err := parseLease(r, family, name)
+			if err != nil {
+				log.WithField("family", family).WithError(err).Error("invalid token")
+				w.WriteHeader(400)
+				return
+			}
+			ticket, err := nm.Transfer(r.Context(), lease)
+			logEntry := log.WithFields(log.Fields{
+				"family": family,
+				"name":   name,
+			})
+			if err != nil {
+				writeError(w, logEntry, err, "could not transfer")
+			} else {
+				logEntry.WithField("token", ticket.Token).Info("transfer prepared")
+				w.WriteHeader(200)
+				w.Write([]byte(ticket.String()))
+			}
+		})
+	router.GET(
+		"/$claim",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			ticket, err := name_manager.ParseClaimTicket(r.URL.Query().Get("ticket"))
+			if err != nil {
+				log.WithError(err).Error("invalid ticket")
+				w.WriteHeader(400)
+				return
+			}
+			opts, err := parseAcquireOptions(r)
+			if err != nil {
+				log.WithError(err).Error("invalid options")
+				w.WriteHeader(400)
+				return
+			}
+			lease, err := nm.Claim(r.Context(), ticket, opts...)
+			logEntry := log.WithFields(log.Fields{
+				"family": ticket.Family,
+				"name":   ticket.Name,
+			})
+			if err != nil {
+				writeError(w, logEntry, err, "could not claim")
+			} else {
+				logEntry.WithField("token", lease.Token).Info("name claimed")
+				writeLeaseToken(w, lease)
+				w.WriteHeader(200)
+				w.Write([]byte(lease.Name))
+			}
+		})
+	router.GET(
+		"/$acquire_many",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			counts, err := name_manager.ParseFamilyCounts(r.URL.Query()["family"])
+			if err != nil {
+				log.WithError(err).Error("invalid families")
+				w.WriteHeader(400)
+				return
+			}
+			opts, err := parseAcquireOptions(r)
+			if err != nil {
+				log.WithError(err).Error("invalid options")
+				w.WriteHeader(400)
+				return
+			}
+			leases, err := nm.AcquireMany(r.Context(), counts, opts...)
+			logEntry := log.WithField("families", name_manager.FormatFamilyCounts(counts))
+			if err != nil {
+				writeError(w, logEntry, err, "could not acquire")
+			} else {
+				logEntry.WithField("leases", leases).Info("names acquired")
+				writeJSON(w, leases)
+			}
+		})
+	router.GET(
+		"/$reap",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			families := r.URL.Query()["family"]
+			leases, err := nm.Reap(r.Context(), families...)
+			logEntry := log.WithField("families", families)
+			if err != nil {
+				writeError(w, logEntry, err, "could not reap")
+			} else {
+				logReaped(logEntry, leases)
+				writeJSON(w, leases)
+			}
+		})
+	router.GET(
+		"/family/:family/name/:name/$delete",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			name := p.ByName("name")
+			logEntry := log.WithFields(log.Fields{
+				"family": family,
+				"name":   name,
+			})
+			err := nm.Delete(r.Context(), family, name, parseDeleteOptions(r)...)
+			if err != nil {
+				writeError(w, logEntry, err, "could not delete")
+			} else {
+				logEntry.Info("name deleted")
+				w.WriteHeader(200)
+			}
+		})
+	router.GET(
+		"/family/:family/$delete",
+		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			family := p.ByName("family")
+			logEntry := log.WithField("family", family)
+			err := nm.DeleteFamily(r.Context(), family, parseDeleteOptions(r)...)
+			if err != nil {
+				writeError(w, logEntry, err, "could not delete family")
+			} else {
+				logEntry.Info("family deleted")
 				w.WriteHeader(200)
-				b, err := json.MarshalIndent(names, "", "  ")
-				if err != nil {
-					panic(fmt.Sprintf("%v", err))
-				}
-				w.Write(b)
 			}
 		})
 	router.GET(
 		"/$reset",
 		func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-			err := nm.Reset()
+			err := nm.ResetContext(r.Context())
 			if err != nil {
 				log.WithError(err).Error("reset errored")
 				w.WriteHeader(500)
@@ -148,3 +542,126 @@ func Serve(listener net.Listener, nm name_manager.NameManager) error {
 
 	return http.Serve(listener, router)
 }
+
+// Reap periodically releases the zombies of all the families (see
+// name_manager.NameManager.Reap), until the context is done.
+func Reap(ctx context.Context, nm name_manager.NameManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			leases, err := nm.Reap(ctx)
+			if err != nil {
+				log.WithError(err).Error("could not reap")
+				continue
+			}
+			logReaped(log.NewEntry(log.StandardLogger()), leases)
+		}
+	}
+}
+
+// logReaped logs the leases released by a reap.
+func logReaped(logEntry *log.Entry, leases []name_manager.Lease) {
+	for _, lease := range leases {
+		logEntry.WithFields(log.Fields{
+			"family": lease.Family,
+			"name":   lease.Name,
+			"token":  lease.Token,
+		}).Info("zombie released")
+	}
+	logEntry.WithField("count", len(leases)).Debug("reaped")
+}
+
+// writeError writes an error response.  Errors that are part of the
+// contract of `name_manager.NameManager` are sent with a 409 status
+// code, the other errors with a 500 status code.
+func writeError(w http.ResponseWriter, logEntry *log.Entry, err error, msg string) {
+	if code, ok := errorCodes[err]; ok {
+		logEntry.WithField("response", code).Info(msg)
+		w.WriteHeader(409)
+		w.Write([]byte(code))
+		return
+	}
+	logEntry.WithError(err).Error(msg)
+	w.WriteHeader(500)
+}
+
+// writeJSON writes a successful response with a JSON body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(fmt.Sprintf("%v", err))
+	}
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// writeLeaseToken sends the token of a lease, and whether the lease is
+// the first lease on the name, in the headers of a response.  It must be
+// called before the status code is written.
+func writeLeaseToken(w http.ResponseWriter, lease name_manager.Lease) {
+	w.Header().Set(leaseTokenHeader, strconv.FormatInt(lease.Token, 10))
+	if lease.Created {
+		w.Header().Set(leaseCreatedHeader, "true")
+	}
+}
+
+// parseLease gets a lease from the "token" query parameter of a request.
+// A missing token is parsed as a zero token, which matches any lease.
+func parseLease(r *http.Request, family, name string) (name_manager.Lease, error) {
+	lease := name_manager.Lease{Family: family, Name: name}
+	if tokenStr := r.URL.Query().Get("token"); tokenStr != "" {
+		token, err := strconv.ParseInt(tokenStr, 10, 64)
+		if err != nil {
+			return name_manager.Lease{}, err
+		}
+		lease.Token = token
+	}
+	return lease, nil
+}
+
+// parseAcquireOptions gets the acquisition options from the query
+// parameters of a request.  Labels are given with "label=key=value"
+// query parameters, the selector with a "selector" query parameter, and
+// the TTL of the lease with a "ttl" query parameter (e.g., "2h").
+func parseAcquireOptions(r *http.Request) ([]name_manager.AcquireOption, error) {
+	var opts []name_manager.AcquireOption
+	labels, err := name_manager.ParseKeyValues(r.URL.Query()["label"])
+	if err != nil {
+		return nil, err
+	}
+	if labels != nil {
+		opts = append(opts, name_manager.WithLabels(labels))
+	}
+	selector, err := name_manager.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		return nil, err
+	}
+	if selector != nil {
+		opts = append(opts, name_manager.WithSelector(selector))
+	}
+	if ttlStr := r.URL.Query().Get("ttl"); ttlStr != "" {
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse duration for ttl: %v", err)
+		}
+		opts = append(opts, name_manager.WithTTL(ttl))
+	}
+	return opts, nil
+}
+
+// parseDeleteOptions gets the deletion options from the "force" and
+// "recycle" query parameters of a request.
+func parseDeleteOptions(r *http.Request) []name_manager.DeleteOption {
+	var opts []name_manager.DeleteOption
+	if r.URL.Query().Get("force") == "true" {
+		opts = append(opts, name_manager.WithForce())
+	}
+	if r.URL.Query().Get("recycle") == "true" {
+		opts = append(opts, name_manager.WithRecycle())
+	}
+	return opts
+}
@@ -19,16 +19,21 @@ type TestServer struct {
 	Clean func()
 }
 
-func New(autoReleaseAfter int) (*TestServer, error) {
+// New creates a test server with a local backend.  The options are
+// additional options for the URL of the local backend.
+func New(autoReleaseAfter int, options ...string) (*TestServer, error) {
 	tmpfile, err := ioutil.TempFile("", "example")
 	if err != nil {
 		return nil, err
 	}
 
-	implURL := "local://" + tmpfile.Name()
+	implURL := "local://" + tmpfile.Name() + ";pollInterval=10ms"
 	if autoReleaseAfter > 0 {
 		implURL = implURL + fmt.Sprintf(";autoReleaseAfter=%ds", autoReleaseAfter)
 	}
+	for _, option := range options {
+		implURL = implURL + ";" + option
+	}
 
 	manager, err := name_manager.CreateFromURL(implURL)
 	if err != nil {
@@ -1,6 +1,8 @@
 package testutil
 
 import (
+	"context"
+	"errors"
 	"github.com/benbjohnson/clock"
 	"github.com/hchauvin/name_manager/pkg/name_manager"
 	"github.com/stretchr/testify/assert"
@@ -134,6 +136,7 @@ func TestList(t *testing.T, mng name_manager.NameManager, mockClock *clock.Mock)
 			CreatedAt: startTime,
 			UpdatedAt: startTime,
 			Free:      false,
+			Token:     1,
 		},
 		{
 			Name:      "0",
@@ -141,12 +144,14 @@ func TestList(t *testing.T, mng name_manager.NameManager, mockClock *clock.Mock)
 			CreatedAt: startTime.Add(2 * time.Second).UTC(),
 			UpdatedAt: startTime.Add(6 * time.Second).UTC(),
 			Free:      false,
+			Token:     2,
 		},
 		{
 			Name:      "1",
 			Family:    "foo",
 			CreatedAt: startTime.Add(4 * time.Second).UTC(),
 			Free:      true,
+			Token:     1,
 		},
 	}
 
@@ -330,6 +335,1032 @@ func TestTryHold(t *testing.T, mng name_manager.NameManager, mockClock *clock.Mo
 	assert.Equal(t, true, names[0].Free)
 }
 
+func TestContextCancellation(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := mng.AcquireContext(ctx, "foo")
+	assert.Error(t, err)
+
+	_, err = mng.TryAcquireContext(ctx, "foo", "0")
+	assert.Error(t, err)
+
+	_, err = mng.ListContext(ctx)
+	assert.Error(t, err)
+
+	// Nothing was acquired with the cancelled context.
+	names, err := mng.List()
+	assert.NoError(t, err)
+	assert.Len(t, names, 0)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lease, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lease.Name)
+
+	err = mng.KeepAliveContext(ctx, lease)
+	assert.NoError(t, err)
+
+	err = mng.ReleaseContext(ctx, lease)
+	assert.NoError(t, err)
+
+	_, err = mng.TryAcquireContext(ctx, "foo", "0")
+	assert.NoError(t, err)
+}
+
+func TestFamilyLimit(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	err := mng.SetFamilyLimit(ctx, "foo", 2)
+	assert.NoError(t, err)
+
+	name, err := mng.Acquire("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", name)
+
+	name, err = mng.Acquire("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", name)
+
+	_, err = mng.Acquire("foo")
+	assert.Equal(t, name_manager.ErrFamilyFull, err)
+
+	// The limit is specific to the family.
+	name, err = mng.Acquire("bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", name)
+
+	err = mng.Release("foo", "0")
+	assert.NoError(t, err)
+
+	name, err = mng.Acquire("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", name)
+
+	// Removing the limit allows new names to be registered.
+	err = mng.SetFamilyLimit(ctx, "foo", 0)
+	assert.NoError(t, err)
+
+	name, err = mng.Acquire("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", name)
+}
+
+func TestAcquireWait(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	err := mng.SetFamilyLimit(context.Background(), "foo", 1)
+	assert.NoError(t, err)
+
+	name, err := mng.Acquire("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", name)
+
+	// The family is at capacity: the wait times out.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = mng.AcquireWait(ctx, "foo")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+
+	// The wait ends when the name is released.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, mng.Release("foo", "0"))
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lease, err := mng.AcquireWait(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lease.Name)
+}
+
+func TestQueue(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	err := mng.SetFamilyLimit(ctx, "foo", 1)
+	assert.NoError(t, err)
+
+	name, err := mng.Acquire("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", name)
+
+	first, err := mng.Enqueue(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", first.Family)
+	assert.Equal(t, 0, first.Position)
+
+	second, err := mng.Enqueue(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, second.Position)
+	assert.NotEqual(t, first.ID, second.ID)
+
+	tickets, err := mng.Queue(ctx, "foo")
+	assert.NoError(t, err)
+	if assert.Len(t, tickets, 2) {
+		assert.Equal(t, first.ID, tickets[0].ID)
+		assert.Equal(t, 0, tickets[0].Position)
+		assert.Equal(t, second.ID, tickets[1].ID)
+		assert.Equal(t, 1, tickets[1].Position)
+	}
+
+	// Names are reserved for the waiters.
+	_, err = mng.Acquire("foo")
+	assert.Equal(t, name_manager.ErrFamilyFull, err)
+
+	lease, position, err := mng.PollTicket(ctx, "foo", first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", lease.Name)
+	assert.Equal(t, 0, position)
+
+	err = mng.Release("foo", "0")
+	assert.NoError(t, err)
+
+	// Only the head of the queue can acquire the released name.
+	lease, position, err = mng.PollTicket(ctx, "foo", second.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", lease.Name)
+	assert.Equal(t, 1, position)
+
+	lease, _, err = mng.PollTicket(ctx, "foo", first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lease.Name)
+
+	tickets, err = mng.Queue(ctx, "foo")
+	assert.NoError(t, err)
+	if assert.Len(t, tickets, 1) {
+		assert.Equal(t, second.ID, tickets[0].ID)
+		assert.Equal(t, 0, tickets[0].Position)
+	}
+
+	err = mng.CancelTicket(ctx, "foo", second.ID)
+	assert.NoError(t, err)
+
+	_, _, err = mng.PollTicket(ctx, "foo", second.ID)
+	assert.Equal(t, name_manager.ErrTicketExpired, err)
+
+	tickets, err = mng.Queue(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Len(t, tickets, 0)
+
+	// A waiter can enqueue before the first acquisition in a family, with
+	// or without a limit.
+	err = mng.SetFamilyLimit(ctx, "bar", 2)
+	assert.NoError(t, err)
+	for _, family := range []string{"bar", "baz"} {
+		ticket, err := mng.Enqueue(ctx, family)
+		assert.NoError(t, err)
+		lease, _, err = mng.PollTicket(ctx, family, ticket.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "0", lease.Name)
+		name, err = mng.Acquire(family)
+		assert.NoError(t, err)
+		assert.Equal(t, "1", name)
+	}
+	_, err = mng.Acquire("bar")
+	assert.Equal(t, name_manager.ErrFamilyFull, err)
+
+	// In a family without limit, the free names are reserved for the
+	// waiters, but new names can still be acquired.
+	ticket, err := mng.Enqueue(ctx, "baz")
+	assert.NoError(t, err)
+	err = mng.Release("baz", "0")
+	assert.NoError(t, err)
+	name, err = mng.Acquire("baz")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", name)
+	lease, _, err = mng.PollTicket(ctx, "baz", ticket.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lease.Name)
+}
+
+func TestLease(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	first, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", first.Family)
+	assert.Equal(t, "0", first.Name)
+	assert.True(t, first.Token > 0)
+
+	err = mng.KeepAliveContext(ctx, first)
+	assert.NoError(t, err)
+
+	// The name is released on behalf of the holder, e.g., because
+	// it was not kept alive, then acquired again.
+	err = mng.Release("foo", "0")
+	assert.NoError(t, err)
+
+	second, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", second.Name)
+	assert.True(t, second.Token > first.Token)
+
+	// The first lease is lost.
+	err = mng.KeepAliveContext(ctx, first)
+	assert.Equal(t, name_manager.ErrLeaseLost, err)
+
+	err = mng.ReleaseContext(ctx, first)
+	assert.Equal(t, name_manager.ErrLeaseLost, err)
+
+	names, err := mng.List()
+	assert.NoError(t, err)
+	if assert.Len(t, names, 1) {
+		assert.False(t, names[0].Free)
+		assert.Equal(t, second.Token, names[0].Token)
+	}
+
+	err = mng.ReleaseContext(ctx, second)
+	assert.NoError(t, err)
+
+	// A released name is not held anymore.
+	err = mng.KeepAliveContext(ctx, second)
+	assert.Equal(t, name_manager.ErrNotHeld, err)
+	err = mng.KeepAlive("foo", "0")
+	assert.Equal(t, name_manager.ErrNotHeld, err)
+	err = mng.KeepAlive("foo", "__unknown__")
+	assert.Equal(t, name_manager.ErrNotHeld, err)
+
+	third, err := mng.TryAcquireContext(ctx, "foo", "0")
+	assert.NoError(t, err)
+	assert.True(t, third.Token > second.Token)
+
+	err = mng.ReleaseContext(ctx, third)
+	assert.NoError(t, err)
+}
+
+func TestLabels(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+	labels := map[string]string{"host": "ci-3", "job": "https://ci/jobs/1"}
+
+	foo, err := mng.AcquireContext(ctx, "foo", name_manager.WithLabels(labels))
+	assert.NoError(t, err)
+
+	_, err = mng.AcquireContext(ctx, "bar")
+	assert.NoError(t, err)
+
+	names, err := mng.List()
+	assert.NoError(t, err)
+	if assert.Len(t, names, 2) {
+		for _, name := range names {
+			if name.Family == "foo" {
+				assert.Equal(t, labels, name.Labels)
+			} else {
+				assert.Empty(t, name.Labels)
+			}
+		}
+	}
+
+	// Free names have no labels.
+	err = mng.ReleaseContext(ctx, foo)
+	assert.NoError(t, err)
+
+	names, err = mng.List()
+	assert.NoError(t, err)
+	for _, name := range names {
+		assert.Empty(t, name.Labels)
+	}
+
+	// The labels of the new holder replace the labels of the previous one.
+	otherLabels := map[string]string{"host": "ci-4"}
+	_, err = mng.TryAcquireContext(ctx, "foo", "0", name_manager.WithLabels(otherLabels))
+	assert.NoError(t, err)
+
+	names, err = mng.List()
+	assert.NoError(t, err)
+	for _, name := range names {
+		if name.Family == "foo" {
+			assert.Equal(t, otherLabels, name.Labels)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	_, err := mng.GetAttributes(ctx, "foo", "0")
+	assert.Equal(t, name_manager.ErrNotExist, err)
+	err = mng.SetAttributes(ctx, "foo", "0", map[string]string{"profile": "large"})
+	assert.Equal(t, name_manager.ErrNotExist, err)
+
+	large, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	small, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+
+	attributes, err := mng.GetAttributes(ctx, "foo", large.Name)
+	assert.NoError(t, err)
+	assert.Empty(t, attributes)
+
+	err = mng.SetAttributes(ctx, "foo", large.Name, map[string]string{"profile": "large", "region": "eu"})
+	assert.NoError(t, err)
+	err = mng.SetAttributes(ctx, "foo", small.Name, map[string]string{"profile": "small"})
+	assert.NoError(t, err)
+
+	// Attributes are merged, and empty values remove attributes.
+	err = mng.SetAttributes(ctx, "foo", large.Name, map[string]string{"region": "", "gpu": "true"})
+	assert.NoError(t, err)
+	attributes, err = mng.GetAttributes(ctx, "foo", large.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"profile": "large", "gpu": "true"}, attributes)
+
+	// Attributes survive release.
+	err = mng.ReleaseContext(ctx, large)
+	assert.NoError(t, err)
+	err = mng.ReleaseContext(ctx, small)
+	assert.NoError(t, err)
+
+	names, err := mng.List()
+	assert.NoError(t, err)
+	if assert.Len(t, names, 2) {
+		for _, name := range names {
+			if name.Name == large.Name {
+				assert.Equal(t, map[string]string{"profile": "large", "gpu": "true"}, name.Attributes)
+			} else {
+				assert.Equal(t, map[string]string{"profile": "small"}, name.Attributes)
+			}
+		}
+	}
+
+	// Only a free name with the required attributes is acquired.
+	lease, err := mng.AcquireContext(ctx, "foo", name_manager.WithRequiredAttributes(map[string]string{"profile": "large"}))
+	assert.NoError(t, err)
+	assert.Equal(t, large.Name, lease.Name)
+
+	// The name with the required attributes is in use.
+	_, err = mng.AcquireContext(ctx, "foo", name_manager.WithRequiredAttributes(map[string]string{"profile": "large"}))
+	assert.Equal(t, name_manager.ErrFamilyFull, err)
+
+	_, err = mng.AcquireContext(ctx, "foo", name_manager.WithRequiredAttributes(map[string]string{"profile": "medium"}))
+	assert.Equal(t, name_manager.ErrNoMatchingName, err)
+
+	// Attributes survive acquisition.
+	attributes, err = mng.GetAttributes(ctx, "foo", large.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"profile": "large", "gpu": "true"}, attributes)
+}
+
+func TestSelector(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	var leases []name_manager.Lease
+	for _, attributes := range []map[string]string{
+		{"profile": "large", "region": "eu"},
+		{"profile": "large", "region": "us"},
+		{"profile": "small"},
+	} {
+		lease, err := mng.AcquireContext(ctx, "foo")
+		assert.NoError(t, err)
+		err = mng.SetAttributes(ctx, "foo", lease.Name, attributes)
+		assert.NoError(t, err)
+		leases = append(leases, lease)
+	}
+	for _, lease := range leases {
+		err := mng.ReleaseContext(ctx, lease)
+		assert.NoError(t, err)
+	}
+
+	selector := name_manager.MustParseSelector("profile=large,region!=eu")
+	lease, err := mng.AcquireContext(ctx, "foo", name_manager.WithSelector(selector))
+	assert.NoError(t, err)
+	assert.Equal(t, leases[1].Name, lease.Name)
+
+	// The matching name is in use: the acquisition can wait for it to
+	// be released.
+	_, err = mng.AcquireContext(ctx, "foo", name_manager.WithSelector(selector))
+	assert.Equal(t, name_manager.ErrFamilyFull, err)
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, mng.ReleaseContext(ctx, lease))
+	}()
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	lease, err = mng.AcquireWait(waitCtx, "foo", name_manager.WithSelector(selector))
+	assert.NoError(t, err)
+	assert.Equal(t, leases[1].Name, lease.Name)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "expected AcquireWait to wait for the release")
+
+	_, err = mng.AcquireContext(ctx, "foo", name_manager.WithSelector(name_manager.MustParseSelector("profile=medium")))
+	assert.Equal(t, name_manager.ErrNoMatchingName, err)
+
+	// A new name, without attributes, is registered when it matches
+	// the selector.
+	lease, err = mng.AcquireContext(ctx, "foo", name_manager.WithSelector(name_manager.MustParseSelector("profile!=small,region!=eu")))
+	assert.NoError(t, err)
+	assert.Equal(t, "3", lease.Name)
+
+	// ... but not when the family is at capacity.
+	err = mng.SetFamilyLimit(ctx, "foo", 4)
+	assert.NoError(t, err)
+	_, err = mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	_, err = mng.AcquireContext(ctx, "foo", name_manager.WithSelector(name_manager.MustParseSelector("profile!=small")))
+	assert.Equal(t, name_manager.ErrFamilyFull, err)
+
+	lease, err = mng.AcquireContext(ctx, "foo", name_manager.WithSelector(name_manager.MustParseSelector("profile=small")))
+	assert.NoError(t, err)
+	assert.Equal(t, leases[2].Name, lease.Name)
+}
+
+func TestNameGenerator(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	generator, err := name_manager.ParseNameGenerator("counter:ci-stack-%03d")
+	assert.NoError(t, err)
+	err = mng.SetNameGenerator(ctx, "foo", generator)
+	assert.NoError(t, err)
+
+	lease, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci-stack-000", lease.Name)
+	lease, err = mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci-stack-001", lease.Name)
+
+	// No name is generated once the pool is exhausted.
+	generator, err = name_manager.ParseNameGenerator("pool:host-a,host-b")
+	assert.NoError(t, err)
+	err = mng.SetNameGenerator(ctx, "bar", generator)
+	assert.NoError(t, err)
+
+	hostA, err := mng.AcquireContext(ctx, "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "host-a", hostA.Name)
+	lease, err = mng.AcquireContext(ctx, "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "host-b", lease.Name)
+	_, err = mng.AcquireContext(ctx, "bar")
+	assert.Equal(t, name_manager.ErrPoolExhausted, err)
+
+	// Free names are reused before new names are generated.
+	err = mng.ReleaseContext(ctx, hostA)
+	assert.NoError(t, err)
+	lease, err = mng.AcquireContext(ctx, "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "host-a", lease.Name)
+
+	// Generated names that are already registered are skipped.
+	generator, err = name_manager.ParseNameGenerator("pool:host-a,host-b,host-c")
+	assert.NoError(t, err)
+	err = mng.SetNameGenerator(ctx, "baz", generator)
+	assert.NoError(t, err)
+	_, err = mng.AcquireContext(ctx, "baz")
+	assert.NoError(t, err)
+	generator, err = name_manager.ParseNameGenerator("pool:host-c,host-a,host-d")
+	assert.NoError(t, err)
+	err = mng.SetNameGenerator(ctx, "baz", generator)
+	assert.NoError(t, err)
+	lease, err = mng.AcquireContext(ctx, "baz")
+	assert.NoError(t, err)
+	assert.Equal(t, "host-d", lease.Name)
+
+	generator, err = name_manager.ParseNameGenerator("uuid")
+	assert.NoError(t, err)
+	err = mng.SetNameGenerator(ctx, "qux", generator)
+	assert.NoError(t, err)
+	lease, err = mng.AcquireContext(ctx, "qux")
+	assert.NoError(t, err)
+	assert.Len(t, lease.Name, 36)
+}
+
+func TestPool(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	err := mng.DefinePool(ctx, "kafka", []string{"host-a", "host-b"})
+	assert.NoError(t, err)
+
+	// The names of the pool are registered right away.
+	names, err := mng.List()
+	assert.NoError(t, err)
+	if assert.Len(t, names, 2) {
+		for _, name := range names {
+			assert.Equal(t, "kafka", name.Family)
+			assert.True(t, name.Free)
+			assert.True(t, name.Pool)
+		}
+	}
+
+	first, err := mng.AcquireContext(ctx, "kafka")
+	assert.NoError(t, err)
+	second, err := mng.AcquireContext(ctx, "kafka")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"host-a", "host-b"}, []string{first.Name, second.Name})
+	// The names of the pool are created on their first acquisition.
+	assert.True(t, first.Created)
+	assert.True(t, second.Created)
+
+	_, err = mng.AcquireContext(ctx, "kafka")
+	assert.Equal(t, name_manager.ErrPoolExhausted, err)
+
+	// The wait ends when a name of the pool is released.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, mng.ReleaseContext(ctx, second))
+	}()
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	lease, err := mng.AcquireWait(waitCtx, "kafka")
+	assert.NoError(t, err)
+	assert.Equal(t, second.Name, lease.Name)
+	assert.False(t, lease.Created)
+
+	// The names of a pool that are released are reserved for the waiters.
+	ticket, err := mng.Enqueue(ctx, "kafka")
+	assert.NoError(t, err)
+	err = mng.ReleaseContext(ctx, lease)
+	assert.NoError(t, err)
+	_, err = mng.AcquireContext(ctx, "kafka")
+	assert.Equal(t, name_manager.ErrPoolExhausted, err)
+	lease, _, err = mng.PollTicket(ctx, "kafka", ticket.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Name, lease.Name)
+
+	// Polling a ticket while the pool is exhausted has no side effect.
+	ticket, err = mng.Enqueue(ctx, "kafka")
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		lease, _, err := mng.PollTicket(ctx, "kafka", ticket.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "", lease.Name)
+	}
+	err = mng.CancelTicket(ctx, "kafka", ticket.ID)
+	assert.NoError(t, err)
+
+	// A pool can be extended...
+	err = mng.DefinePool(ctx, "kafka", []string{"host-a", "host-b", "host-c"})
+	assert.NoError(t, err)
+	lease, err = mng.AcquireContext(ctx, "kafka")
+	assert.NoError(t, err)
+	assert.Equal(t, "host-c", lease.Name)
+	_, err = mng.AcquireContext(ctx, "kafka")
+	assert.Equal(t, name_manager.ErrPoolExhausted, err)
+
+	// ... but cannot leave out registered names.
+	err = mng.DefinePool(ctx, "kafka", []string{"host-a", "host-c"})
+	assert.Error(t, err)
+
+	// Names outside of a pool are not members of the pool.
+	_, err = mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	names, err = mng.List()
+	assert.NoError(t, err)
+	for _, name := range names {
+		assert.Equal(t, name.Family == "kafka", name.Pool)
+	}
+}
+
+func TestAcquireMany(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	leases, err := mng.AcquireMany(ctx, map[string]int{"db": 1, "broker": 2})
+	assert.NoError(t, err)
+	if assert.Len(t, leases, 3) {
+		// The leases are sorted by family.
+		assert.Equal(t, "broker", leases[0].Family)
+		assert.Equal(t, "broker", leases[1].Family)
+		assert.Equal(t, "db", leases[2].Family)
+		assert.ElementsMatch(t, []string{"0", "1"}, []string{leases[0].Name, leases[1].Name})
+		assert.Equal(t, "0", leases[2].Name)
+	}
+
+	// When a family is full, no name is acquired.
+	err = mng.SetFamilyLimit(ctx, "broker", 3)
+	assert.NoError(t, err)
+	_, err = mng.AcquireMany(ctx, map[string]int{"db": 1, "broker": 2, "cache": 1})
+	assert.Equal(t, name_manager.ErrFamilyFull, err)
+
+	names, err := mng.List()
+	assert.NoError(t, err)
+	acquired := 0
+	for _, name := range names {
+		assert.NotEqual(t, "cache", name.Family)
+		if !name.Free {
+			acquired++
+		}
+	}
+	assert.Equal(t, 3, acquired)
+
+	// Releasing the holdings releases all the names.
+	for _, lease := range leases {
+		assert.NoError(t, mng.ReleaseContext(ctx, lease))
+	}
+	holdings, err := mng.HoldMany(ctx, map[string]int{"db": 2, "broker": 1})
+	assert.NoError(t, err)
+	assert.Len(t, holdings.Leases, 3)
+	err = holdings.Release()
+	assert.NoError(t, err)
+
+	names, err = mng.List()
+	assert.NoError(t, err)
+	for _, name := range names {
+		assert.True(t, name.Free, "%s:%s should be free", name.Family, name.Name)
+	}
+
+	_, err = mng.AcquireMany(ctx, map[string]int{"db": 0})
+	assert.Error(t, err)
+}
+
+func TestTransfer(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	first, err := mng.AcquireContext(ctx, "foo", name_manager.WithLabels(map[string]string{"job": "setup"}))
+	assert.NoError(t, err)
+
+	ticket, err := mng.Transfer(ctx, first)
+	assert.NoError(t, err)
+	assert.Equal(t, bareLease(first), ticket.Lease)
+
+	// The name is still held with the lease until it is claimed.
+	err = mng.KeepAliveContext(ctx, first)
+	assert.NoError(t, err)
+
+	// The ticket can be passed around as a string.
+	parsed, err := name_manager.ParseClaimTicket(ticket.String())
+	assert.NoError(t, err)
+
+	second, err := mng.Claim(ctx, parsed, name_manager.WithLabels(map[string]string{"job": "tests"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", second.Family)
+	assert.Equal(t, first.Name, second.Name)
+	assert.Equal(t, first.Token+1, second.Token)
+
+	names, err := mng.List()
+	assert.NoError(t, err)
+	if assert.Len(t, names, 1) {
+		assert.False(t, names[0].Free)
+		assert.Equal(t, second.Token, names[0].Token)
+		assert.Equal(t, map[string]string{"job": "tests"}, names[0].Labels)
+	}
+
+	// The transferred lease is lost, and the ticket cannot be claimed
+	// twice.
+	err = mng.KeepAliveContext(ctx, first)
+	assert.Equal(t, name_manager.ErrLeaseLost, err)
+	_, err = mng.Claim(ctx, ticket)
+	assert.Equal(t, name_manager.ErrInvalidClaim, err)
+
+	// A new transfer invalidates the previous ticket.
+	ticket, err = mng.Transfer(ctx, second)
+	assert.NoError(t, err)
+	newTicket, err := mng.Transfer(ctx, second)
+	assert.NoError(t, err)
+	_, err = mng.Claim(ctx, ticket)
+	assert.Equal(t, name_manager.ErrInvalidClaim, err)
+
+	// A released name cannot be claimed.
+	err = mng.ReleaseContext(ctx, second)
+	assert.NoError(t, err)
+	_, err = mng.Claim(ctx, newTicket)
+	assert.Equal(t, name_manager.ErrInvalidClaim, err)
+
+	_, err = mng.Transfer(ctx, second)
+	assert.Equal(t, name_manager.ErrNotHeld, err)
+}
+
+// TestQuarantine tests that the quarantined names are skipped by the
+// acquisitions.
+func TestQuarantine(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	err := mng.Quarantine(ctx, "foo", "0", "never acquired")
+	assert.Equal(t, name_manager.ErrNotExist, err)
+
+	lease, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lease.Name)
+
+	// A name can be quarantined while it is held.
+	err = mng.Quarantine(ctx, "foo", "0", "cleanup failed")
+	assert.NoError(t, err)
+	err = mng.ReleaseContext(ctx, lease)
+	assert.NoError(t, err)
+
+	names, err := mng.List()
+	assert.NoError(t, err)
+	if assert.Len(t, names, 1) {
+		assert.True(t, names[0].Free)
+		assert.Equal(t, "cleanup failed", names[0].Quarantine)
+		assert.Empty(t, names[0].Attributes)
+	}
+	attributes, err := mng.GetAttributes(ctx, "foo", "0")
+	assert.NoError(t, err)
+	assert.Empty(t, attributes)
+
+	lease, err = mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", lease.Name)
+	err = mng.ReleaseContext(ctx, lease)
+	assert.NoError(t, err)
+
+	leases, err := mng.AcquireMany(ctx, map[string]int{"foo": 1})
+	assert.NoError(t, err)
+	if assert.Len(t, leases, 1) {
+		assert.Equal(t, "1", leases[0].Name)
+		err = mng.ReleaseContext(ctx, leases[0])
+		assert.NoError(t, err)
+	}
+
+	// A quarantined name can still be acquired explicitly.
+	lease, err = mng.TryAcquireContext(ctx, "foo", "0")
+	assert.NoError(t, err)
+	err = mng.ReleaseContext(ctx, lease)
+	assert.NoError(t, err)
+
+	err = mng.Unquarantine(ctx, "foo", "0")
+	assert.NoError(t, err)
+
+	names, err = mng.List()
+	assert.NoError(t, err)
+	for _, name := range names {
+		assert.Empty(t, name.Quarantine)
+	}
+
+	lease, err = mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lease.Name)
+
+	// In a family at capacity, the free names that are not quarantined
+	// are still acquired.
+	err = mng.SetFamilyLimit(ctx, "bar", 2)
+	assert.NoError(t, err)
+	leases, err = mng.AcquireMany(ctx, map[string]int{"bar": 2})
+	assert.NoError(t, err)
+	for _, lease := range leases {
+		err = mng.ReleaseContext(ctx, lease)
+		assert.NoError(t, err)
+	}
+	err = mng.Quarantine(ctx, "bar", "0", "")
+	assert.NoError(t, err)
+	lease, err = mng.AcquireContext(ctx, "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", lease.Name)
+
+	// Without a reason, the reason for the quarantine is unknown.
+	names, err = mng.List()
+	assert.NoError(t, err)
+	for _, name := range names {
+		if name.Family == "bar" && name.Name == "0" {
+			assert.Equal(t, "unknown", name.Quarantine)
+		}
+	}
+}
+
+func TestDelete(t *testing.T, mng name_manager.NameManager) {
+	defer reset(mng)
+
+	ctx := context.Background()
+
+	leases := make([]name_manager.Lease, 3)
+	for i := range leases {
+		lease, err := mng.AcquireContext(ctx, "foo")
+		assert.NoError(t, err)
+		leases[i] = lease
+	}
+
+	err := mng.Delete(ctx, "foo", "1")
+	assert.Equal(t, name_manager.ErrInUse, err)
+	err = mng.Delete(ctx, "foo", "9")
+	assert.Equal(t, name_manager.ErrNotExist, err)
+
+	err = mng.ReleaseContext(ctx, leases[1])
+	assert.NoError(t, err)
+	err = mng.Delete(ctx, "foo", "1")
+	assert.NoError(t, err)
+
+	names, err := mng.List()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"0", "2"}, nameStrings(names))
+
+	// A deleted name is not generated again.
+	lease, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", lease.Name)
+
+	// A forced deletion makes the holder lose its lease.
+	err = mng.Delete(ctx, "foo", "2", name_manager.WithForce())
+	assert.NoError(t, err)
+	err = mng.KeepAliveContext(ctx, leases[2])
+	assert.Equal(t, name_manager.ErrLeaseLost, err)
+
+	// Recycled names are generated again, lowest first.
+	err = mng.Delete(ctx, "foo", "3", name_manager.WithForce(), name_manager.WithRecycle())
+	assert.NoError(t, err)
+	err = mng.Delete(ctx, "foo", "0", name_manager.WithForce(), name_manager.WithRecycle())
+	assert.NoError(t, err)
+	for _, expected := range []string{"0", "3", "4"} {
+		lease, err := mng.AcquireContext(ctx, "foo")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, lease.Name)
+		// The tokens of a recycled name keep increasing.
+		if expected == "0" {
+			assert.Greater(t, lease.Token, leases[0].Token)
+		}
+	}
+	err = mng.KeepAliveContext(ctx, leases[0])
+	assert.Equal(t, name_manager.ErrLeaseLost, err)
+
+	// The deleted names do not count toward the limit.
+	err = mng.SetFamilyLimit(ctx, "bar", 1)
+	assert.NoError(t, err)
+	lease, err = mng.AcquireContext(ctx, "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lease.Name)
+	err = mng.Delete(ctx, "bar", "0", name_manager.WithForce())
+	assert.NoError(t, err)
+	lease, err = mng.AcquireContext(ctx, "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", lease.Name)
+
+	// The names created after a deletion are brand-new.
+	var calls []string
+	hooks := name_manager.Hooks{
+		OnCreate: func(ctx context.Context, lease name_manager.Lease) error {
+			calls = append(calls, "create "+lease.Name)
+			return nil
+		},
+		OnAcquire: func(ctx context.Context, lease name_manager.Lease) error {
+			calls = append(calls, "acquire "+lease.Name)
+			return nil
+		},
+	}
+	lease, err = mng.AcquireContext(ctx, "baz")
+	assert.NoError(t, err)
+	assert.True(t, lease.Created)
+	err = mng.Delete(ctx, "baz", "0", name_manager.WithForce())
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		holding, err := mng.HoldContext(ctx, "baz", name_manager.WithHooks(hooks))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "1", holding.Name)
+			assert.Equal(t, i == 0, holding.Created)
+			err = holding.Release()
+			assert.NoError(t, err)
+		}
+	}
+	assert.Equal(t, []string{"create 1", "acquire 1"}, calls)
+
+	err = mng.DeleteFamily(ctx, "foo")
+	assert.Equal(t, name_manager.ErrInUse, err)
+	err = mng.DeleteFamily(ctx, "foo", name_manager.WithForce())
+	assert.NoError(t, err)
+	err = mng.DeleteFamily(ctx, "baz")
+	assert.NoError(t, err)
+
+	names, err = mng.List()
+	assert.NoError(t, err)
+	if assert.Len(t, names, 1) {
+		assert.Equal(t, "bar", names[0].Family)
+	}
+
+	// The names of a deleted family are generated from scratch.
+	lease, err = mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", lease.Name)
+}
+
+// bareLease returns a lease as it is given by the backends outside of
+// acquisitions, e.g., when it is reaped: whether the name was created
+// is only reported on acquisition.
+func bareLease(lease name_manager.Lease) name_manager.Lease {
+	return name_manager.Lease{Family: lease.Family, Name: lease.Name, Token: lease.Token}
+}
+
+// nameStrings returns the names of a list of names.
+func nameStrings(names []name_manager.Name) []string {
+	strs := make([]string, len(names))
+	for i, name := range names {
+		strs[i] = name.Name
+	}
+	return strs
+}
+
+// TestTTL tests the TTL of the leases.  The backend must release the
+// names after 5s by default, and have a maximum TTL of 20s.
+func TestTTL(t *testing.T, mng name_manager.NameManager, mockClock *clock.Mock) {
+	defer reset(mng)
+
+	wait := func(d time.Duration) {
+		if mockClock != nil {
+			mockClock.Add(d)
+		} else {
+			time.Sleep(d)
+		}
+	}
+
+	ctx := context.Background()
+
+	long, err := mng.AcquireContext(ctx, "foo", name_manager.WithTTL(10*time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, "0", long.Name)
+	short, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", short.Name)
+	capped, err := mng.AcquireContext(ctx, "foo", name_manager.WithTTL(1*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, "2", capped.Name)
+
+	wait(7 * time.Second)
+
+	// Only the name with the default TTL is released.
+	_, err = mng.TryAcquireContext(ctx, "foo", "0")
+	assert.Equal(t, name_manager.ErrInUse, err)
+	lease, err := mng.TryAcquireContext(ctx, "foo", "1")
+	assert.NoError(t, err)
+	err = mng.ReleaseContext(ctx, lease)
+	assert.NoError(t, err)
+
+	wait(5 * time.Second)
+
+	lease, err = mng.TryAcquireContext(ctx, "foo", "0")
+	assert.NoError(t, err)
+	err = mng.ReleaseContext(ctx, lease)
+	assert.NoError(t, err)
+	_, err = mng.TryAcquireContext(ctx, "foo", "2")
+	assert.Equal(t, name_manager.ErrInUse, err)
+
+	wait(10 * time.Second)
+
+	// The TTL of the last name is capped.
+	_, err = mng.TryAcquireContext(ctx, "foo", "2")
+	assert.NoError(t, err)
+}
+
+// TestReap tests the collection of the zombies.  The backend must
+// release the names after 5s by default.
+func TestReap(t *testing.T, mng name_manager.NameManager, mockClock *clock.Mock) {
+	defer reset(mng)
+
+	wait := func(d time.Duration) {
+		if mockClock != nil {
+			mockClock.Add(d)
+		} else {
+			time.Sleep(d)
+		}
+	}
+
+	ctx := context.Background()
+
+	foo, err := mng.AcquireContext(ctx, "foo")
+	assert.NoError(t, err)
+	bar, err := mng.AcquireContext(ctx, "bar")
+	assert.NoError(t, err)
+	baz, err := mng.AcquireContext(ctx, "baz")
+	assert.NoError(t, err)
+
+	leases, err := mng.Reap(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, leases)
+
+	wait(7 * time.Second)
+
+	// The zombies are still held until they are collected.
+	err = mng.KeepAliveContext(ctx, baz)
+	assert.NoError(t, err)
+
+	leases, err = mng.Reap(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []name_manager.Lease{bareLease(foo)}, leases)
+
+	leases, err = mng.Reap(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []name_manager.Lease{bareLease(bar)}, leases)
+
+	names, err := mng.ListContext(ctx)
+	assert.NoError(t, err)
+	free := make(map[string]bool)
+	for _, name := range names {
+		free[name.Family] = name.Free
+	}
+	assert.Equal(t, map[string]bool{"foo": true, "bar": true, "baz": false}, free)
+}
+
 func reset(mng name_manager.NameManager) {
 	if runtime.GOOS == "windows" {
 		// FIXME: On Windows, "reset" fails with